@@ -0,0 +1,518 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	_ "modernc.org/sqlite"
+)
+
+type Address struct {
+	AddressID    int
+	UserID       string
+	Name         string
+	Street       string
+	Unit         string
+	City         string
+	Province     string
+	PostalCode   string
+	Phone        string
+	Instructions string
+	IsDefault    bool
+	CreatedAt    time.Time
+	UpdatedAt    time.Time
+}
+
+// CheckoutAddress is the part of the checkout body that picks where a delivery goes,
+// a saved AddressID or a new Address. With neither the user's default is used.
+type CheckoutAddress struct {
+	AddressID int
+	Address   *Address
+}
+
+// the first letter of a postal code tells the province, X covers both territories
+var postalProvinces = map[string][]string{
+	"A": {"NL"},
+	"B": {"NS"},
+	"C": {"PE"},
+	"E": {"NB"},
+	"G": {"QC"}, "H": {"QC"}, "J": {"QC"},
+	"K": {"ON"}, "L": {"ON"}, "M": {"ON"}, "N": {"ON"}, "P": {"ON"},
+	"R": {"MB"},
+	"S": {"SK"},
+	"T": {"AB"},
+	"V": {"BC"},
+	"X": {"NT", "NU"},
+	"Y": {"YT"},
+}
+
+var nonDigits = regexp.MustCompile(`\D`)
+
+func initializeAddressesTable() error {
+	SQL_0 := `CREATE TABLE IF NOT EXISTS addresses (
+				address_id INTEGER PRIMARY KEY AUTOINCREMENT,
+				user_id TEXT,
+				name TEXT,
+				street TEXT,
+				unit TEXT,
+				city TEXT,
+				province TEXT,
+				postal_code TEXT,
+				phone TEXT,
+				instructions TEXT,
+				is_default BOOLEAN,
+				created_at TIMESTAMP,
+				updated_at TIMESTAMP
+			)`
+	_, err_0 := db.Exec(SQL_0)
+	if err_0 != nil {
+		return fmt.Errorf("failed to create addresses table: %v", err_0)
+	}
+
+	// a copy of the address as it was at checkout, editing the address book doesn't change it
+	SQL_1 := `CREATE TABLE IF NOT EXISTS order_addresses (
+				order_id TEXT PRIMARY KEY,
+				address_id INT,
+				user_id TEXT,
+				name TEXT,
+				street TEXT,
+				unit TEXT,
+				city TEXT,
+				province TEXT,
+				postal_code TEXT,
+				phone TEXT,
+				instructions TEXT,
+				is_default BOOLEAN,
+				created_at TIMESTAMP,
+				updated_at TIMESTAMP
+			)`
+	_, err_1 := db.Exec(SQL_1)
+	if err_1 != nil {
+		return fmt.Errorf("failed to create order_addresses table: %v", err_1)
+	}
+
+	return nil
+}
+
+// CUSTOMER
+
+func getMyAddresses(c *gin.Context) {
+	userID, err := currentUserID(c)
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": err.Error()})
+		return
+	}
+
+	SQL := `SELECT * FROM addresses WHERE user_id = ? ORDER BY is_default DESC, address_id`
+	rows, err := db.Query(SQL, userID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	defer rows.Close()
+
+	addresses, err := bindAddresses(rows)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.IndentedJSON(http.StatusOK, addresses)
+}
+
+func addAddress(c *gin.Context) {
+	userID, err := currentUserID(c)
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": err.Error()})
+		return
+	}
+
+	var address Address
+	if err := c.ShouldBindBodyWithJSON(&address); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if errs := validateAddress(&address); len(errs) > 0 {
+		validationFailed(c, errs)
+		return
+	}
+
+	// the first address saved is the default
+	var count int
+	if err := db.QueryRow(`SELECT COUNT(*) FROM addresses WHERE user_id = ?`, userID).Scan(&count); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	SQL := `INSERT INTO addresses (
+				user_id,
+				name,
+				street,
+				unit,
+				city,
+				province,
+				postal_code,
+				phone,
+				instructions,
+				is_default,
+				created_at,
+				updated_at) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`
+	result, err := db.Exec(SQL, userID, address.Name, address.Street, address.Unit, address.City, address.Province,
+		address.PostalCode, address.Phone, address.Instructions, false, time.Now(), time.Now())
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	addressID, _ := result.LastInsertId()
+
+	if count == 0 || address.IsDefault {
+		if err := setDefault(userID, int(addressID)); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "address saved", "address_id": addressID})
+}
+
+func updateAddress(c *gin.Context) {
+	userID, err := currentUserID(c)
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": err.Error()})
+		return
+	}
+
+	addressID := c.Param("address_id")
+
+	var address Address
+	if err := c.ShouldBindBodyWithJSON(&address); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if errs := validateAddress(&address); len(errs) > 0 {
+		validationFailed(c, errs)
+		return
+	}
+
+	SQL := `UPDATE addresses SET (
+				name,
+				street,
+				unit,
+				city,
+				province,
+				postal_code,
+				phone,
+				instructions,
+				updated_at) = (?, ?, ?, ?, ?, ?, ?, ?, ?) WHERE address_id = ? AND user_id = ?`
+	result, err := db.Exec(SQL, address.Name, address.Street, address.Unit, address.City, address.Province,
+		address.PostalCode, address.Phone, address.Instructions, time.Now(), addressID, userID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "address not found: " + addressID})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "address updated: " + addressID})
+}
+
+func deleteAddress(c *gin.Context) {
+	userID, err := currentUserID(c)
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": err.Error()})
+		return
+	}
+
+	addressID := c.Param("address_id")
+
+	address, err := getAddress(userID, addressID)
+	if err == sql.ErrNoRows {
+		c.JSON(http.StatusNotFound, gin.H{"error": "address not found: " + addressID})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	SQL := `DELETE FROM addresses WHERE address_id = ? AND user_id = ?`
+	if _, err := db.Exec(SQL, addressID, userID); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	// hand the default on to the newest address left
+	if address.IsDefault {
+		var next int
+		err := db.QueryRow(`SELECT address_id FROM addresses WHERE user_id = ? ORDER BY address_id DESC LIMIT 1`, userID).Scan(&next)
+		if err != nil && err != sql.ErrNoRows {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		if err == nil {
+			if err := setDefault(userID, next); err != nil {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+				return
+			}
+		}
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "address deleted: " + addressID})
+}
+
+func setDefaultAddress(c *gin.Context) {
+	userID, err := currentUserID(c)
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": err.Error()})
+		return
+	}
+
+	addressID := c.Param("address_id")
+
+	address, err := getAddress(userID, addressID)
+	if err == sql.ErrNoRows {
+		c.JSON(http.StatusNotFound, gin.H{"error": "address not found: " + addressID})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	if err := setDefault(userID, address.AddressID); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "default address set: " + addressID})
+}
+
+// VALIDATION
+
+// validateAddress checks the required fields and normalizes the province, postal
+// code and phone so stored addresses all look the same.
+func validateAddress(address *Address) []ValidationError {
+	errs := []ValidationError{}
+
+	address.Name = strings.TrimSpace(address.Name)
+	address.Street = strings.TrimSpace(address.Street)
+	address.Unit = strings.TrimSpace(address.Unit)
+	address.City = strings.TrimSpace(address.City)
+	address.Province = strings.ToUpper(strings.TrimSpace(address.Province))
+
+	if address.Name == "" {
+		errs = append(errs, ValidationError{Field: "Name", Message: "is required"})
+	}
+	if address.Street == "" {
+		errs = append(errs, ValidationError{Field: "Street", Message: "is required"})
+	}
+	if address.City == "" {
+		errs = append(errs, ValidationError{Field: "City", Message: "is required"})
+	}
+
+	postalCode, ok := findPostalCode(address.PostalCode)
+	if !ok || len(strings.ReplaceAll(strings.TrimSpace(address.PostalCode), " ", "")) != 6 {
+		errs = append(errs, ValidationError{Field: "PostalCode", Message: "must be a Canadian postal code like M5V 2T6"})
+	} else {
+		address.PostalCode = postalCode
+	}
+
+	provinces, known := postalProvinces[postalCode[:min(len(postalCode), 1)]]
+	switch {
+	case address.Province == "":
+		errs = append(errs, ValidationError{Field: "Province", Message: "is required"})
+	case !isProvince(address.Province):
+		errs = append(errs, ValidationError{Field: "Province", Message: "must be a province code like ON"})
+	case ok && known && !contains(provinces, address.Province):
+		errs = append(errs, ValidationError{Field: "PostalCode", Message: postalCode + " is not in " + address.Province})
+	}
+
+	if address.Phone != "" {
+		digits := nonDigits.ReplaceAllString(address.Phone, "")
+		if len(digits) == 11 && digits[0] == '1' {
+			digits = digits[1:]
+		}
+		if len(digits) != 10 {
+			errs = append(errs, ValidationError{Field: "Phone", Message: "must be a 10 digit phone number"})
+		} else {
+			address.Phone = fmt.Sprintf("%s-%s-%s", digits[:3], digits[3:6], digits[6:])
+		}
+	}
+
+	return errs
+}
+
+func isProvince(code string) bool {
+	for _, provinces := range postalProvinces {
+		if contains(provinces, code) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// String is the one line form stored in orders.delivery_address.
+func (a Address) String() string {
+	street := a.Street
+	if a.Unit != "" {
+		street = a.Unit + "-" + a.Street
+	}
+
+	return fmt.Sprintf("%s, %s, %s %s", street, a.City, a.Province, a.PostalCode)
+}
+
+// CHECKOUT
+
+// checkoutAddress works out where a delivery goes: a saved address of the cart's
+// owner, a new address in the body, or the owner's default address.
+func checkoutAddress(c *gin.Context, ownerID string) (Address, []ValidationError, error) {
+	var body CheckoutAddress
+	if err := c.ShouldBindBodyWithJSON(&body); err != nil {
+		return Address{}, nil, err
+	}
+
+	switch {
+	case body.AddressID != 0:
+		address, err := getAddress(ownerID, fmt.Sprint(body.AddressID))
+		if err == sql.ErrNoRows {
+			return Address{}, []ValidationError{{Field: "AddressID", Message: "is not in your address book"}}, nil
+		}
+		return address, nil, err
+
+	case body.Address != nil:
+		address := *body.Address
+		if errs := validateAddress(&address); len(errs) > 0 {
+			return Address{}, errs, nil
+		}
+		return address, nil, nil
+	}
+
+	SQL := `SELECT * FROM addresses WHERE user_id = ? AND is_default = true`
+	rows, err := db.Query(SQL, ownerID)
+	if err != nil {
+		return Address{}, nil, err
+	}
+	defer rows.Close()
+
+	addresses, err := bindAddresses(rows)
+	if err != nil {
+		return Address{}, nil, err
+	}
+	if len(addresses) == 0 {
+		return Address{}, []ValidationError{{Field: "Address", Message: "choose a delivery address"}}, nil
+	}
+
+	return addresses[0], nil, nil
+}
+
+func pushOrderAddress(ex execer, orderID string, address Address) error {
+	SQL_0 := `INSERT OR REPLACE INTO order_addresses (
+				order_id,
+				address_id,
+				user_id,
+				name,
+				street,
+				unit,
+				city,
+				province,
+				postal_code,
+				phone,
+				instructions,
+				is_default,
+				created_at,
+				updated_at) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`
+	_, err := ex.Exec(SQL_0, orderID, address.AddressID, address.UserID, address.Name, address.Street, address.Unit, address.City,
+		address.Province, address.PostalCode, address.Phone, address.Instructions, address.IsDefault, time.Now(), time.Now())
+	if err != nil {
+		return err
+	}
+
+	// keep the text column filled for the CSV export and older clients
+	SQL_1 := `UPDATE orders SET delivery_address = ? WHERE order_id = ?`
+	_, err = ex.Exec(SQL_1, address.String(), orderID)
+	if err != nil {
+		return err
+	} else {
+		return nil
+	}
+}
+
+// getOrderAddress returns the delivery address snapshot, nil for pickup orders and
+// orders placed before the address book.
+func getOrderAddress(orderID string) (*Address, error) {
+	SQL := `SELECT address_id, user_id, name, street, unit, city, province, postal_code, phone, instructions, is_default, created_at, updated_at
+			FROM order_addresses WHERE order_id = ?`
+	rows, err := db.Query(SQL, orderID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	addresses, err := bindAddresses(rows)
+	if err != nil || len(addresses) == 0 {
+		return nil, err
+	}
+
+	return &addresses[0], nil
+}
+
+func getAddress(userID string, addressID string) (Address, error) {
+	SQL := `SELECT * FROM addresses WHERE address_id = ? AND user_id = ?`
+	rows, err := db.Query(SQL, addressID, userID)
+	if err != nil {
+		return Address{}, err
+	}
+	defer rows.Close()
+
+	addresses, err := bindAddresses(rows)
+	if err != nil {
+		return Address{}, err
+	}
+	if len(addresses) == 0 {
+		return Address{}, sql.ErrNoRows
+	}
+
+	return addresses[0], nil
+}
+
+func setDefault(userID string, addressID int) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(`UPDATE addresses SET is_default = false WHERE user_id = ?`, userID); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(`UPDATE addresses SET is_default = true WHERE user_id = ? AND address_id = ?`, userID, addressID); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func bindAddresses(rows *sql.Rows) ([]Address, error) {
+	addresses := []Address{}
+	for rows.Next() {
+		var a Address
+		err := rows.Scan(&a.AddressID, &a.UserID, &a.Name, &a.Street, &a.Unit, &a.City, &a.Province, &a.PostalCode,
+			&a.Phone, &a.Instructions, &a.IsDefault, &a.CreatedAt, &a.UpdatedAt)
+		if err != nil {
+			return addresses, err
+		}
+		addresses = append(addresses, a)
+	}
+
+	return addresses, nil
+}
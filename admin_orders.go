@@ -0,0 +1,363 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/csv"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	_ "modernc.org/sqlite"
+)
+
+type OrderNote struct {
+	NoteID    int
+	OrderID   string
+	AuthorID  string
+	Note      string
+	CreatedAt time.Time
+}
+
+type AdminOrderDetail struct {
+	OrderDetail
+	CustomerName  string
+	CustomerEmail string
+	InternalNotes []OrderNote
+}
+
+type BulkStatusUpdate struct {
+	OrderIDs []string
+	Status   string
+	Note     string
+}
+
+func initializeOrderNotesTable() error {
+	SQL := `
+		CREATE TABLE IF NOT EXISTS order_notes (
+			note_id INTEGER PRIMARY KEY AUTOINCREMENT,
+			order_id TEXT,
+			author_id TEXT,
+			note TEXT,
+			created_at TIMESTAMP
+		)`
+	_, err := db.Exec(SQL)
+	if err != nil {
+		return err
+	} else {
+		return nil
+	}
+}
+
+// orderFilter builds the WHERE clause shared by the admin list and CSV export from
+// the query string: status, from and to (YYYY-MM-DD, inclusive), fulfillment
+// (pickup or delivery) and q, matching an order id or the customer's username or email.
+func orderFilter(c *gin.Context) (string, []any, []ValidationError) {
+	where := []string{"1 = 1"}
+	args := []any{}
+	errs := []ValidationError{}
+
+	if status := c.Query("status"); status != "" {
+		if !isOrderStatus(status) {
+			errs = append(errs, ValidationError{Field: "status", Message: "unknown order status"})
+		}
+		where = append(where, "status = ?")
+		args = append(args, status)
+	}
+
+	// created_at is stored as local time text, so comparing date prefixes is enough
+	if from := c.Query("from"); from != "" {
+		date, err := time.Parse("2006-01-02", from)
+		if err != nil {
+			errs = append(errs, ValidationError{Field: "from", Message: "must be a date like 2024-09-30"})
+		}
+		where = append(where, "created_at >= ?")
+		args = append(args, date.Format("2006-01-02"))
+	}
+	if to := c.Query("to"); to != "" {
+		date, err := time.Parse("2006-01-02", to)
+		if err != nil {
+			errs = append(errs, ValidationError{Field: "to", Message: "must be a date like 2024-09-30"})
+		}
+		where = append(where, "created_at < ?")
+		args = append(args, date.AddDate(0, 0, 1).Format("2006-01-02"))
+	}
+
+	switch c.Query("fulfillment") {
+	case "":
+	case "delivery":
+		where = append(where, "LOWER(CAST(id_delivery AS TEXT)) IN ('true', '1')")
+	case "pickup":
+		where = append(where, "LOWER(CAST(COALESCE(id_delivery, '') AS TEXT)) NOT IN ('true', '1')")
+	default:
+		errs = append(errs, ValidationError{Field: "fulfillment", Message: "must be pickup or delivery"})
+	}
+
+	if q := strings.TrimSpace(c.Query("q")); q != "" {
+		like := "%" + q + "%"
+		where = append(where, "(order_id LIKE ? OR user_id IN (SELECT id FROM users WHERE username LIKE ? OR email LIKE ?))")
+		args = append(args, like, like, like)
+	}
+
+	return strings.Join(where, " AND "), args, errs
+}
+
+func adminGetOrders(c *gin.Context) {
+	where, args, errs := orderFilter(c)
+
+	page, err := strconv.Atoi(c.DefaultQuery("page", "1"))
+	if err != nil || page < 1 {
+		errs = append(errs, ValidationError{Field: "page", Message: "must be 1 or more"})
+	}
+	perPage, err := strconv.Atoi(c.DefaultQuery("per_page", "25"))
+	if err != nil || perPage < 1 || perPage > 200 {
+		errs = append(errs, ValidationError{Field: "per_page", Message: "must be between 1 and 200"})
+	}
+	if len(errs) > 0 {
+		validationFailed(c, errs)
+		return
+	}
+
+	var total int
+	if err := db.QueryRow(`SELECT COUNT(*) FROM orders WHERE `+where, args...).Scan(&total); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	SQL := `SELECT ` + orderColumns + ` FROM orders WHERE ` + where + ` ORDER BY created_at DESC LIMIT ? OFFSET ?`
+	rows, err := db.Query(SQL, append(args, perPage, (page-1)*perPage)...)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	defer rows.Close()
+
+	orders, err := bindOrders(rows)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.IndentedJSON(http.StatusOK, gin.H{"orders": orders, "page": page, "per_page": perPage, "total": total})
+}
+
+func adminGetOrder(c *gin.Context) {
+	orderID := c.Param("order_id")
+
+	detail, err := getOrderDetail(orderID)
+	if err == sql.ErrNoRows {
+		c.JSON(http.StatusNotFound, gin.H{"error": "order not found: " + orderID})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	name, email, err := getUserContact(detail.Order.UserID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	notes, err := getOrderNotes(orderID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.IndentedJSON(http.StatusOK, AdminOrderDetail{
+		OrderDetail:   detail,
+		CustomerName:  name,
+		CustomerEmail: email,
+		InternalNotes: notes,
+	})
+}
+
+// adminBulkUpdateStatus moves every listed order it can and reports the ones it couldn't,
+// one illegal transition doesn't stop the rest.
+func adminBulkUpdateStatus(c *gin.Context) {
+	p, err := currentPrincipal(c)
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": err.Error()})
+		return
+	}
+
+	var update BulkStatusUpdate
+	if err := c.ShouldBindBodyWithJSON(&update); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	errs := []ValidationError{}
+	if len(update.OrderIDs) == 0 {
+		errs = append(errs, ValidationError{Field: "OrderIDs", Message: "is required"})
+	}
+	if !isOrderStatus(update.Status) {
+		errs = append(errs, ValidationError{Field: "Status", Message: "unknown order status"})
+	}
+	if len(errs) > 0 {
+		validationFailed(c, errs)
+		return
+	}
+
+	if !p.Can(statusPermission(update.Status)) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "requires the " + statusPermission(update.Status) + " permission"})
+		return
+	}
+
+	updated := []string{}
+	failed := map[string]string{}
+	for _, orderID := range update.OrderIDs {
+		order, err := getOrder(orderID)
+		if err == sql.ErrNoRows {
+			failed[orderID] = "order not found"
+			continue
+		}
+		if err != nil {
+			failed[orderID] = err.Error()
+			continue
+		}
+		if needsRefund(order, update.Status) && !p.Can(PermRefundsIssue) {
+			failed[orderID] = "the order is paid, cancelling it requires the " + PermRefundsIssue + " permission"
+			continue
+		}
+
+		if _, err := transitionWithRefund(order, update.Status, p.UserID, update.Note); err != nil {
+			failed[orderID] = err.Error()
+			continue
+		}
+		updated = append(updated, orderID)
+	}
+
+	c.JSON(http.StatusOK, gin.H{"updated": updated, "failed": failed})
+}
+
+func adminAddOrderNote(c *gin.Context) {
+	adminID, err := currentUserID(c)
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": err.Error()})
+		return
+	}
+
+	orderID := c.Param("order_id")
+
+	var note OrderNote
+	if err := c.ShouldBindBodyWithJSON(&note); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if strings.TrimSpace(note.Note) == "" {
+		validationFailed(c, []ValidationError{{Field: "Note", Message: "is required"}})
+		return
+	}
+
+	if _, err := getOrder(orderID); err == sql.ErrNoRows {
+		c.JSON(http.StatusNotFound, gin.H{"error": "order not found: " + orderID})
+		return
+	} else if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	SQL := `INSERT INTO order_notes (order_id, author_id, note, created_at) VALUES (?, ?, ?, ?)`
+	_, err = db.Exec(SQL, orderID, adminID, note.Note, time.Now())
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	message := fmt.Sprintf(`added note to order %s`, orderID)
+
+	c.JSON(http.StatusOK, gin.H{"message": message})
+}
+
+func adminExportOrders(c *gin.Context) {
+	where, args, errs := orderFilter(c)
+	if len(errs) > 0 {
+		validationFailed(c, errs)
+		return
+	}
+
+	SQL := `SELECT ` + orderColumns + ` FROM orders WHERE ` + where + ` ORDER BY created_at DESC`
+	rows, err := db.Query(SQL, args...)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	orders, err := bindOrders(rows)
+	rows.Close()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	filename := fmt.Sprintf("orders-%s.csv", time.Now().Format("2006-01-02"))
+	c.Header("Content-Type", "text/csv")
+	c.Header("Content-Disposition", `attachment; filename="`+filename+`"`)
+
+	w := csv.NewWriter(c.Writer)
+	w.Write([]string{"order_id", "created_at", "status", "customer_id", "customer_name", "customer_email", "delivery",
+		"delivery_address", "ready_date", "subtotal", "discount", "delivery_fee", "tax", "total", "payment_id", "notes"})
+
+	for _, order := range orders {
+		name, email, err := getUserContact(order.UserID)
+		if err != nil {
+			name, email = "", ""
+		}
+
+		w.Write([]string{
+			order.OrderID,
+			order.CreatedAt.Format(time.RFC3339),
+			order.Status,
+			order.UserID,
+			csvCell(name),
+			csvCell(email),
+			csvCell(order.IsDelivery),
+			csvCell(order.DeliveryAddress),
+			order.ReadyDate.Format(time.RFC3339),
+			strconv.Itoa(order.Subtotal),
+			strconv.Itoa(order.Discount),
+			strconv.Itoa(order.DeliveryFee),
+			strconv.Itoa(order.Tax),
+			strconv.Itoa(order.TotalPrice),
+			order.PaymentID,
+			csvCell(order.Notes),
+		})
+	}
+
+	w.Flush()
+}
+
+// csvCell keeps text a customer typed from being read as a formula when the export
+// is opened in a spreadsheet.
+func csvCell(value string) string {
+	if value != "" && strings.ContainsRune("=+-@\t\r", rune(value[0])) {
+		return "'" + value
+	}
+
+	return value
+}
+
+func getOrderNotes(orderID string) ([]OrderNote, error) {
+	SQL := `SELECT * FROM order_notes WHERE order_id = ? ORDER BY note_id`
+	rows, err := db.Query(SQL, orderID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	notes := []OrderNote{}
+	for rows.Next() {
+		var note OrderNote
+		err := rows.Scan(&note.NoteID, &note.OrderID, &note.AuthorID, &note.Note, &note.CreatedAt)
+		if err != nil {
+			return notes, err
+		}
+		notes = append(notes, note)
+	}
+
+	return notes, nil
+}
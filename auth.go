@@ -0,0 +1,152 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	_ "modernc.org/sqlite"
+)
+
+// Principal is who is making the request, as read from their token.
+type Principal struct {
+	UserID    string
+	SessionID string
+	Role      string
+}
+
+func (p Principal) Can(permission string) bool {
+	return roleCan(p.Role, permission)
+}
+
+const (
+	principalKey = "principal"
+	authErrorKey = "auth_error"
+)
+
+// authenticate reads the token from the token header, or an Authorization: Bearer
+// header, and puts the principal on the context. Requests without a usable token go
+// through anonymously, routes that need a login turn them away with the reason.
+func authenticate() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		token := requestToken(c)
+		if token == "" {
+			c.Next()
+			return
+		}
+
+		userID, sessionID, err := validateSession(token)
+		if err != nil {
+			c.Set(authErrorKey, err)
+			c.Next()
+			return
+		}
+
+		role, err := getRole(userID)
+		if err != nil {
+			c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+
+		c.Set(principalKey, Principal{UserID: userID, SessionID: sessionID, Role: role})
+		c.Next()
+	}
+}
+
+func requestToken(c *gin.Context) string {
+	if token := c.GetHeader("token"); token != "" {
+		return token
+	}
+
+	scheme, token, found := strings.Cut(c.GetHeader("Authorization"), " ")
+	if found && strings.EqualFold(scheme, "Bearer") {
+		return strings.TrimSpace(token)
+	}
+
+	return ""
+}
+
+// currentPrincipal returns the logged in caller, or why there isn't one.
+func currentPrincipal(c *gin.Context) (Principal, error) {
+	if p, ok := c.Get(principalKey); ok {
+		return p.(Principal), nil
+	}
+	if err, ok := c.Get(authErrorKey); ok {
+		return Principal{}, err.(error)
+	}
+
+	return Principal{}, fmt.Errorf("login required")
+}
+
+func requireLogin() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if _, err := currentPrincipal(c); err != nil {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": err.Error()})
+			return
+		}
+
+		c.Next()
+	}
+}
+
+// requireCartAccess guards routes taking a :cart_id, see cartAccess.
+func requireCartAccess() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if !cartAccess(c, c.Param("cart_id")) {
+			c.Abort()
+			return
+		}
+
+		c.Next()
+	}
+}
+
+// cartAccess answers for the caller and returns false unless they may use the cart.
+// A cart belonging to a registered user is theirs alone. Guest carts have no login
+// to check, knowing the cart's random id is what lets a guest shop with it. Guest
+// carts from before ids were random could be guessed and aren't served.
+func cartAccess(c *gin.Context, cartID string) bool {
+	ownerID := cartOwner(cartID)
+	if ownerID == "" {
+		c.JSON(http.StatusNotFound, gin.H{"error": "cart not found: " + cartID})
+		return false
+	}
+
+	var registered bool
+	SQL := `SELECT EXISTS (SELECT 1 FROM users WHERE id = ? AND username IS NOT NULL)`
+	if err := db.QueryRow(SQL, ownerID).Scan(&registered); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return false
+	}
+	if !registered {
+		if !randomCartID(cartID) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "cart not found: " + cartID})
+			return false
+		}
+		return true
+	}
+
+	p, err := currentPrincipal(c)
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": err.Error()})
+		return false
+	}
+	if p.UserID != ownerID {
+		c.JSON(http.StatusNotFound, gin.H{"error": "cart not found: " + cartID})
+		return false
+	}
+
+	return true
+}
+
+// whoAmI tells the frontend who is logged in and what they may do.
+func whoAmI(c *gin.Context) {
+	p, err := currentPrincipal(c)
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"user_id": p.UserID, "is_admin": p.Role != RoleCustomer, "role": p.Role, "permissions": rolePermissions[p.Role]})
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	_ "modernc.org/sqlite"
+)
+
+type CartCleanupRun struct {
+	RunID        int
+	StartedAt    time.Time
+	IdleHours    int
+	CartsExpired int
+	ItemsPurged  int
+	Error        string
+}
+
+func initializeCartCleanupTable() error {
+	SQL := `
+		CREATE TABLE IF NOT EXISTS cart_cleanup_runs (
+			run_id INTEGER PRIMARY KEY AUTOINCREMENT,
+			started_at TIMESTAMP,
+			idle_hours INT,
+			carts_expired INT,
+			items_purged INT,
+			error TEXT
+		)`
+	_, err := db.Exec(SQL)
+	if err != nil {
+		return err
+	} else {
+		return nil
+	}
+}
+
+// cleanupCartsJob expires guest carts idle for CART_IDLE_HOURS (72).
+// Scheduled every CART_CLEANUP_MINUTES.
+func cleanupCartsJob(job Job) error {
+	run := expireGuestCarts(time.Duration(envInt("CART_IDLE_HOURS", 72)) * time.Hour)
+	if run.Error != "" {
+		return errors.New(run.Error)
+	}
+	if run.CartsExpired > 0 {
+		log.Printf("cart cleanup expired %d carts, purged %d items", run.CartsExpired, run.ItemsPurged)
+	}
+
+	return nil
+}
+
+// expireGuestCarts empties carts whose owner never registered and that have had no
+// activity for idle. The cart row stays, marked expired, so its id still resolves.
+func expireGuestCarts(idle time.Duration) CartCleanupRun {
+	run := CartCleanupRun{StartedAt: time.Now(), IdleHours: int(idle.Hours())}
+
+	cartIDs, err := findIdleGuestCarts(time.Now().Add(-idle))
+	if err != nil {
+		run.Error = err.Error()
+		return recordCleanupRun(run)
+	}
+
+	for _, cartID := range cartIDs {
+		purged, err := expireCart(cartID)
+		if err != nil {
+			run.Error = err.Error()
+			break
+		}
+		run.CartsExpired++
+		run.ItemsPurged += purged
+	}
+
+	return recordCleanupRun(run)
+}
+
+func findIdleGuestCarts(cutoff time.Time) ([]string, error) {
+	SQL := `SELECT cart_id, last_activity_at FROM carts
+			WHERE expired_at IS NULL
+			AND NOT EXISTS (
+				SELECT 1 FROM users WHERE users.id = carts.owner_id AND COALESCE(users.username, '') != ''
+			)`
+	rows, err := db.Query(SQL)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	cartIDs := []string{}
+	for rows.Next() {
+		var cartID string
+		var lastActivity sql.NullTime
+		if err := rows.Scan(&cartID, &lastActivity); err != nil {
+			return nil, err
+		}
+		if lastActivity.Valid && lastActivity.Time.Before(cutoff) {
+			cartIDs = append(cartIDs, cartID)
+		}
+	}
+
+	return cartIDs, nil
+}
+
+func expireCart(cartID string) (int, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	result, err := tx.Exec(`DELETE FROM cart_items WHERE cart_id = ?`, cartID)
+	if err != nil {
+		return 0, err
+	}
+	purged, _ := result.RowsAffected()
+
+	if _, err := tx.Exec(`DELETE FROM cart_coupons WHERE cart_id = ?`, cartID); err != nil {
+		return 0, err
+	}
+
+	if _, err := tx.Exec(`UPDATE carts SET (expired_at, updated_at) = (?, ?) WHERE cart_id = ?`, time.Now(), time.Now(), cartID); err != nil {
+		return 0, err
+	}
+
+	return int(purged), tx.Commit()
+}
+
+func recordCleanupRun(run CartCleanupRun) CartCleanupRun {
+	SQL := `INSERT INTO cart_cleanup_runs (started_at, idle_hours, carts_expired, items_purged, error) VALUES (?, ?, ?, ?, ?)`
+	result, err := db.Exec(SQL, run.StartedAt, run.IdleHours, run.CartsExpired, run.ItemsPurged, run.Error)
+	if err != nil {
+		log.Printf("failed to record cart cleanup run: %v", err)
+		return run
+	}
+
+	id, _ := result.LastInsertId()
+	run.RunID = int(id)
+
+	return run
+}
+
+func getCartCleanupMetrics(c *gin.Context) {
+	SQL_0 := `SELECT COUNT(*), COALESCE(SUM(carts_expired), 0), COALESCE(SUM(items_purged), 0) FROM cart_cleanup_runs`
+
+	var runs, cartsExpired, itemsPurged int
+	if err := db.QueryRow(SQL_0).Scan(&runs, &cartsExpired, &itemsPurged); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	SQL_1 := `SELECT * FROM cart_cleanup_runs ORDER BY run_id DESC LIMIT 20`
+	rows, err := db.Query(SQL_1)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	defer rows.Close()
+
+	recent := []CartCleanupRun{}
+	for rows.Next() {
+		var run CartCleanupRun
+		err := rows.Scan(&run.RunID, &run.StartedAt, &run.IdleHours, &run.CartsExpired, &run.ItemsPurged, &run.Error)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		recent = append(recent, run)
+	}
+
+	c.IndentedJSON(http.StatusOK, gin.H{
+		"runs":          runs,
+		"carts_expired": cartsExpired,
+		"items_purged":  itemsPurged,
+		"recent_runs":   recent,
+	})
+}
@@ -1,8 +1,10 @@
 package main
 
 import (
+	"database/sql"
 	"fmt"
 	"net/http"
+	"strconv"
 
 	"github.com/gin-gonic/gin"
 	_ "modernc.org/sqlite"
@@ -30,6 +32,25 @@ func initializeCartItemsTable() error {
 			notes TEXT
 		)`
 	_, err := db.Exec(SQL)
+	if err != nil {
+		return err
+	}
+
+	// one line per product and size, lines doubled up by concurrent adds are merged first
+	SQL_1 := `UPDATE cart_items SET quantity = (
+				SELECT SUM(d.quantity) FROM cart_items d WHERE (d.cart_id, d.product_id, d.size) = (cart_items.cart_id, cart_items.product_id, cart_items.size)
+			) WHERE item_id IN (SELECT MIN(item_id) FROM cart_items GROUP BY cart_id, product_id, size HAVING COUNT(*) > 1)`
+	if _, err := db.Exec(SQL_1); err != nil {
+		return err
+	}
+
+	SQL_2 := `DELETE FROM cart_items WHERE item_id NOT IN (SELECT MIN(item_id) FROM cart_items GROUP BY cart_id, product_id, size)`
+	if _, err := db.Exec(SQL_2); err != nil {
+		return err
+	}
+
+	SQL_3 := `CREATE UNIQUE INDEX IF NOT EXISTS cart_items_line ON cart_items (cart_id, product_id, size)`
+	_, err = db.Exec(SQL_3)
 	if err != nil {
 		return err
 	} else {
@@ -38,15 +59,39 @@ func initializeCartItemsTable() error {
 }
 
 func addToCart(c *gin.Context) {
-	SQL := `INSERT INTO cart_items (cart_id, product_id, size, price, quantity, notes) VALUES (?, ?, ?, ?, ?, ?);`
-
 	var cartItem CartItem
 	if err := c.ShouldBindBodyWithJSON(&cartItem); err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error_1": err.Error()})
 		return
 	}
 
-	_, err := db.Exec(SQL, cartItem.CartID, cartItem.ProductID, cartItem.Size, cartItem.Price, cartItem.Quantity, cartItem.Notes)
+	errs := []ValidationError{}
+	if cartItem.CartID == "" {
+		errs = append(errs, ValidationError{Field: "cart_id", Message: "is required"})
+	}
+	if cartItem.ProductID == "" {
+		errs = append(errs, ValidationError{Field: "product_id", Message: "is required"})
+	}
+	if cartItem.Size == "" {
+		errs = append(errs, ValidationError{Field: "Size", Message: "is required"})
+	}
+	if cartItem.Quantity < 1 {
+		errs = append(errs, ValidationError{Field: "Quantity", Message: "must be at least 1"})
+	}
+	if len(errs) > 0 {
+		validationFailed(c, errs)
+		return
+	}
+
+	if !cartAccess(c, cartItem.CartID) {
+		return
+	}
+
+	quantity, err := addItemToCart(cartItem)
+	if ve, ok := err.(*ValidationError); ok {
+		validationFailed(c, []ValidationError{*ve})
+		return
+	}
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error_2": err.Error()})
 		return
@@ -54,20 +99,23 @@ func addToCart(c *gin.Context) {
 
 	message := fmt.Sprintf(`item %s added to cart %s`, cartItem.ProductID, cartItem.CartID)
 
-	c.JSON(http.StatusOK, gin.H{"message": message})
+	c.JSON(http.StatusOK, gin.H{"message": message, "quantity": quantity})
 }
 
 func removeFromCart(c *gin.Context) {
 	cartID := c.Param("cart_id")
 	itemID := c.Param("item_id")
-	SQL := `DELETE FROM cart_items WHERE (cart_id, item_id) = (?, ?)`
 
-	_, err := db.Exec(SQL, itemID)
-	if err != nil {
+	if err := deleteCartItem(cartID, itemID); err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error_1": err.Error()})
 		return
 	}
 
+	if err := touchCart(cartID); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
 	message := fmt.Sprintf(`removed %s from cart %s`, itemID, cartID)
 
 	c.JSON(http.StatusOK, gin.H{"message": message})
@@ -76,41 +124,175 @@ func removeFromCart(c *gin.Context) {
 func changeQuantity(c *gin.Context) {
 	cartID := c.Param("cart_id")
 	itemID := c.Param("item_id")
-	quantity := c.Param("quantity")
-	SQL := `UPDATE cart_items SET quantity = ? WHERE (cart_id, item_id) = (?, ?)`
 
-	_, err := db.Exec(SQL, quantity, cartID, itemID)
+	quantity, err := strconv.Atoi(c.Param("quantity"))
+	if err != nil || quantity < 0 {
+		validationFailed(c, []ValidationError{{Field: "quantity", Message: "must be a whole number of 0 or more"}})
+		return
+	}
+
+	if quantity == 0 {
+		if err := deleteCartItem(cartID, itemID); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+
+		if err := touchCart(cartID); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+
+		message := fmt.Sprintf(`removed %s from cart %s`, itemID, cartID)
+
+		c.JSON(http.StatusOK, gin.H{"message": message})
+		return
+	}
+
+	var lineID int
+	var productID string
+	SQL_0 := `SELECT item_id, product_id FROM cart_items WHERE (cart_id, item_id) = (?, ?)`
+	err = db.QueryRow(SQL_0, cartID, itemID).Scan(&lineID, &productID)
+	if err == sql.ErrNoRows {
+		c.JSON(http.StatusNotFound, gin.H{"error": fmt.Sprintf(`item %s is not in cart %s`, itemID, cartID)})
+		return
+	}
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
 
-	message := fmt.Sprintf(`changed %s's quantity to %s in cart %s`, itemID, quantity, cartID)
+	if err := checkMaxQuantity(cartID, productID, lineID, quantity); err != nil {
+		validationFailed(c, []ValidationError{*err})
+		return
+	}
+
+	SQL := `UPDATE cart_items SET quantity = ? WHERE (cart_id, item_id) = (?, ?)`
+	_, err = db.Exec(SQL, quantity, cartID, itemID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	if err := touchCart(cartID); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	message := fmt.Sprintf(`changed %s's quantity to %d in cart %s`, itemID, quantity, cartID)
 
 	c.JSON(http.StatusOK, gin.H{"message": message})
 }
 
+// addItemToCart adds the line or, when the same product and size is already in the
+// cart, bumps its quantity. It returns the line's new quantity.
+func addItemToCart(cartItem CartItem) (int, error) {
+	// whatever price the client sent is ignored, the line takes the price list's
+	price, found, err := getCurrentPrice(cartItem.ProductID, cartItem.Size)
+	if err != nil {
+		return 0, err
+	}
+	if !found {
+		return 0, &ValidationError{Field: "Size", Message: fmt.Sprintf("%s isn't sold in size %s", cartItem.ProductID, cartItem.Size)}
+	}
+
+	existing, err := findCartItem(cartItem.CartID, cartItem.ProductID, cartItem.Size)
+	if err != nil {
+		return 0, err
+	}
+
+	if err := checkMaxQuantity(cartItem.CartID, cartItem.ProductID, existing.CartItemID, existing.Quantity+cartItem.Quantity); err != nil {
+		return 0, err
+	}
+
+	// the unique line index makes concurrent adds of the same size add up on one line
+	var quantity int
+	SQL := `INSERT INTO cart_items (cart_id, product_id, size, price, quantity, notes) VALUES (?, ?, ?, ?, ?, ?)
+			ON CONFLICT (cart_id, product_id, size) DO UPDATE SET (quantity, price) = (quantity + excluded.quantity, excluded.price)
+			RETURNING quantity`
+	err = db.QueryRow(SQL, cartItem.CartID, cartItem.ProductID, cartItem.Size, price, cartItem.Quantity, cartItem.Notes).Scan(&quantity)
+	if err != nil {
+		return 0, err
+	}
+
+	if err := touchCart(cartItem.CartID); err != nil {
+		return 0, err
+	}
+
+	return quantity, nil
+}
+
+func findCartItem(cartID string, productID string, size string) (CartItem, error) {
+	SQL := `SELECT * FROM cart_items WHERE (cart_id, product_id, size) = (?, ?, ?)`
+	rows, err := db.Query(SQL, cartID, productID, size)
+	if err != nil {
+		return CartItem{}, err
+	}
+	defer rows.Close()
+
+	items, err := bindCartItems(rows)
+	if err != nil || len(items) == 0 {
+		return CartItem{}, err
+	}
+
+	return items[0], nil
+}
+
+func deleteCartItem(cartID string, itemID string) error {
+	SQL := `DELETE FROM cart_items WHERE (cart_id, item_id) = (?, ?)`
+	_, err := db.Exec(SQL, cartID, itemID)
+	if err != nil {
+		return err
+	} else {
+		return nil
+	}
+}
+
+// checkMaxQuantity returns a validation error when the product's lines in the cart
+// would add up to more than its max_quantity, with line itemID (0 for a new line)
+// holding quantity. The limit covers every size together. Products without a limit
+// accept any quantity.
+func checkMaxQuantity(cartID string, productID string, itemID int, quantity int) *ValidationError {
+	maxQuantity, err := getProductMaxQuantity(productID)
+	if err != nil {
+		return &ValidationError{Field: "product_id", Message: err.Error()}
+	}
+	if maxQuantity <= 0 {
+		return nil
+	}
+
+	var others int
+	SQL := `SELECT COALESCE(SUM(quantity), 0) FROM cart_items WHERE (cart_id, product_id) = (?, ?) AND item_id != ?`
+	if err := db.QueryRow(SQL, cartID, productID, itemID).Scan(&others); err != nil {
+		return &ValidationError{Field: "product_id", Message: err.Error()}
+	}
+
+	if others+quantity > maxQuantity {
+		return &ValidationError{Field: "Quantity", Message: fmt.Sprintf("at most %d per order", maxQuantity)}
+	}
+
+	return nil
+}
+
 func getCartItems(c *gin.Context) {
 	cartID := c.Param("cart_id")
-	SQL := `SELECT * FROM cart_items WHERE cart_id = ?`
 
-	rows, err := db.Query(SQL, cartID)
+	items, err := getCartItemsByID(cartID)
 	if err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
-	defer rows.Close()
 
-	items := []CartItem{}
-	for rows.Next() {
-		var item CartItem
-		err := rows.Scan(&item.CartItemID, &item.CartID, &item.ProductID, &item.Size, &item.Price, &item.Quantity, &item.Notes)
-		if err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
-			return
-		}
-		items = append(items, item)
+	c.IndentedJSON(http.StatusOK, items)
+}
+
+func getCartItemsByID(cartID string) ([]CartItem, error) {
+	SQL := `SELECT * FROM cart_items WHERE cart_id = ?`
+
+	rows, err := db.Query(SQL, cartID)
+	if err != nil {
+		return nil, err
 	}
+	defer rows.Close()
 
-	c.IndentedJSON(http.StatusOK, items)
+	return bindCartItems(rows)
 }
@@ -0,0 +1,264 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	htmltemplate "html/template"
+	"log"
+	"net/http"
+	"text/template"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	_ "modernc.org/sqlite"
+)
+
+type CartReminder struct {
+	ReminderID int
+	CartID     string
+	Email      string
+	Token      string
+	SentAt     time.Time
+}
+
+type cartReminderData struct {
+	Username   string
+	Lines      []PricingLine
+	Subtotal   int
+	RestoreURL string
+}
+
+var cartReminderText = template.Must(template.New("cart_reminder").Funcs(template.FuncMap{"money": formatMoney}).Parse(
+	`Hi {{.Username}},
+
+You left a few things in your cart:
+{{range .Lines}}
+  {{.Quantity}} x {{.Name}} ({{.Size}})  {{money .LineTotal}}{{end}}
+
+Subtotal: {{money .Subtotal}}
+
+Pick up where you left off: {{.RestoreURL}}
+`))
+
+var cartReminderHTML = htmltemplate.Must(htmltemplate.New("cart_reminder").Funcs(htmltemplate.FuncMap{"money": formatMoney}).Parse(
+	`<p>Hi {{.Username}},</p>
+<p>You left a few things in your cart:</p>
+<table>
+{{range .Lines}}<tr><td>{{.Quantity}} x {{.Name}} ({{.Size}})</td><td>{{money .LineTotal}}</td></tr>
+{{end}}</table>
+<p>Subtotal: {{money .Subtotal}}</p>
+<p><a href="{{.RestoreURL}}">Return to your cart</a></p>
+`))
+
+func initializeCartRemindersTable() error {
+	SQL := `
+		CREATE TABLE IF NOT EXISTS cart_reminders (
+			reminder_id INTEGER PRIMARY KEY AUTOINCREMENT,
+			cart_id TEXT,
+			email TEXT,
+			token TEXT,
+			sent_at TIMESTAMP
+		)`
+	_, err := db.Exec(SQL)
+	if err != nil {
+		return err
+	} else {
+		return nil
+	}
+}
+
+// cartRemindersJob emails registered shoppers whose cart has been idle, at most
+// CART_REMINDER_MAX (2) times per stretch of inactivity and never after checkout.
+// Scheduled every CART_REMINDER_MINUTES, idle means CART_REMINDER_HOURS (24).
+func cartRemindersJob(job Job) error {
+	idle := time.Duration(envInt("CART_REMINDER_HOURS", 24)) * time.Hour
+
+	sent, err := sendCartReminders(idle, envInt("CART_REMINDER_MAX", 2))
+	if err != nil {
+		return err
+	}
+	if sent > 0 {
+		log.Printf("sent %d cart reminders", sent)
+	}
+
+	return nil
+}
+
+func sendCartReminders(idle time.Duration, maxReminders int) (int, error) {
+	SQL := `SELECT carts.cart_id, carts.last_activity_at, carts.checked_out_at, users.username, users.email
+			FROM carts JOIN users ON users.id = carts.owner_id
+			WHERE carts.expired_at IS NULL
+			AND COALESCE(users.email, '') != ''
+			AND EXISTS (SELECT 1 FROM cart_items WHERE cart_items.cart_id = carts.cart_id)
+			GROUP BY carts.cart_id`
+	rows, err := db.Query(SQL)
+	if err != nil {
+		return 0, err
+	}
+
+	type candidate struct {
+		cartID   string
+		username string
+		email    string
+		since    time.Time
+	}
+
+	cutoff := time.Now().Add(-idle)
+	candidates := []candidate{}
+	for rows.Next() {
+		var cartID string
+		var username sql.NullString
+		var email string
+		var lastActivity, checkedOut sql.NullTime
+		if err := rows.Scan(&cartID, &lastActivity, &checkedOut, &username, &email); err != nil {
+			rows.Close()
+			return 0, err
+		}
+
+		if !lastActivity.Valid || lastActivity.Time.After(cutoff) {
+			continue
+		}
+		// checking out ends the reminders until the shopper touches the cart again
+		if checkedOut.Valid && !checkedOut.Time.Before(lastActivity.Time) {
+			continue
+		}
+
+		candidates = append(candidates, candidate{cartID, username.String, email, lastActivity.Time})
+	}
+	rows.Close()
+
+	sent := 0
+	for _, cand := range candidates {
+		reminders, err := getCartReminders(cand.cartID, cand.since)
+		if err != nil {
+			return sent, err
+		}
+		if len(reminders) >= maxReminders {
+			continue
+		}
+		// space reminders out by the same idle period
+		if len(reminders) > 0 && reminders[len(reminders)-1].SentAt.After(cutoff) {
+			continue
+		}
+
+		if err := sendCartReminder(cand.cartID, cand.username, cand.email); err != nil {
+			log.Printf("cart reminder for %s failed: %v", cand.cartID, err)
+			continue
+		}
+		sent++
+	}
+
+	return sent, nil
+}
+
+func sendCartReminder(cartID string, username string, email string) error {
+	pricing, err := priceCart(cartID, 0)
+	if err != nil {
+		return err
+	}
+
+	token, err := randomToken()
+	if err != nil {
+		return err
+	}
+
+	data := cartReminderData{
+		Username:   username,
+		Lines:      pricing.Lines,
+		Subtotal:   pricing.Subtotal,
+		RestoreURL: shopURL() + "/carts/restore/" + token,
+	}
+
+	var text, html bytes.Buffer
+	if err := cartReminderText.Execute(&text, data); err != nil {
+		return err
+	}
+	if err := cartReminderHTML.Execute(&html, data); err != nil {
+		return err
+	}
+
+	mail := Mail{To: email, Subject: "You left something in your cart", Text: text.String(), HTML: html.String()}
+	if err := queueMail(db, EmailCartReminder, "", mail); err != nil {
+		return err
+	}
+
+	SQL := `INSERT INTO cart_reminders (cart_id, email, token, sent_at) VALUES (?, ?, ?, ?)`
+	_, err = db.Exec(SQL, cartID, email, token, time.Now())
+	if err != nil {
+		return err
+	} else {
+		return nil
+	}
+}
+
+func getCartReminders(cartID string, since time.Time) ([]CartReminder, error) {
+	SQL := `SELECT * FROM cart_reminders WHERE cart_id = ? ORDER BY reminder_id`
+	rows, err := db.Query(SQL, cartID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	reminders := []CartReminder{}
+	for rows.Next() {
+		var reminder CartReminder
+		err := rows.Scan(&reminder.ReminderID, &reminder.CartID, &reminder.Email, &reminder.Token, &reminder.SentAt)
+		if err != nil {
+			return reminders, err
+		}
+		if reminder.SentAt.After(since) {
+			reminders = append(reminders, reminder)
+		}
+	}
+
+	return reminders, nil
+}
+
+// restoreCart is the deep link target from a reminder email. It hands the cart id
+// back to the frontend and counts as activity on the cart. Links stop working
+// CART_RESTORE_DAYS (7) after the email was sent.
+func restoreCart(c *gin.Context) {
+	token := c.Param("token")
+	SQL := `SELECT cart_id, sent_at FROM cart_reminders WHERE token = ?`
+
+	var cartID string
+	var sentAt time.Time
+	err := db.QueryRow(SQL, token).Scan(&cartID, &sentAt)
+	if err == sql.ErrNoRows {
+		c.JSON(http.StatusNotFound, gin.H{"error": "unknown restore link"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	if time.Since(sentAt) > time.Duration(envInt("CART_RESTORE_DAYS", 7))*24*time.Hour {
+		c.JSON(http.StatusGone, gin.H{"error": "this restore link has expired"})
+		return
+	}
+
+	if err := touchCart(cartID); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	items, err := getCartItemsByID(cartID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.IndentedJSON(http.StatusOK, gin.H{"cart_id": cartID, "items": items})
+}
+
+func randomToken() (string, error) {
+	b := make([]byte, 24)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(b), nil
+}
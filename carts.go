@@ -3,6 +3,7 @@ package main
 import (
 	"database/sql"
 	"net/http"
+	"strconv"
 	"time"
 
 	"github.com/gin-gonic/gin"
@@ -10,9 +11,13 @@ import (
 )
 
 type Cart struct {
-	CartID    string
-	CreatedAt time.Time
-	UpdatedAt time.Time
+	CartID         string
+	CreatedAt      time.Time
+	UpdatedAt      time.Time
+	OwnerID        string
+	LastActivityAt time.Time
+	ExpiredAt      sql.NullTime
+	CheckedOutAt   sql.NullTime
 }
 
 func initializeCartsTable() error {
@@ -20,9 +25,38 @@ func initializeCartsTable() error {
 		CREATE TABLE IF NOT EXISTS carts (
 			cart_id TEXT,
 			created_at TIMESTAMP,
-			updated_at TIMESTAMP
+			updated_at TIMESTAMP,
+			owner_id TEXT,
+			last_activity_at TIMESTAMP,
+			expired_at TIMESTAMP,
+			checked_out_at TIMESTAMP
 		)`
 	_, err := db.Exec(SQL)
+	if err != nil {
+		return err
+	}
+
+	if err := addColumn("carts", "owner_id", "TEXT"); err != nil {
+		return err
+	}
+	if err := addColumn("carts", "last_activity_at", "TIMESTAMP"); err != nil {
+		return err
+	}
+	if err := addColumn("carts", "expired_at", "TIMESTAMP"); err != nil {
+		return err
+	}
+	if err := addColumn("carts", "checked_out_at", "TIMESTAMP"); err != nil {
+		return err
+	}
+
+	// carts made before owner_id existed were always named after their user, C000012 belongs to U000012
+	SQL_1 := `UPDATE carts SET owner_id = 'U' || substr(cart_id, 2) WHERE owner_id IS NULL`
+	if _, err := db.Exec(SQL_1); err != nil {
+		return err
+	}
+
+	SQL_2 := `UPDATE carts SET last_activity_at = updated_at WHERE last_activity_at IS NULL`
+	_, err = db.Exec(SQL_2)
 	if err != nil {
 		return err
 	} else {
@@ -30,10 +64,17 @@ func initializeCartsTable() error {
 	}
 }
 
+// createCart starts an empty cart for the user. Cart ids are random, a guest's cart
+// has no login guarding it so its id must not be guessable.
 func createCart(userID string) (string, error) {
-	cartID := "C" + userID[1:]
-	SQL := `INSERT INTO carts (cart_id, created_at, updated_at) VALUES (?, ?, ?)`
-	_, err := db.Exec(SQL, cartID, time.Now(), time.Now())
+	token, err := randomToken()
+	if err != nil {
+		return "", err
+	}
+
+	cartID := "C" + token
+	SQL := `INSERT INTO carts (cart_id, created_at, updated_at, owner_id, last_activity_at) VALUES (?, ?, ?, ?, ?)`
+	_, err = db.Exec(SQL, cartID, time.Now(), time.Now(), userID, time.Now())
 	if err != nil {
 		return "", err
 	} else {
@@ -41,34 +82,224 @@ func createCart(userID string) (string, error) {
 	}
 }
 
+// randomCartID reports whether createCart made the id from a random token. Older carts
+// were named after their user's sequential id.
+func randomCartID(cartID string) bool {
+	return len(cartID) > len("C000000")
+}
+
+// cartOwner returns the user the cart belongs to, empty if there is no such cart.
+func cartOwner(cartID string) string {
+	SQL := `SELECT owner_id FROM carts WHERE cart_id = ?`
+
+	var ownerID sql.NullString
+	if err := db.QueryRow(SQL, cartID).Scan(&ownerID); err != nil {
+		return ""
+	}
+
+	return ownerID.String
+}
+
+// userCart finds the cart a logged in user shops with, making one if they have none.
+func userCart(userID string) (string, error) {
+	SQL := `SELECT cart_id FROM carts WHERE owner_id = ? AND checked_out_at IS NULL ORDER BY last_activity_at DESC LIMIT 1`
+
+	var cartID string
+	err := db.QueryRow(SQL, userID).Scan(&cartID)
+	if err == sql.ErrNoRows {
+		return createCart(userID)
+	}
+	if err != nil {
+		return "", err
+	}
+
+	return cartID, nil
+}
+
+// adoptGuestCart hands what the user put in their guest cart over to the account they
+// registered or logged in with and returns the account's cart. The guest cart becomes
+// the account's cart if it has none open, otherwise its lines and coupon are merged in.
+func adoptGuestCart(userID string, guestCartID string) (string, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return "", err
+	}
+	defer tx.Rollback()
+
+	// only an open cart still owned by a guest can be taken over
+	var adoptable bool
+	SQL := `SELECT EXISTS (
+				SELECT 1 FROM carts c JOIN users u ON u.id = c.owner_id
+				WHERE c.cart_id = ? AND c.checked_out_at IS NULL AND u.username IS NULL
+			)`
+	if err := tx.QueryRow(SQL, guestCartID).Scan(&adoptable); err != nil {
+		return "", err
+	}
+	if !adoptable || !randomCartID(guestCartID) {
+		tx.Rollback()
+		return userCart(userID)
+	}
+
+	var cartID string
+	SQL_0 := `SELECT cart_id FROM carts WHERE owner_id = ? AND checked_out_at IS NULL ORDER BY last_activity_at DESC LIMIT 1`
+	err = tx.QueryRow(SQL_0, userID).Scan(&cartID)
+	if err == sql.ErrNoRows {
+		SQL_1 := `UPDATE carts SET (owner_id, updated_at, last_activity_at, expired_at) = (?, ?, ?, NULL) WHERE cart_id = ?`
+		if _, err := tx.Exec(SQL_1, userID, time.Now(), time.Now(), guestCartID); err != nil {
+			return "", err
+		}
+		return guestCartID, tx.Commit()
+	}
+	if err != nil {
+		return "", err
+	}
+
+	SQL_2 := `INSERT INTO cart_items (cart_id, product_id, size, price, quantity, notes)
+			SELECT ?, product_id, size, price, quantity, notes FROM cart_items WHERE cart_id = ? ORDER BY item_id
+			ON CONFLICT (cart_id, product_id, size) DO UPDATE SET quantity = quantity + excluded.quantity`
+	if _, err := tx.Exec(SQL_2, cartID, guestCartID); err != nil {
+		return "", err
+	}
+
+	SQL_3 := `DELETE FROM cart_items WHERE cart_id = ?`
+	if _, err := tx.Exec(SQL_3, guestCartID); err != nil {
+		return "", err
+	}
+
+	// a coupon already on the account's cart wins over the guest's
+	SQL_4 := `INSERT OR IGNORE INTO cart_coupons (cart_id, code, created_at) SELECT ?, code, created_at FROM cart_coupons WHERE cart_id = ?`
+	if _, err := tx.Exec(SQL_4, cartID, guestCartID); err != nil {
+		return "", err
+	}
+
+	SQL_5 := `DELETE FROM cart_coupons WHERE cart_id = ?`
+	if _, err := tx.Exec(SQL_5, guestCartID); err != nil {
+		return "", err
+	}
+
+	SQL_6 := `UPDATE carts SET (updated_at, last_activity_at, expired_at) = (?, ?, NULL) WHERE cart_id = ?`
+	if _, err := tx.Exec(SQL_6, time.Now(), time.Now(), cartID); err != nil {
+		return "", err
+	}
+
+	return cartID, tx.Commit()
+}
+
+// touchCart records shopper activity so the cleanup job leaves the cart alone.
+// Touching an expired cart brings it back.
+func touchCart(cartID string) error {
+	SQL := `UPDATE carts SET (updated_at, last_activity_at, expired_at) = (?, ?, NULL) WHERE cart_id = ?`
+	_, err := db.Exec(SQL, time.Now(), time.Now(), cartID)
+	if err != nil {
+		return err
+	} else {
+		return nil
+	}
+}
+
+func markCartCheckedOut(ex execer, cartID string) error {
+	SQL := `UPDATE carts SET (checked_out_at, updated_at) = (?, ?) WHERE cart_id = ?`
+	_, err := ex.Exec(SQL, time.Now(), time.Now(), cartID)
+	if err != nil {
+		return err
+	} else {
+		return nil
+	}
+}
+
 func checkoutCart(c *gin.Context) {
 	cartID := c.Param("cart_id")
-	SQL := `SELECT * FROM cart_items WHERE cart_id = ?`
 
-	rows, err := db.Query(SQL, cartID)
-	if err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"message": "error fetching from db", "error": err.Error()})
+	var order Order
+	if err := c.ShouldBindBodyWithJSON(&order); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"message": "error binding order", "error": err.Error()})
+		return
 	}
 
-	items, err := bindCartItems(rows)
-	defer rows.Close()
+	isDelivery, _ := strconv.ParseBool(order.IsDelivery)
+
+	// the delivery fee always comes from the zone, never from the client
+	var zone *DeliveryZone
+	var address *Address
+	if isDelivery {
+		checked, errs, err := checkoutAddress(c, cartOwner(cartID))
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"message": "error finding delivery address", "error": err.Error()})
+			return
+		}
+		if len(errs) > 0 {
+			validationFailed(c, errs)
+			return
+		}
+		address = &checked
+
+		found, err := findDeliveryZone(checked.PostalCode, nil)
+		if err == sql.ErrNoRows {
+			validationFailed(c, []ValidationError{{Field: "Address", Message: "we don't deliver to " + checked.PostalCode + " yet"}})
+			return
+		}
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"message": "error finding delivery zone", "error": err.Error()})
+			return
+		}
+		zone = &found
+	}
+
+	pricing, err := priceCartForZone(cartID, zone)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"message": "error binding cart", "error": err.Error()})
+		c.JSON(http.StatusBadRequest, gin.H{"message": "error pricing cart", "error": err.Error()})
 		return
 	}
 
-	orderID := "O" + cartID[1:]
+	if len(pricing.Items) == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"message": "cart is empty"})
+		return
+	}
+
+	if zone != nil {
+		if errs := checkDeliveryOrder(*zone, pricing, order.ReadyDate); len(errs) > 0 {
+			validationFailed(c, errs)
+			return
+		}
+	}
+
+	var slot *PickupSlot
+	if !isDelivery {
+		found, err := findPickupSlot(order.ReadyDate)
+		if err != nil {
+			validationFailed(c, []ValidationError{{Field: "ReadyDate", Message: err.Error()}})
+			return
+		}
+		slot = &found
+	}
+
+	orderID, err := generateOrderID()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"message": "error generating order id", "error": err.Error()})
+		return
+	}
 
-	if err := pushOrderItems(items, orderID); err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"message": "error pushing order items", "error": err.Error()})
+	err = placeOrder(cartID, orderID, order, pricing, address, slot)
+	if ve, ok := err.(*ValidationError); ok {
+		validationFailed(c, []ValidationError{*ve})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"message": "error placing order", "error": err.Error()})
 		return
 	}
 
-	if err := pushOrder(c, orderID); err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"message": "error pushing order", "error": err.Error()})
+	// discounts and store credit can cover the whole order, there's nothing for stripe to take
+	if pricing.Total == 0 {
+		if err := transitionOrder(orderID, StatusPaid, systemActor, true, "nothing to pay"); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"message": "error updating order status", "error": err.Error()})
+			return
+		}
+		c.Redirect(303, shopURL()+"/success")
+		return
 	}
 
-	paymentID := createCheckoutSession(c)
+	paymentID := createCheckoutSession(c, orderID, pricing)
 	if paymentID != "" {
 		err := pushPaymentID(orderID, paymentID)
 		if err != nil {
@@ -97,39 +328,112 @@ func bindCartItems(rows *sql.Rows) ([]CartItem, error) {
 	return items, nil
 }
 
-func pushOrderItems(items []CartItem, orderID string) error {
-	SQL := `INSERT INTO order_items (order_id, product_id, size, price, quantity, notes) VALUES (?, ?, ?, ?, ?, ?)`
-	for _, v := range items {
-		_, err := db.Exec(SQL, orderID, v.ProductID, v.Size, v.Price, v.Quantity, v.Notes)
-		if err != nil {
+// placeOrder saves everything checkout writes in one transaction: the order, its
+// lines and the stock they take, the pickup place or delivery address, discounts,
+// coupon uses, spent store credit, the checked out cart and the jobs the new order
+// queues. A failure anywhere leaves no trace of the order. A full slot, stock that
+// ran short, a used up coupon or a balance that no longer covers the credit comes
+// back as *ValidationError.
+func placeOrder(cartID string, orderID string, order Order, pricing CartPricing, address *Address, slot *PickupSlot) error {
+	userID := cartOwner(cartID)
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if slot != nil {
+		if err := reservePickupSlot(tx, orderID, *slot); err != nil {
+			return err
+		}
+	}
+
+	if err := pushOrderItems(tx, pricing.Lines, orderID); err != nil {
+		return err
+	}
+
+	change, err := pushOrder(tx, order, orderID, userID, pricing)
+	if err != nil {
+		return err
+	}
+
+	if address != nil {
+		if err := pushOrderAddress(tx, orderID, *address); err != nil {
 			return err
 		}
 	}
+
+	if err := pushOrderDiscounts(tx, pricing.Discounts, orderID); err != nil {
+		return err
+	}
+
+	if err := reserveOrderCoupons(tx, orderID, userID, pricing.Discounts); err != nil {
+		return err
+	}
+
+	if err := spendStoreCredit(tx, userID, orderID, pricing.Discounts); err != nil {
+		return err
+	}
+
+	if err := markCartCheckedOut(tx, cartID); err != nil {
+		return err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+
+	orderBroker.Publish(change)
+
 	return nil
 }
 
-func pushOrder(c *gin.Context, orderID string) error {
-	var order Order
-	if err := c.ShouldBindBodyWithJSON(&order); err != nil {
-		return err
+// pushOrderItems snapshots each priced line so later catalogue edits don't change the
+// order, and takes the units out of stock.
+func pushOrderItems(tx *sql.Tx, lines []PricingLine, orderID string) error {
+	SQL := `INSERT INTO order_items (order_id, product_id, size, price, quantity, notes, name, variant_label, image, tax_class, discount)
+			VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`
+	for _, v := range lines {
+		_, err := tx.Exec(SQL, orderID, v.ProductID, v.Size, v.Price, v.Quantity, v.Notes, v.Name, v.Size, v.Image, v.TaxClass, v.Discount)
+		if err != nil {
+			return err
+		}
+		if err := adjustStock(tx, v.ProductID, v.Size, -v.Quantity); err != nil {
+			return err
+		}
 	}
+
+	return nil
+}
+
+// pushOrder inserts the order as pending payment and records it in the history,
+// queueing its status change job in the same transaction.
+func pushOrder(tx *sql.Tx, order Order, orderID string, userID string, pricing CartPricing) (OrderStatusChange, error) {
+	// subtotal is stored after discounts, tax and total_price are what was charged
 	SQL := `INSERT INTO orders (
 				order_id,
-				is_delivery,
+				id_delivery,
 				delivery_address,
 				ready_date,
 				notes,
 				subtotal,
 				delivery_fee,
+				tax,
+				total_price,
+				discount,
 				status,
 				created_at,
-				updated_at) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`
-	_, err := db.Exec(SQL, orderID, order.IsDelivery, order.DeliveryAddress, order.ReadyDate, order.Notes, order.Subtotal, order.DeliveryFee, order.Status, time.Now(), time.Now())
+				updated_at,
+				user_id) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`
+	_, err := tx.Exec(SQL, orderID, order.IsDelivery, order.DeliveryAddress, order.ReadyDate, order.Notes,
+		pricing.Subtotal-pricing.DiscountTotal, pricing.DeliveryFee, pricing.Tax, pricing.Total, pricing.DiscountTotal,
+		StatusPendingPayment, time.Now(), time.Now(), userID)
 	if err != nil {
-		return err
-	} else {
-		return nil
+		return OrderStatusChange{}, err
 	}
+
+	return recordStatusChange(tx, orderID, "", StatusPendingPayment, userID, "order placed")
 }
 
 func pushPaymentID(orderID string, paymentID string) error {
@@ -143,11 +447,5 @@ func pushPaymentID(orderID string, paymentID string) error {
 }
 
 func paymentFailedStatus(orderID string) error {
-	SQL := `UPDATE orders SET status = ? WHERE order_id = ?`
-	_, err := db.Exec(SQL, "payment failed", orderID)
-	if err != nil {
-		return err
-	} else {
-		return nil
-	}
+	return transitionOrder(orderID, StatusCancelled, systemActor, true, "payment failed")
 }
@@ -10,7 +10,8 @@ func initializeCounterTable() error {
 	SQL_0 := `CREATE TABLE IF NOT EXISTS counter (
 				id INT PRIMARY KEY,
 				users INT,
-				products INT
+				products INT,
+				orders INT DEFAULT 0
 			)`
 
 	_, err_0 := db.Exec(SQL_0)
@@ -24,5 +25,5 @@ func initializeCounterTable() error {
 		return fmt.Errorf("failed to create counter table: %v", err_1)
 	}
 
-	return nil
+	return addColumn("counter", "orders", "INT DEFAULT 0")
 }
@@ -0,0 +1,453 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	_ "modernc.org/sqlite"
+)
+
+const (
+	CouponPercent      = "percent"
+	CouponFixed        = "fixed"
+	CouponFreeDelivery = "free_delivery"
+)
+
+type Coupon struct {
+	Code               string
+	Kind               string
+	Amount             int
+	MinSubtotal        int
+	MaxUses            int
+	MaxUsesPerCustomer int
+	StartsAt           time.Time
+	EndsAt             time.Time
+	ProductIDs         string
+	Categories         string
+	CreatedAt          time.Time
+	UpdatedAt          time.Time
+}
+
+type CouponCode struct {
+	Code string
+}
+
+func initializeCouponsTable() error {
+	SQL_0 := `CREATE TABLE IF NOT EXISTS coupons (
+				code TEXT PRIMARY KEY,
+				kind TEXT,
+				amount INT,
+				min_subtotal INT,
+				max_uses INT,
+				max_uses_per_customer INT,
+				starts_at TIMESTAMP,
+				ends_at TIMESTAMP,
+				product_ids TEXT,
+				categories TEXT,
+				created_at TIMESTAMP,
+				updated_at TIMESTAMP
+			)`
+	_, err_0 := db.Exec(SQL_0)
+	if err_0 != nil {
+		return fmt.Errorf("failed to create coupons table: %v", err_0)
+	}
+
+	SQL_1 := `CREATE TABLE IF NOT EXISTS coupon_redemptions (
+				code TEXT,
+				user_id TEXT,
+				order_id TEXT,
+				created_at TIMESTAMP
+			)`
+	_, err_1 := db.Exec(SQL_1)
+	if err_1 != nil {
+		return fmt.Errorf("failed to create coupon_redemptions table: %v", err_1)
+	}
+
+	SQL_2 := `CREATE TABLE IF NOT EXISTS cart_coupons (
+				cart_id TEXT PRIMARY KEY,
+				code TEXT,
+				created_at TIMESTAMP
+			)`
+	_, err_2 := db.Exec(SQL_2)
+	if err_2 != nil {
+		return fmt.Errorf("failed to create cart_coupons table: %v", err_2)
+	}
+
+	return nil
+}
+
+// ADMIN
+
+func addCoupon(c *gin.Context) {
+	var coupon Coupon
+	if err := c.ShouldBindBodyWithJSON(&coupon); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	coupon.Code = strings.ToUpper(strings.TrimSpace(coupon.Code))
+	if coupon.Code == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "coupon code is required"})
+		return
+	}
+
+	switch coupon.Kind {
+	case CouponPercent:
+		if coupon.Amount <= 0 || coupon.Amount > 100 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "percent coupons need an amount between 1 and 100"})
+			return
+		}
+	case CouponFixed:
+		if coupon.Amount <= 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "fixed coupons need a positive amount"})
+			return
+		}
+	case CouponFreeDelivery:
+	default:
+		c.JSON(http.StatusBadRequest, gin.H{"error": "unknown coupon kind: " + coupon.Kind})
+		return
+	}
+
+	SQL := `INSERT OR REPLACE INTO coupons (
+				code,
+				kind,
+				amount,
+				min_subtotal,
+				max_uses,
+				max_uses_per_customer,
+				starts_at,
+				ends_at,
+				product_ids,
+				categories,
+				created_at,
+				updated_at) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`
+	_, err := db.Exec(SQL, coupon.Code, coupon.Kind, coupon.Amount, coupon.MinSubtotal, coupon.MaxUses, coupon.MaxUsesPerCustomer,
+		coupon.StartsAt, coupon.EndsAt, coupon.ProductIDs, coupon.Categories, time.Now(), time.Now())
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "coupon saved", "code": coupon.Code})
+}
+
+func getCoupons(c *gin.Context) {
+	SQL := `SELECT * FROM coupons`
+	rows, err := db.Query(SQL)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	defer rows.Close()
+
+	coupons, err := bindCoupons(rows)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.IndentedJSON(http.StatusOK, coupons)
+}
+
+func deleteCoupon(c *gin.Context) {
+	code := strings.ToUpper(c.Param("code"))
+	SQL := `DELETE FROM coupons WHERE code = ?`
+
+	_, err := db.Exec(SQL, code)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "coupon deleted: " + code})
+}
+
+// CART
+
+func applyCartCoupon(c *gin.Context) {
+	cartID := c.Param("cart_id")
+
+	var body CouponCode
+	if err := c.ShouldBindBodyWithJSON(&body); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	code := strings.ToUpper(strings.TrimSpace(body.Code))
+
+	items, err := getCartItemsByID(cartID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	_, undiscounted, err := evaluatePromotions(items)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	// validate against the current cart so the shopper hears about a bad code right away
+	if _, err := evaluateCoupon(code, cartOwner(cartID), undiscounted, sumCartItems(items), 0); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	SQL := `INSERT OR REPLACE INTO cart_coupons (cart_id, code, created_at) VALUES (?, ?, ?)`
+	_, err = db.Exec(SQL, cartID, code, time.Now())
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	if err := touchCart(cartID); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	message := fmt.Sprintf(`applied coupon %s to cart %s`, code, cartID)
+
+	c.JSON(http.StatusOK, gin.H{"message": message})
+}
+
+func removeCartCoupon(c *gin.Context) {
+	cartID := c.Param("cart_id")
+	SQL := `DELETE FROM cart_coupons WHERE cart_id = ?`
+
+	_, err := db.Exec(SQL, cartID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	if err := touchCart(cartID); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	message := fmt.Sprintf(`removed coupon from cart %s`, cartID)
+
+	c.JSON(http.StatusOK, gin.H{"message": message})
+}
+
+func getCartCoupon(cartID string) (string, error) {
+	SQL := `SELECT code FROM cart_coupons WHERE cart_id = ?`
+
+	var code string
+	err := db.QueryRow(SQL, cartID).Scan(&code)
+	if err == sql.ErrNoRows {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+
+	return code, nil
+}
+
+// ENGINE
+
+func getCoupon(code string) (Coupon, error) {
+	SQL := `SELECT * FROM coupons WHERE code = ?`
+	rows, err := db.Query(SQL, code)
+	if err != nil {
+		return Coupon{}, err
+	}
+	defer rows.Close()
+
+	coupons, err := bindCoupons(rows)
+	if err != nil {
+		return Coupon{}, err
+	}
+	if len(coupons) == 0 {
+		return Coupon{}, fmt.Errorf("coupon %s doesn't exist", code)
+	}
+
+	return coupons[0], nil
+}
+
+// evaluateCoupon checks every restriction on the coupon and returns the discount it
+// gives on the cart. items are the units no promotion has used, so nothing is
+// discounted twice. deliveryFee is only used by free delivery coupons.
+func evaluateCoupon(code string, userID string, items []CartItem, subtotal int, deliveryFee int) (Discount, error) {
+	coupon, err := getCoupon(code)
+	if err != nil {
+		return Discount{}, err
+	}
+
+	now := time.Now()
+	if !coupon.StartsAt.IsZero() && now.Before(coupon.StartsAt) {
+		return Discount{}, fmt.Errorf("coupon %s is not active yet", code)
+	}
+	if !coupon.EndsAt.IsZero() && now.After(coupon.EndsAt) {
+		return Discount{}, fmt.Errorf("coupon %s has expired", code)
+	}
+
+	if subtotal < coupon.MinSubtotal {
+		return Discount{}, fmt.Errorf("coupon %s needs a subtotal of at least %s", code, formatMoney(coupon.MinSubtotal))
+	}
+
+	if coupon.MaxUses > 0 {
+		used, err := countRedemptions(`SELECT COUNT(*) FROM coupon_redemptions WHERE code = ?`, code)
+		if err != nil {
+			return Discount{}, err
+		}
+		if used >= coupon.MaxUses {
+			return Discount{}, fmt.Errorf("coupon %s has been fully redeemed", code)
+		}
+	}
+
+	if coupon.MaxUsesPerCustomer > 0 {
+		// guests start over with every new cart, only an account can be held to a limit
+		username, _, err := getUserContact(userID)
+		if err != nil {
+			return Discount{}, err
+		}
+		if username == "" {
+			return Discount{}, fmt.Errorf("log in to use coupon %s", code)
+		}
+
+		used, err := countRedemptions(`SELECT COUNT(*) FROM coupon_redemptions WHERE code = ? AND user_id = ?`, code, userID)
+		if err != nil {
+			return Discount{}, err
+		}
+		if used >= coupon.MaxUsesPerCustomer {
+			return Discount{}, fmt.Errorf("coupon %s has already been used", code)
+		}
+	}
+
+	eligible, err := eligibleSubtotal(coupon, items)
+	if err != nil {
+		return Discount{}, err
+	}
+	if eligible == 0 && coupon.Kind != CouponFreeDelivery {
+		return Discount{}, fmt.Errorf("coupon %s doesn't apply to any item in the cart that isn't already on promotion", code)
+	}
+
+	discount := Discount{Source: DiscountCoupon, Code: coupon.Code}
+	switch coupon.Kind {
+	case CouponPercent:
+		discount.Amount = eligible * coupon.Amount / 100
+		discount.Description = fmt.Sprintf("%d%% off", coupon.Amount)
+	case CouponFixed:
+		discount.Amount = min(coupon.Amount, eligible)
+		discount.Description = fmt.Sprintf("%s off", formatMoney(coupon.Amount))
+	case CouponFreeDelivery:
+		discount.Amount = deliveryFee
+		discount.Description = "free delivery"
+		discount.Delivery = true
+	}
+
+	return discount, nil
+}
+
+// eligibleSubtotal sums the cart lines the coupon is restricted to. A coupon with
+// no product or category restriction applies to the whole cart.
+func eligibleSubtotal(coupon Coupon, items []CartItem) (int, error) {
+	productIDs := splitList(coupon.ProductIDs)
+	categories := splitList(coupon.Categories)
+
+	total := 0
+	for _, item := range items {
+		if len(productIDs) == 0 && len(categories) == 0 {
+			total += item.Price * item.Quantity
+			continue
+		}
+
+		if contains(productIDs, item.ProductID) {
+			total += item.Price * item.Quantity
+			continue
+		}
+
+		if len(categories) > 0 {
+			category, err := getProductCategory(item.ProductID)
+			if err != nil {
+				return 0, err
+			}
+			if contains(categories, category) {
+				total += item.Price * item.Quantity
+			}
+		}
+	}
+
+	return total, nil
+}
+
+// reserveOrderCoupons takes a use of each of the order's coupons in the checkout's
+// transaction. The limits are checked again there, so concurrent checkouts can't all
+// take the last use. An order that is cancelled, or never paid before its checkout
+// expires, gives the uses back.
+func reserveOrderCoupons(tx *sql.Tx, orderID string, userID string, discounts []Discount) error {
+	for _, discount := range discounts {
+		if discount.Source != DiscountCoupon {
+			continue
+		}
+
+		coupon, err := getCoupon(discount.Code)
+		if err != nil {
+			return err
+		}
+
+		if coupon.MaxUses > 0 {
+			var used int
+			SQL := `SELECT COUNT(*) FROM coupon_redemptions WHERE code = ?`
+			if err := tx.QueryRow(SQL, coupon.Code).Scan(&used); err != nil {
+				return err
+			}
+			if used >= coupon.MaxUses {
+				return &ValidationError{Field: "Code", Message: fmt.Sprintf("coupon %s has been fully redeemed", coupon.Code)}
+			}
+		}
+
+		if coupon.MaxUsesPerCustomer > 0 {
+			var used int
+			SQL := `SELECT COUNT(*) FROM coupon_redemptions WHERE code = ? AND user_id = ?`
+			if err := tx.QueryRow(SQL, coupon.Code, userID).Scan(&used); err != nil {
+				return err
+			}
+			if used >= coupon.MaxUsesPerCustomer {
+				return &ValidationError{Field: "Code", Message: fmt.Sprintf("coupon %s has already been used", coupon.Code)}
+			}
+		}
+
+		SQL := `INSERT INTO coupon_redemptions (code, user_id, order_id, created_at) VALUES (?, ?, ?, ?)`
+		if _, err := tx.Exec(SQL, coupon.Code, userID, orderID, time.Now()); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// releaseOrderCoupons gives a cancelled order's coupons back.
+func releaseOrderCoupons(tx *sql.Tx, orderID string) error {
+	_, err := tx.Exec(`DELETE FROM coupon_redemptions WHERE order_id = ?`, orderID)
+	return err
+}
+
+func countRedemptions(SQL string, args ...any) (int, error) {
+	var count int
+	if err := db.QueryRow(SQL, args...).Scan(&count); err != nil {
+		return 0, err
+	}
+
+	return count, nil
+}
+
+func bindCoupons(rows *sql.Rows) ([]Coupon, error) {
+	coupons := []Coupon{}
+	for rows.Next() {
+		var coupon Coupon
+		err := rows.Scan(&coupon.Code, &coupon.Kind, &coupon.Amount, &coupon.MinSubtotal, &coupon.MaxUses, &coupon.MaxUsesPerCustomer,
+			&coupon.StartsAt, &coupon.EndsAt, &coupon.ProductIDs, &coupon.Categories, &coupon.CreatedAt, &coupon.UpdatedAt)
+		if err != nil {
+			return coupons, err
+		}
+		coupons = append(coupons, coupon)
+	}
+
+	return coupons, nil
+}
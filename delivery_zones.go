@@ -0,0 +1,451 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	_ "modernc.org/sqlite"
+)
+
+// DeliveryZone is an area we deliver to. PostalPrefixes is a comma separated list
+// like "M5V,M5J", DeliveryDays like "mon,wed,fri" (empty means every day) and Polygon
+// an optional JSON list of [lat, lng] points. Fees and thresholds are in cents,
+// a FreeOver of 0 means delivery is never free.
+type DeliveryZone struct {
+	ZoneID         int
+	Name           string
+	PostalPrefixes string
+	Polygon        string
+	Fee            int
+	FreeOver       int
+	MinimumOrder   int
+	DeliveryDays   string
+	Active         bool
+	CreatedAt      time.Time
+	UpdatedAt      time.Time
+}
+
+type DeliveryCheck struct {
+	Deliverable  bool
+	PostalCode   string
+	Zone         *DeliveryZone
+	Fee          int
+	FreeOver     int
+	MinimumOrder int
+	DeliveryDays []string
+	Subtotal     int
+	Reason       string
+}
+
+var postalCodePattern = regexp.MustCompile(`(?i)\b([ABCEGHJ-NPRSTVXY]\d[ABCEGHJ-NPRSTV-Z])\s?(\d[ABCEGHJ-NPRSTV-Z]\d)\b`)
+
+var weekdays = []string{"sun", "mon", "tue", "wed", "thu", "fri", "sat"}
+
+func initializeDeliveryZonesTable() error {
+	SQL := `
+		CREATE TABLE IF NOT EXISTS delivery_zones (
+			zone_id INTEGER PRIMARY KEY AUTOINCREMENT,
+			name TEXT,
+			postal_prefixes TEXT,
+			polygon TEXT,
+			fee INT,
+			free_over INT,
+			minimum_order INT,
+			delivery_days TEXT,
+			active BOOLEAN,
+			created_at TIMESTAMP,
+			updated_at TIMESTAMP
+		)`
+	_, err := db.Exec(SQL)
+	if err != nil {
+		return err
+	} else {
+		return nil
+	}
+}
+
+// ADMIN
+
+func addDeliveryZone(c *gin.Context) {
+	var zone DeliveryZone
+	if err := c.ShouldBindBodyWithJSON(&zone); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if errs := validateDeliveryZone(&zone); len(errs) > 0 {
+		validationFailed(c, errs)
+		return
+	}
+
+	SQL := `INSERT INTO delivery_zones (
+				name,
+				postal_prefixes,
+				polygon,
+				fee,
+				free_over,
+				minimum_order,
+				delivery_days,
+				active,
+				created_at,
+				updated_at) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`
+	result, err := db.Exec(SQL, zone.Name, zone.PostalPrefixes, zone.Polygon, zone.Fee, zone.FreeOver, zone.MinimumOrder,
+		zone.DeliveryDays, zone.Active, time.Now(), time.Now())
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	zoneID, _ := result.LastInsertId()
+
+	c.JSON(http.StatusOK, gin.H{"message": "delivery zone saved", "zone_id": zoneID})
+}
+
+func updateDeliveryZone(c *gin.Context) {
+	zoneID := c.Param("zone_id")
+
+	var zone DeliveryZone
+	if err := c.ShouldBindBodyWithJSON(&zone); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if errs := validateDeliveryZone(&zone); len(errs) > 0 {
+		validationFailed(c, errs)
+		return
+	}
+
+	SQL := `UPDATE delivery_zones SET (
+				name,
+				postal_prefixes,
+				polygon,
+				fee,
+				free_over,
+				minimum_order,
+				delivery_days,
+				active,
+				updated_at) = (?, ?, ?, ?, ?, ?, ?, ?, ?) WHERE zone_id = ?`
+	result, err := db.Exec(SQL, zone.Name, zone.PostalPrefixes, zone.Polygon, zone.Fee, zone.FreeOver, zone.MinimumOrder,
+		zone.DeliveryDays, zone.Active, time.Now(), zoneID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "delivery zone not found: " + zoneID})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "delivery zone updated: " + zoneID})
+}
+
+func getDeliveryZones(c *gin.Context) {
+	zones, err := getZones(false)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.IndentedJSON(http.StatusOK, zones)
+}
+
+func deleteDeliveryZone(c *gin.Context) {
+	zoneID := c.Param("zone_id")
+	SQL := `DELETE FROM delivery_zones WHERE zone_id = ?`
+
+	_, err := db.Exec(SQL, zoneID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "delivery zone deleted: " + zoneID})
+}
+
+// validateDeliveryZone also normalizes the prefix and day lists so matching can
+// compare them directly.
+func validateDeliveryZone(zone *DeliveryZone) []ValidationError {
+	errs := []ValidationError{}
+
+	if strings.TrimSpace(zone.Name) == "" {
+		errs = append(errs, ValidationError{Field: "Name", Message: "is required"})
+	}
+
+	prefixes := []string{}
+	for _, prefix := range splitList(zone.PostalPrefixes) {
+		prefixes = append(prefixes, strings.ToUpper(strings.ReplaceAll(prefix, " ", "")))
+	}
+	zone.PostalPrefixes = strings.Join(prefixes, ",")
+
+	if zone.Polygon != "" {
+		if _, err := parsePolygon(zone.Polygon); err != nil {
+			errs = append(errs, ValidationError{Field: "Polygon", Message: err.Error()})
+		}
+	}
+	if zone.PostalPrefixes == "" && zone.Polygon == "" {
+		errs = append(errs, ValidationError{Field: "PostalPrefixes", Message: "a zone needs postal prefixes or a polygon"})
+	}
+
+	if zone.Fee < 0 {
+		errs = append(errs, ValidationError{Field: "Fee", Message: "can't be negative"})
+	}
+	if zone.FreeOver < 0 {
+		errs = append(errs, ValidationError{Field: "FreeOver", Message: "can't be negative"})
+	}
+	if zone.MinimumOrder < 0 {
+		errs = append(errs, ValidationError{Field: "MinimumOrder", Message: "can't be negative"})
+	}
+
+	days := []string{}
+	for _, day := range splitList(zone.DeliveryDays) {
+		day = strings.ToLower(day)
+		if len(day) > 3 {
+			day = day[:3]
+		}
+		if !contains(weekdays, day) {
+			errs = append(errs, ValidationError{Field: "DeliveryDays", Message: "unknown day: " + day})
+			continue
+		}
+		days = append(days, day)
+	}
+	zone.DeliveryDays = strings.Join(days, ",")
+
+	return errs
+}
+
+// PUBLIC
+
+// checkDeliveryAddress tells the shopper whether we deliver to a postal code and what
+// it costs. With a cart_id the fee and minimum are worked out for that cart.
+func checkDeliveryAddress(c *gin.Context) {
+	postalCode, ok := findPostalCode(c.Query("postal_code"))
+	if !ok {
+		validationFailed(c, []ValidationError{{Field: "postal_code", Message: "must be a Canadian postal code like M5V 2T6"}})
+		return
+	}
+
+	var point []float64
+	if c.Query("lat") != "" || c.Query("lng") != "" {
+		lat, err_0 := strconv.ParseFloat(c.Query("lat"), 64)
+		lng, err_1 := strconv.ParseFloat(c.Query("lng"), 64)
+		if err_0 != nil || err_1 != nil {
+			validationFailed(c, []ValidationError{{Field: "lat", Message: "lat and lng must both be numbers"}})
+			return
+		}
+		point = []float64{lat, lng}
+	}
+
+	check := DeliveryCheck{PostalCode: postalCode, DeliveryDays: []string{}}
+
+	zone, err := findDeliveryZone(postalCode, point)
+	if err == sql.ErrNoRows {
+		check.Reason = "we don't deliver to " + postalCode + " yet"
+		c.IndentedJSON(http.StatusOK, check)
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	check.Deliverable = true
+	check.Zone = &zone
+	check.Fee = zone.Fee
+	check.FreeOver = zone.FreeOver
+	check.MinimumOrder = zone.MinimumOrder
+	check.DeliveryDays = deliveryDays(zone)
+
+	if cartID := c.Query("cart_id"); cartID != "" {
+		pricing, err := priceCartForZone(cartID, &zone)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"message": "error pricing cart", "error": err.Error()})
+			return
+		}
+		check.Fee = pricing.DeliveryFee
+		check.Subtotal = pricing.Subtotal - pricing.DiscountTotal
+		if check.Subtotal < zone.MinimumOrder {
+			check.Deliverable = false
+			check.Reason = fmt.Sprintf("delivery to %s needs an order of at least %s", postalCode, formatMoney(zone.MinimumOrder))
+		}
+	}
+
+	c.IndentedJSON(http.StatusOK, check)
+}
+
+// ZONES
+
+// findPostalCode pulls a Canadian postal code out of free text and formats it as "A1A 1A1".
+func findPostalCode(text string) (string, bool) {
+	match := postalCodePattern.FindStringSubmatch(text)
+	if match == nil {
+		return "", false
+	}
+
+	return strings.ToUpper(match[1] + " " + match[2]), true
+}
+
+// findDeliveryZone picks the active zone with the longest postal prefix matching the
+// code. Zones with a polygon also need the point to fall inside it when one is given,
+// and polygon-only zones match on the point alone. Returns sql.ErrNoRows if none match.
+func findDeliveryZone(postalCode string, point []float64) (DeliveryZone, error) {
+	zones, err := getZones(true)
+	if err != nil {
+		return DeliveryZone{}, err
+	}
+
+	compact := strings.ReplaceAll(postalCode, " ", "")
+	best := -1
+	var found DeliveryZone
+	for _, zone := range zones {
+		score := -1
+		for _, prefix := range splitList(zone.PostalPrefixes) {
+			if strings.HasPrefix(compact, prefix) && len(prefix) > score {
+				score = len(prefix)
+			}
+		}
+
+		if zone.Polygon != "" {
+			inside := false
+			if point != nil {
+				polygon, err := parsePolygon(zone.Polygon)
+				if err != nil {
+					return DeliveryZone{}, err
+				}
+				inside = pointInPolygon(point, polygon)
+			}
+
+			switch {
+			case zone.PostalPrefixes == "" && inside:
+				score = 0
+			case point != nil && !inside:
+				score = -1
+			}
+		}
+
+		if score > best {
+			best = score
+			found = zone
+		}
+	}
+
+	if best < 0 {
+		return DeliveryZone{}, sql.ErrNoRows
+	}
+
+	return found, nil
+}
+
+// priceCartForZone prices the cart with the zone's delivery fee, or for pickup when
+// zone is nil. The free delivery threshold is checked against the discounted subtotal.
+func priceCartForZone(cartID string, zone *DeliveryZone) (CartPricing, error) {
+	if zone == nil {
+		return priceCart(cartID, 0)
+	}
+
+	pricing, err := priceCart(cartID, zone.Fee)
+	if err != nil {
+		return pricing, err
+	}
+
+	if zone.FreeOver > 0 && pricing.Subtotal-pricing.DiscountTotal >= zone.FreeOver {
+		return priceCart(cartID, 0)
+	}
+
+	return pricing, nil
+}
+
+// checkDeliveryOrder enforces the zone's minimum order and delivery days at checkout.
+func checkDeliveryOrder(zone DeliveryZone, pricing CartPricing, readyDate time.Time) []ValidationError {
+	errs := []ValidationError{}
+
+	if pricing.Subtotal-pricing.DiscountTotal < zone.MinimumOrder {
+		errs = append(errs, ValidationError{
+			Field:   "Address",
+			Message: fmt.Sprintf("delivery to %s needs an order of at least %s", zone.Name, formatMoney(zone.MinimumOrder)),
+		})
+	}
+
+	if !readyDate.IsZero() {
+		day := weekdays[readyDate.In(time.Local).Weekday()]
+		if days := deliveryDays(zone); !contains(days, day) {
+			errs = append(errs, ValidationError{
+				Field:   "ReadyDate",
+				Message: fmt.Sprintf("we deliver to %s on %s", zone.Name, strings.Join(days, ", ")),
+			})
+		}
+	}
+
+	return errs
+}
+
+func deliveryDays(zone DeliveryZone) []string {
+	if zone.DeliveryDays == "" {
+		return weekdays
+	}
+
+	return splitList(zone.DeliveryDays)
+}
+
+// parsePolygon reads a JSON list of [lat, lng] points, at least a triangle.
+func parsePolygon(value string) ([][]float64, error) {
+	var polygon [][]float64
+	if err := json.Unmarshal([]byte(value), &polygon); err != nil {
+		return nil, fmt.Errorf("must be a JSON list of [lat, lng] points")
+	}
+	if len(polygon) < 3 {
+		return nil, fmt.Errorf("needs at least 3 points")
+	}
+	for _, p := range polygon {
+		if len(p) != 2 {
+			return nil, fmt.Errorf("every point needs a lat and a lng")
+		}
+	}
+
+	return polygon, nil
+}
+
+// pointInPolygon is the usual ray casting test, fine at city scale where the earth is flat enough.
+func pointInPolygon(point []float64, polygon [][]float64) bool {
+	inside := false
+	for i, j := 0, len(polygon)-1; i < len(polygon); j, i = i, i+1 {
+		a, b := polygon[i], polygon[j]
+		if (a[1] > point[1]) != (b[1] > point[1]) &&
+			point[0] < (b[0]-a[0])*(point[1]-a[1])/(b[1]-a[1])+a[0] {
+			inside = !inside
+		}
+	}
+
+	return inside
+}
+
+func getZones(activeOnly bool) ([]DeliveryZone, error) {
+	SQL := `SELECT * FROM delivery_zones`
+	if activeOnly {
+		SQL += ` WHERE active = true`
+	}
+
+	rows, err := db.Query(SQL + ` ORDER BY zone_id`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	zones := []DeliveryZone{}
+	for rows.Next() {
+		var zone DeliveryZone
+		err := rows.Scan(&zone.ZoneID, &zone.Name, &zone.PostalPrefixes, &zone.Polygon, &zone.Fee, &zone.FreeOver,
+			&zone.MinimumOrder, &zone.DeliveryDays, &zone.Active, &zone.CreatedAt, &zone.UpdatedAt)
+		if err != nil {
+			return zones, err
+		}
+		zones = append(zones, zone)
+	}
+
+	return zones, nil
+}
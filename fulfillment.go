@@ -0,0 +1,488 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	_ "modernc.org/sqlite"
+)
+
+// Fulfillment tracks an order through packing: who claimed it, when the last item
+// was packed and who marked it ready, with the time of each step.
+type Fulfillment struct {
+	OrderID   string
+	ClaimedBy string
+	ClaimedAt sql.NullTime
+	PackedBy  string
+	PackedAt  sql.NullTime
+	ReadyBy   string
+	ReadyAt   sql.NullTime
+}
+
+// FulfillmentItem is an order line to pack. ToPick leaves out anything refunded
+// before it was packed.
+type FulfillmentItem struct {
+	Item     OrderItem
+	ToPick   int
+	PackedBy string
+	PackedAt sql.NullTime
+}
+
+type FulfillmentOrder struct {
+	Order       Order
+	Fulfillment Fulfillment
+	Items       []FulfillmentItem
+}
+
+// PickLine is one product and size to take off the shelf, summed over orders.
+type PickLine struct {
+	ProductID    string
+	Size         string
+	Name         string
+	VariantLabel string
+	Quantity     int
+	Orders       []string
+}
+
+type FulfillmentSlot struct {
+	ReadyDate time.Time
+	Orders    []FulfillmentOrder
+	PickList  []PickLine
+}
+
+type PackRequest struct {
+	ItemIDs []int
+}
+
+func initializeFulfillmentTables() error {
+	SQL_0 := `CREATE TABLE IF NOT EXISTS fulfillments (
+				order_id TEXT PRIMARY KEY,
+				claimed_by TEXT,
+				claimed_at TIMESTAMP,
+				packed_by TEXT,
+				packed_at TIMESTAMP,
+				ready_by TEXT,
+				ready_at TIMESTAMP
+			)`
+	_, err_0 := db.Exec(SQL_0)
+	if err_0 != nil {
+		return fmt.Errorf("failed to create fulfillments table: %v", err_0)
+	}
+
+	SQL_1 := `CREATE TABLE IF NOT EXISTS packed_items (
+				item_id INTEGER PRIMARY KEY,
+				order_id TEXT,
+				packed_by TEXT,
+				packed_at TIMESTAMP
+			)`
+	_, err_1 := db.Exec(SQL_1)
+	if err_1 != nil {
+		return fmt.Errorf("failed to create packed_items table: %v", err_1)
+	}
+
+	return nil
+}
+
+// getFulfillmentQueue lists the paid orders still to be packed, grouped by ready
+// date and slot, earliest first. Each slot has a pick list of what's left to pack in
+// it, and the whole queue has one too. ?date=YYYY-MM-DD limits it to one day.
+func getFulfillmentQueue(c *gin.Context) {
+	where, args := "status IN (?, ?) AND order_id NOT IN (SELECT order_id FROM fulfillments WHERE ready_at IS NOT NULL)", []any{StatusPaid, StatusPreparing}
+
+	if date := c.Query("date"); date != "" {
+		day, err := time.ParseInLocation("2006-01-02", date, time.Local)
+		if err != nil {
+			validationFailed(c, []ValidationError{{Field: "date", Message: "must look like 2006-01-02"}})
+			return
+		}
+		where, args = where+" AND ready_date >= ? AND ready_date < ?", append(args, day, day.AddDate(0, 0, 1))
+	}
+
+	SQL := `SELECT ` + orderColumns + ` FROM orders WHERE ` + where + ` ORDER BY ready_date, order_id`
+	rows, err := db.Query(SQL, args...)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	orders, err := bindOrders(rows)
+	rows.Close()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	slots := []FulfillmentSlot{}
+	all := []FulfillmentOrder{}
+	for _, order := range orders {
+		fo, err := getFulfillmentOrder(order)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		all = append(all, fo)
+
+		// orders come sorted, so a slot's orders are next to each other
+		if len(slots) == 0 || slotKey(slots[len(slots)-1].ReadyDate) != slotKey(order.ReadyDate) {
+			slots = append(slots, FulfillmentSlot{ReadyDate: order.ReadyDate})
+		}
+		slot := &slots[len(slots)-1]
+		slot.Orders = append(slot.Orders, fo)
+	}
+
+	for i := range slots {
+		slots[i].PickList = buildPickList(slots[i].Orders)
+	}
+
+	c.IndentedJSON(http.StatusOK, gin.H{"slots": slots, "pick_list": buildPickList(all)})
+}
+
+func getFulfillment(c *gin.Context) {
+	order, err := getOrder(c.Param("order_id"))
+	if err == sql.ErrNoRows {
+		c.JSON(http.StatusNotFound, gin.H{"error": "order not found: " + c.Param("order_id")})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	fo, err := getFulfillmentOrder(order)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.IndentedJSON(http.StatusOK, fo)
+}
+
+// claimOrder gives an order to the staff member packing it and moves a paid order
+// to preparing. Claiming your own order again is fine, someone else's is a conflict.
+func claimOrder(c *gin.Context) {
+	staffID, err := currentUserID(c)
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": err.Error()})
+		return
+	}
+
+	orderID := c.Param("order_id")
+	order, ok := fulfillableOrder(c, orderID)
+	if !ok {
+		return
+	}
+
+	SQL := `INSERT INTO fulfillments (order_id, claimed_by, claimed_at) VALUES (?, ?, ?)
+			ON CONFLICT (order_id) DO UPDATE SET (claimed_by, claimed_at) = (excluded.claimed_by, excluded.claimed_at)
+			WHERE COALESCE(fulfillments.claimed_by, '') IN ('', excluded.claimed_by)`
+	result, err := db.Exec(SQL, orderID, staffID, time.Now())
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		fulfillment, _ := getFulfillmentRow(orderID)
+		c.JSON(http.StatusConflict, gin.H{"error": "order is already claimed by " + fulfillment.ClaimedBy})
+		return
+	}
+
+	if order.Status == StatusPaid {
+		if err := transitionOrder(orderID, StatusPreparing, staffID, true, "claimed for packing"); err != nil {
+			// give the claim back, the order didn't move
+			db.Exec(`UPDATE fulfillments SET (claimed_by, claimed_at) = (NULL, NULL) WHERE order_id = ?`, orderID)
+			c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+			return
+		}
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "claimed order " + orderID})
+}
+
+// releaseOrder hands a claimed order back to the queue. Packed items stay packed.
+func releaseOrder(c *gin.Context) {
+	staffID, err := currentUserID(c)
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": err.Error()})
+		return
+	}
+
+	orderID := c.Param("order_id")
+	SQL := `UPDATE fulfillments SET (claimed_by, claimed_at) = (NULL, NULL) WHERE order_id = ? AND claimed_by = ? AND ready_at IS NULL`
+	result, err := db.Exec(SQL, orderID, staffID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		c.JSON(http.StatusConflict, gin.H{"error": "you don't have order " + orderID + " claimed"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "released order " + orderID})
+}
+
+// packItems marks lines of a claimed order as packed, all of the remaining ones when
+// ItemIDs is empty. Packing the last line stamps the order as packed.
+func packItems(c *gin.Context) {
+	staffID, err := currentUserID(c)
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": err.Error()})
+		return
+	}
+
+	var request PackRequest
+	if err := c.ShouldBindBodyWithJSON(&request); err != nil && c.Request.ContentLength > 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	orderID := c.Param("order_id")
+	order, ok := fulfillableOrder(c, orderID)
+	if !ok {
+		return
+	}
+	if !claimedBy(c, orderID, staffID) {
+		return
+	}
+
+	fo, err := getFulfillmentOrder(order)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	items := map[int]FulfillmentItem{}
+	for _, item := range fo.Items {
+		items[item.Item.OrderItemID] = item
+	}
+	if len(request.ItemIDs) == 0 {
+		for id := range items {
+			request.ItemIDs = append(request.ItemIDs, id)
+		}
+	}
+	errs := []ValidationError{}
+	for _, id := range request.ItemIDs {
+		if _, ok := items[id]; !ok {
+			errs = append(errs, ValidationError{Field: "ItemIDs", Message: fmt.Sprintf("item %d isn't on order %s", id, orderID)})
+		}
+	}
+	if len(errs) > 0 {
+		validationFailed(c, errs)
+		return
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	defer tx.Rollback()
+
+	for _, id := range request.ItemIDs {
+		SQL := `INSERT OR IGNORE INTO packed_items (item_id, order_id, packed_by, packed_at) VALUES (?, ?, ?, ?)`
+		if _, err := tx.Exec(SQL, id, orderID, staffID, time.Now()); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+	}
+
+	var remaining int
+	SQL_0 := `SELECT COUNT(*) FROM order_items WHERE order_id = ? AND item_id NOT IN (SELECT item_id FROM packed_items WHERE order_id = ?)
+			AND quantity > COALESCE(refunded_quantity, 0)`
+	if err := tx.QueryRow(SQL_0, orderID, orderID).Scan(&remaining); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if remaining == 0 {
+		SQL_1 := `UPDATE fulfillments SET (packed_by, packed_at) = (?, ?) WHERE order_id = ? AND packed_at IS NULL`
+		if _, err := tx.Exec(SQL_1, staffID, time.Now(), orderID); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": fmt.Sprintf("packed %d items", len(request.ItemIDs)), "remaining": remaining})
+}
+
+// markOrderReady finishes packing. Pickup orders become ready_for_pickup and the
+// customer is told, delivery orders stay preparing, off the queue, until they go out.
+func markOrderReady(c *gin.Context) {
+	staffID, err := currentUserID(c)
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": err.Error()})
+		return
+	}
+
+	orderID := c.Param("order_id")
+	order, ok := fulfillableOrder(c, orderID)
+	if !ok {
+		return
+	}
+	if !claimedBy(c, orderID, staffID) {
+		return
+	}
+
+	fulfillment, err := getFulfillmentRow(orderID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if !fulfillment.PackedAt.Valid {
+		c.JSON(http.StatusConflict, gin.H{"error": "pack every item before marking the order ready"})
+		return
+	}
+
+	SQL := `UPDATE fulfillments SET (ready_by, ready_at) = (?, ?) WHERE order_id = ? AND ready_at IS NULL`
+	if _, err := db.Exec(SQL, staffID, time.Now(), orderID); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	if isDelivery, _ := strconv.ParseBool(order.IsDelivery); !isDelivery {
+		if err := transitionOrder(orderID, StatusReadyForPickup, staffID, true, "packed"); err != nil {
+			db.Exec(`UPDATE fulfillments SET (ready_by, ready_at) = (NULL, NULL) WHERE order_id = ?`, orderID)
+			c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+			return
+		}
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "order " + orderID + " is ready"})
+}
+
+// fulfillableOrder loads an order that is paid or being prepared, answering for the
+// caller when it isn't.
+func fulfillableOrder(c *gin.Context, orderID string) (Order, bool) {
+	order, err := getOrder(orderID)
+	if err == sql.ErrNoRows {
+		c.JSON(http.StatusNotFound, gin.H{"error": "order not found: " + orderID})
+		return order, false
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return order, false
+	}
+
+	if order.Status != StatusPaid && order.Status != StatusPreparing {
+		c.JSON(http.StatusConflict, gin.H{"error": "order is " + order.Status + ", only paid orders are packed"})
+		return order, false
+	}
+
+	return order, true
+}
+
+func claimedBy(c *gin.Context, orderID string, staffID string) bool {
+	fulfillment, err := getFulfillmentRow(orderID)
+	if err != nil && err != sql.ErrNoRows {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return false
+	}
+
+	if fulfillment.ClaimedBy != staffID {
+		c.JSON(http.StatusConflict, gin.H{"error": "claim order " + orderID + " before packing it"})
+		return false
+	}
+
+	return true
+}
+
+func getFulfillmentRow(orderID string) (Fulfillment, error) {
+	var f Fulfillment
+	SQL := `SELECT order_id, COALESCE(claimed_by, ''), claimed_at, COALESCE(packed_by, ''), packed_at, COALESCE(ready_by, ''), ready_at
+			FROM fulfillments WHERE order_id = ?`
+	err := db.QueryRow(SQL, orderID).Scan(&f.OrderID, &f.ClaimedBy, &f.ClaimedAt, &f.PackedBy, &f.PackedAt, &f.ReadyBy, &f.ReadyAt)
+	if err == sql.ErrNoRows {
+		return Fulfillment{OrderID: orderID}, err
+	}
+
+	return f, err
+}
+
+func getFulfillmentOrder(order Order) (FulfillmentOrder, error) {
+	fo := FulfillmentOrder{Order: order, Items: []FulfillmentItem{}}
+
+	fulfillment, err := getFulfillmentRow(order.OrderID)
+	if err != nil && err != sql.ErrNoRows {
+		return fo, err
+	}
+	fo.Fulfillment = fulfillment
+
+	items, err := getOrderItems(order.OrderID)
+	if err != nil {
+		return fo, err
+	}
+
+	rows, err := db.Query(`SELECT item_id, packed_by, packed_at FROM packed_items WHERE order_id = ?`, order.OrderID)
+	if err != nil {
+		return fo, err
+	}
+	defer rows.Close()
+
+	packed := map[int]FulfillmentItem{}
+	for rows.Next() {
+		var id int
+		var p FulfillmentItem
+		if err := rows.Scan(&id, &p.PackedBy, &p.PackedAt); err != nil {
+			return fo, err
+		}
+		packed[id] = p
+	}
+
+	for _, item := range items {
+		toPick := item.Quantity - item.RefundedQuantity
+		if toPick <= 0 {
+			continue
+		}
+
+		fi := packed[item.OrderItemID]
+		fi.Item = item
+		fi.ToPick = toPick
+		fo.Items = append(fo.Items, fi)
+	}
+
+	return fo, nil
+}
+
+// buildPickList sums what's still unpacked across orders per product and size.
+func buildPickList(orders []FulfillmentOrder) []PickLine {
+	lines := map[string]*PickLine{}
+	for _, fo := range orders {
+		for _, fi := range fo.Items {
+			if fi.PackedAt.Valid {
+				continue
+			}
+
+			key := fi.Item.ProductID + "\x00" + fi.Item.Size
+			line, ok := lines[key]
+			if !ok {
+				line = &PickLine{ProductID: fi.Item.ProductID, Size: fi.Item.Size, Name: fi.Item.Name, VariantLabel: fi.Item.VariantLabel}
+				lines[key] = line
+			}
+			line.Quantity += fi.ToPick
+			if !contains(line.Orders, fo.Order.OrderID) {
+				line.Orders = append(line.Orders, fo.Order.OrderID)
+			}
+		}
+	}
+
+	pickList := []PickLine{}
+	for _, line := range lines {
+		pickList = append(pickList, *line)
+	}
+	sort.Slice(pickList, func(i, j int) bool {
+		if pickList[i].Name != pickList[j].Name {
+			return pickList[i].Name < pickList[j].Name
+		}
+		return pickList[i].Size < pickList[j].Size
+	})
+
+	return pickList
+}
@@ -3,8 +3,9 @@ package main
 import (
 	"database/sql"
 	"fmt"
-	"net/http"
 	"strconv"
+	"strings"
+	"time"
 
 	"log"
 
@@ -20,7 +21,6 @@ import (
 	"github.com/gin-contrib/cors"
 )
 
-var jwtSecret []byte
 var db *sql.DB
 
 func main() {
@@ -34,7 +34,9 @@ func main() {
 
 	port := os.Getenv("SECRET_CODE")
 
-	jwtSecret = []byte(os.Getenv("JWT_SECRET"))
+	if err := loadSigningKeys(); err != nil {
+		log.Fatalf("failed to load signing keys: %v", err)
+	}
 
 	// DATABASE INIT
 	db, err = InitializeDB()
@@ -42,7 +44,20 @@ func main() {
 		log.Fatalf("failed to initialize the database: %v", err)
 	}
 
-	userID, cartID := initializeAllTables()
+	initializeAllTables()
+
+	// BACKGROUND JOBS
+	mailer = newMailSender()
+	schedules := map[string]time.Duration{
+		JobCartCleanup:   time.Duration(envInt("CART_CLEANUP_MINUTES", 60)) * time.Minute,
+		JobCartReminders: time.Duration(envInt("CART_REMINDER_MINUTES", 30)) * time.Minute,
+	}
+	for kind, interval := range schedules {
+		if err := scheduleJob(kind, interval); err != nil {
+			log.Fatal(`error scheduling `+kind, err)
+		}
+	}
+	go runJobWorkers(envInt("JOB_WORKERS", 4), time.Duration(envInt("JOB_POLL_SECONDS", 2))*time.Second)
 
 	//REST API
 	r := gin.Default()
@@ -50,8 +65,9 @@ func main() {
 	r.Use(cors.New(cors.Config{
 		AllowOrigins: []string{"http://localhost:5173"},
 		AllowMethods: []string{"GET", "PUT", "POST", "DELETE", "OPTIONS"},
-		AllowHeaders: []string{"Origin", "Content-Type", "token"},
+		AllowHeaders: []string{"Origin", "Content-Type", "token", "Authorization"},
 	}))
+	r.Use(authenticate())
 
 	r.GET("/ping", func(c *gin.Context) {
 		c.JSON(200, gin.H{
@@ -60,10 +76,7 @@ func main() {
 	})
 
 	r.GET("/ids", func(c *gin.Context) {
-		c.JSON(200, gin.H{
-			"user_id": userID,
-			"cart_id": cartID,
-		})
+		newGuest(c)
 	})
 
 	//PRODUCTS
@@ -83,60 +96,37 @@ func main() {
 		getPrices(c)
 	})
 
-	r.PUT("/products/ID/:ID/:column", func(c *gin.Context) {
-		isAdmin, err := validateAdmin(c)
-		if err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
-		}
-
-		if isAdmin {
-			editProductString(c)
-		}
+	r.PUT("/products/ID/:ID/:column", requirePermission(PermCatalogWrite), func(c *gin.Context) {
+		editProductString(c)
 	})
 
-	r.POST("/products", func(c *gin.Context) {
+	r.POST("/products", requirePermission(PermCatalogWrite), func(c *gin.Context) {
 		//takes an array or products in body JSON
-		isAdmin, err := validateAdmin(c)
-		if err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
-		}
-
-		if isAdmin {
-			addProducts(c)
-		}
+		addProducts(c)
 	})
 
-	r.POST("/products/price", func(c *gin.Context) {
-		isAdmin, err := validateAdmin(c)
-		if err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
-		}
+	r.POST("/products/price", requirePermission(PermCatalogWrite), func(c *gin.Context) {
+		setPrice(c)
+	})
 
-		if isAdmin {
-			setPrice(c)
-		}
+	r.PUT("/products/price/ID/:product_id/:size/:price", requirePermission(PermCatalogWrite), func(c *gin.Context) {
+		updatePriceBySize(c)
 	})
 
-	r.PUT("/products/price/ID/:product_id/:size/:price", func(c *gin.Context) {
-		isAdmin, err := validateAdmin(c)
-		if err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
-		}
+	r.GET("/products/stock", requirePermission(PermCatalogWrite), func(c *gin.Context) {
+		getStock(c)
+	})
 
-		if isAdmin {
-			updatePriceBySize(c)
-		}
+	r.PUT("/products/stock/ID/:product_id/:size/:quantity", requirePermission(PermCatalogWrite), func(c *gin.Context) {
+		setStock(c)
 	})
 
-	r.DELETE("/products/:id", func(c *gin.Context) {
-		isAdmin, err := validateAdmin(c)
-		if err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
-		}
+	r.PUT("/products/max_quantity/ID/:product_id/:max_quantity", requirePermission(PermCatalogWrite), func(c *gin.Context) {
+		updateMaxQuantity(c)
+	})
 
-		if isAdmin {
-			deleteProduct(c)
-		}
+	r.DELETE("/products/:id", requirePermission(PermCatalogWrite), func(c *gin.Context) {
+		deleteProduct(c)
 	})
 
 	//CART
@@ -144,37 +134,179 @@ func main() {
 		addToCart(c)
 	})
 
-	r.DELETE("/carts/:cart_id/:item_id", func(c *gin.Context) {
+	r.DELETE("/carts/:cart_id/:item_id", requireCartAccess(), func(c *gin.Context) {
 		removeFromCart(c)
 	})
 
-	r.POST("/checkout", func(c *gin.Context) {
+	r.POST("/checkout/:cart_id", requireCartAccess(), func(c *gin.Context) {
 		checkoutCart(c)
 	})
 
-	r.PUT("/carts/:cart_id/:item_id/:quantity", func(c *gin.Context) {
+	r.GET("/carts/restore/:token", func(c *gin.Context) {
+		restoreCart(c)
+	})
+
+	r.GET("/carts/:cart_id/summary", requireCartAccess(), func(c *gin.Context) {
+		getCartSummary(c)
+	})
+
+	r.POST("/carts/:cart_id/coupon", requireCartAccess(), func(c *gin.Context) {
+		applyCartCoupon(c)
+	})
+
+	r.DELETE("/carts/:cart_id/coupon", requireCartAccess(), func(c *gin.Context) {
+		removeCartCoupon(c)
+	})
+
+	r.PUT("/carts/:cart_id/:item_id/:quantity", requireCartAccess(), func(c *gin.Context) {
 		changeQuantity(c)
 	})
 
+	r.POST("/carts/:cart_id/:item_id/save_for_later", requireCartAccess(), func(c *gin.Context) {
+		saveForLater(c)
+	})
+
+	//WISHLIST
+	r.GET("/wishlist", requireLogin(), func(c *gin.Context) {
+		getWishlist(c)
+	})
+
+	r.POST("/wishlist", requireLogin(), func(c *gin.Context) {
+		addToWishlist(c)
+	})
+
+	r.DELETE("/wishlist/:item_id", requireLogin(), func(c *gin.Context) {
+		removeFromWishlist(c)
+	})
+
+	r.POST("/wishlist/:item_id/move_to_cart", requireLogin(), func(c *gin.Context) {
+		moveToCart(c)
+	})
+
+	r.POST("/wishlist/share", requireLogin(), func(c *gin.Context) {
+		shareWishlist(c)
+	})
+
+	r.DELETE("/wishlist/share", requireLogin(), func(c *gin.Context) {
+		unshareWishlist(c)
+	})
+
+	r.GET("/wishlist/shared/:token", func(c *gin.Context) {
+		getSharedWishlist(c)
+	})
+
 	//CART ITEMS
-	r.GET("/cart_items/:cart_id", func(c *gin.Context) {
+	r.GET("/cart_items/:cart_id", requireCartAccess(), func(c *gin.Context) {
 		getCartItems(c)
 	})
+
+	//COUPONS
+	r.GET("/coupons", requirePermission(PermCatalogWrite), func(c *gin.Context) {
+		getCoupons(c)
+	})
+
+	r.POST("/coupons", requirePermission(PermCatalogWrite), func(c *gin.Context) {
+		addCoupon(c)
+	})
+
+	r.DELETE("/coupons/:code", requirePermission(PermCatalogWrite), func(c *gin.Context) {
+		deleteCoupon(c)
+	})
+
+	//PROMOTIONS
+	r.GET("/promotions", requirePermission(PermCatalogWrite), func(c *gin.Context) {
+		getPromotions(c)
+	})
+
+	r.POST("/promotions", requirePermission(PermCatalogWrite), func(c *gin.Context) {
+		addPromotion(c)
+	})
+
+	r.PUT("/promotions/:promotion_id/active/:active", requirePermission(PermCatalogWrite), func(c *gin.Context) {
+		setPromotionActive(c)
+	})
+
+	r.DELETE("/promotions/:promotion_id", requirePermission(PermCatalogWrite), func(c *gin.Context) {
+		deletePromotion(c)
+	})
+
+	//METRICS
+	r.GET("/metrics/carts", requirePermission(PermCatalogWrite), func(c *gin.Context) {
+		getCartCleanupMetrics(c)
+	})
+
 	//USERS
 	r.POST("/users", func(c *gin.Context) {
-		register(c, userID)
+		register(c)
 	})
 
 	r.POST("/login", func(c *gin.Context) {
 		login(c)
 	})
 
+	r.POST("/token/refresh", func(c *gin.Context) {
+		refreshSession(c)
+	})
+
+	r.POST("/logout", requireLogin(), func(c *gin.Context) {
+		logout(c)
+	})
+
+	r.POST("/logout/all", requireLogin(), func(c *gin.Context) {
+		logoutEverywhere(c)
+	})
+
+	r.GET("/me/sessions", requireLogin(), func(c *gin.Context) {
+		getMySessions(c)
+	})
+
+	r.DELETE("/me/sessions/:session_id", requireLogin(), func(c *gin.Context) {
+		revokeMySession(c)
+	})
+
+	r.POST("/password/forgot", func(c *gin.Context) {
+		forgotPassword(c)
+	})
+
+	r.POST("/password/reset", func(c *gin.Context) {
+		resetPassword(c)
+	})
+
+	r.GET("/me/addresses", requireLogin(), func(c *gin.Context) {
+		getMyAddresses(c)
+	})
+
+	r.POST("/me/addresses", requireLogin(), func(c *gin.Context) {
+		addAddress(c)
+	})
+
+	r.PUT("/me/addresses/:address_id", requireLogin(), func(c *gin.Context) {
+		updateAddress(c)
+	})
+
+	r.PUT("/me/addresses/:address_id/default", requireLogin(), func(c *gin.Context) {
+		setDefaultAddress(c)
+	})
+
+	r.DELETE("/me/addresses/:address_id", requireLogin(), func(c *gin.Context) {
+		deleteAddress(c)
+	})
+
 	r.GET("/validate_admin", func(c *gin.Context) {
-		isAdmin, err := validateAdmin(c)
-		if err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
-		}
-		c.JSON(http.StatusOK, gin.H{"is_admin": isAdmin})
+		whoAmI(c)
+	})
+
+	//ROLES
+	r.GET("/admin/roles", requirePermission(PermUsersManage), func(c *gin.Context) {
+		getRoles(c)
+	})
+
+	r.GET("/admin/users", requirePermission(PermUsersManage), func(c *gin.Context) {
+		getUserRoles(c)
+	})
+
+	r.PUT("/admin/users/:user_id/role/:role", requirePermission(PermUsersManage), func(c *gin.Context) {
+		setUserRole(c)
 	})
 
 	//ORDERS
@@ -182,11 +314,223 @@ func main() {
 		getNumberOfOrders(c)
 	})
 
-	r.PUT("/orders/:order_id/:status", func(c *gin.Context) {
+	r.GET("/me/orders", requireLogin(), func(c *gin.Context) {
+		getMyOrders(c)
+	})
+
+	r.GET("/me/orders/:order_id", requireLogin(), func(c *gin.Context) {
+		getMyOrder(c)
+	})
+
+	r.GET("/orders/:order_id/invoice.pdf", requireLogin(), func(c *gin.Context) {
+		getInvoicePDF(c)
+	})
+
+	r.POST("/stream_tickets", requireLogin(), func(c *gin.Context) {
+		createStreamTicket(c)
+	})
+
+	r.GET("/me/orders/:order_id/stream", func(c *gin.Context) {
+		streamMyOrder(c)
+	})
+
+	r.POST("/me/orders/:order_id/cancel", requireLogin(), func(c *gin.Context) {
+		cancelMyOrder(c)
+	})
+
+	r.PUT("/orders/:order_id/:status", requireLogin(), func(c *gin.Context) {
 		editOrderStatus(c)
 	})
 
+	//ADMIN ORDERS
+	r.GET("/admin/orders/stream", func(c *gin.Context) {
+		streamAllOrders(c)
+	})
+
+	r.GET("/admin/orders", requirePermission(PermOrdersManage), func(c *gin.Context) {
+		adminGetOrders(c)
+	})
+
+	r.GET("/admin/orders/export.csv", requirePermission(PermOrdersManage), func(c *gin.Context) {
+		adminExportOrders(c)
+	})
+
+	r.GET("/admin/orders/:order_id", requirePermission(PermOrdersManage), func(c *gin.Context) {
+		adminGetOrder(c)
+	})
+
+	r.PUT("/admin/orders/status", requirePermission(PermOrdersManage), func(c *gin.Context) {
+		adminBulkUpdateStatus(c)
+	})
+
+	r.POST("/admin/orders/:order_id/notes", requirePermission(PermOrdersManage), func(c *gin.Context) {
+		adminAddOrderNote(c)
+	})
+
+	r.GET("/admin/orders/:order_id/refunds", requirePermission(PermOrdersManage), func(c *gin.Context) {
+		adminGetRefunds(c)
+	})
+
+	r.POST("/admin/orders/:order_id/refunds", requirePermission(PermRefundsIssue), func(c *gin.Context) {
+		adminRefundOrder(c)
+	})
+
+	//RETURNS
+	r.POST("/me/orders/:order_id/returns", requireLogin(), func(c *gin.Context) {
+		requestReturn(c)
+	})
+
+	r.GET("/me/returns", requireLogin(), func(c *gin.Context) {
+		getMyReturns(c)
+	})
+
+	r.GET("/me/returns/:return_id", requireLogin(), func(c *gin.Context) {
+		getMyReturn(c)
+	})
+
+	r.GET("/me/store_credit", requireLogin(), func(c *gin.Context) {
+		getMyStoreCredit(c)
+	})
+
+	r.GET("/admin/returns", requirePermission(PermOrdersManage), func(c *gin.Context) {
+		adminGetReturns(c)
+	})
+
+	r.GET("/admin/returns/:return_id", requirePermission(PermOrdersManage), func(c *gin.Context) {
+		adminGetReturn(c)
+	})
+
+	r.PUT("/admin/returns/:return_id/:status", requirePermission(PermRefundsIssue), func(c *gin.Context) {
+		adminUpdateReturn(c)
+	})
+
+	//EMAILS
+	r.GET("/admin/emails", requirePermission(PermOrdersManage), func(c *gin.Context) {
+		adminGetEmails(c)
+	})
+
+	r.POST("/admin/emails/:message_id/retry", requirePermission(PermOrdersManage), func(c *gin.Context) {
+		adminRetryEmail(c)
+	})
+
+	//JOBS
+	r.GET("/admin/jobs", requirePermission(PermSettingsManage), func(c *gin.Context) {
+		adminGetJobs(c)
+	})
+
+	r.GET("/admin/jobs/:job_id", requirePermission(PermSettingsManage), func(c *gin.Context) {
+		adminGetJob(c)
+	})
+
+	r.POST("/admin/jobs/:job_id/retry", requirePermission(PermSettingsManage), func(c *gin.Context) {
+		adminRetryJob(c)
+	})
+
+	r.GET("/admin/schedules", requirePermission(PermSettingsManage), func(c *gin.Context) {
+		adminGetJobSchedules(c)
+	})
+
+	//WEBHOOKS
+	r.GET("/admin/webhooks", requirePermission(PermSettingsManage), func(c *gin.Context) {
+		getWebhookEndpoints(c)
+	})
+
+	r.POST("/admin/webhooks", requirePermission(PermSettingsManage), func(c *gin.Context) {
+		addWebhookEndpoint(c)
+	})
+
+	r.PUT("/admin/webhooks/:endpoint_id", requirePermission(PermSettingsManage), func(c *gin.Context) {
+		updateWebhookEndpoint(c)
+	})
+
+	r.DELETE("/admin/webhooks/:endpoint_id", requirePermission(PermSettingsManage), func(c *gin.Context) {
+		deleteWebhookEndpoint(c)
+	})
+
+	r.GET("/admin/webhooks/:endpoint_id/deliveries", requirePermission(PermSettingsManage), func(c *gin.Context) {
+		getWebhookDeliveries(c)
+	})
+
+	r.POST("/admin/webhooks/:endpoint_id/deliveries/:delivery_id/retry", requirePermission(PermSettingsManage), func(c *gin.Context) {
+		redeliverWebhook(c)
+	})
+
+	r.POST("/admin/webhooks/:endpoint_id/test", requirePermission(PermSettingsManage), func(c *gin.Context) {
+		sendTestWebhook(c)
+	})
+
+	//FULFILLMENT
+	r.GET("/fulfillment/queue", requirePermission(PermOrdersManage), func(c *gin.Context) {
+		getFulfillmentQueue(c)
+	})
+
+	r.GET("/fulfillment/orders/:order_id", requirePermission(PermOrdersManage), func(c *gin.Context) {
+		getFulfillment(c)
+	})
+
+	r.POST("/fulfillment/orders/:order_id/claim", requirePermission(PermOrdersManage), func(c *gin.Context) {
+		claimOrder(c)
+	})
+
+	r.DELETE("/fulfillment/orders/:order_id/claim", requirePermission(PermOrdersManage), func(c *gin.Context) {
+		releaseOrder(c)
+	})
+
+	r.POST("/fulfillment/orders/:order_id/pack", requirePermission(PermOrdersManage), func(c *gin.Context) {
+		packItems(c)
+	})
+
+	r.POST("/fulfillment/orders/:order_id/ready", requirePermission(PermOrdersManage), func(c *gin.Context) {
+		markOrderReady(c)
+	})
+
+	//PICKUP
+	r.GET("/pickup/slots", func(c *gin.Context) {
+		getPickupSlots(c)
+	})
+
+	r.GET("/pickup/hours", requirePermission(PermSettingsManage), func(c *gin.Context) {
+		getStoreHours(c)
+	})
+
+	r.PUT("/pickup/hours", requirePermission(PermSettingsManage), func(c *gin.Context) {
+		setStoreHours(c)
+	})
+
+	r.POST("/pickup/closures", requirePermission(PermSettingsManage), func(c *gin.Context) {
+		addStoreClosure(c)
+	})
+
+	r.DELETE("/pickup/closures/:date", requirePermission(PermSettingsManage), func(c *gin.Context) {
+		deleteStoreClosure(c)
+	})
+
+	//DELIVERY
+	r.GET("/delivery/check", func(c *gin.Context) {
+		checkDeliveryAddress(c)
+	})
+
+	r.GET("/delivery/zones", requirePermission(PermSettingsManage), func(c *gin.Context) {
+		getDeliveryZones(c)
+	})
+
+	r.POST("/delivery/zones", requirePermission(PermSettingsManage), func(c *gin.Context) {
+		addDeliveryZone(c)
+	})
+
+	r.PUT("/delivery/zones/:zone_id", requirePermission(PermSettingsManage), func(c *gin.Context) {
+		updateDeliveryZone(c)
+	})
+
+	r.DELETE("/delivery/zones/:zone_id", requirePermission(PermSettingsManage), func(c *gin.Context) {
+		deleteDeliveryZone(c)
+	})
+
 	//PAYMENTS
+	r.POST("/stripe/webhook", func(c *gin.Context) {
+		stripeWebhook(c)
+	})
+
 	stripe.Key = os.Getenv("STRIPE_API_KEY")
 	//
 	r.Run("localhost:" + port)
@@ -198,7 +542,10 @@ func main() {
 
 // utils
 func InitializeDB() (*sql.DB, error) {
-	db, err := sql.Open("sqlite", "./main.db")
+	// the background jobs write alongside the handlers, wait on locks instead of failing.
+	// WAL keeps readers from blocking the writer, and transactions take the write lock
+	// up front so two of them can't deadlock upgrading from a read.
+	db, err := sql.Open("sqlite", "./main.db?_pragma=busy_timeout(5000)&_pragma=journal_mode(WAL)&_txlock=immediate")
 	if err != nil {
 		log.Fatalf("Failed to open main.db. %v", err)
 	}
@@ -212,71 +559,155 @@ func InitializeDB() (*sql.DB, error) {
 	return db, nil
 }
 
-func initializeAllTables() (string, string) {
+func initializeAllTables() {
 	if err := initializeCounterTable(); err != nil {
 		log.Fatal(`error initializing counter table`, err)
-		return "", ""
+		return
 	}
 
 	if err := initializeUserTable(); err != nil {
 		log.Fatal(`error initializing User table`, err)
-		return "", ""
+		return
 	}
 
-	var userID string
-
-	if id, err := generateUserID(); err != nil {
-		log.Fatal(`error generating user id`)
-		return "", ""
-	} else {
-		userID = id
-	}
-
-	fmt.Println(userID)
-
 	if err := initializeProductsTable(); err != nil {
 		log.Fatal(`error initializing product table`, err)
-		return "", ""
+		return
 	}
 	if err := initializePriceTable(); err != nil {
 		log.Fatal(`error initializing rrice table`, err)
-		return "", ""
-	}
-
-	if err := addCurrentUser(userID); err != nil {
-		log.Fatal(`error adding user`, err)
-		return "", ""
+		return
 	}
 
 	if err := initializeCartsTable(); err != nil {
 		log.Fatal(`error initializing carts table`, err)
-		return "", ""
+		return
 	}
 
 	if err := initializeCartItemsTable(); err != nil {
 		log.Fatal(`error initializing cart_items table`, err)
-		return "", ""
+		return
 	}
 
-	var cartID string
-	if result, err := createCart(userID); err != nil {
-		log.Fatal(`error creating cart`, err)
-		return "", ""
-	} else {
-		cartID = result
+	if err := initializeCartCleanupTable(); err != nil {
+		log.Fatal(`error initializing cart_cleanup_runs table`, err)
+		return
+	}
+
+	if err := initializeCartRemindersTable(); err != nil {
+		log.Fatal(`error initializing cart_reminders table`, err)
+		return
+	}
+
+	if err := initializeWishlistTables(); err != nil {
+		log.Fatal(`error initializing wishlist tables`, err)
+		return
 	}
 
 	if err := initializeOrdersTable(); err != nil {
 		log.Fatal(`error initializing orders table`, err)
-		return "", ""
+		return
 	}
 
 	if err := initializeOrderItemsTable(); err != nil {
 		log.Fatal(`error initializing order_items table`, err)
-		return "", ""
+		return
+	}
+
+	if err := initializeOrderStatusHistoryTable(); err != nil {
+		log.Fatal(`error initializing order_status_history table`, err)
+		return
+	}
+
+	if err := initializeStockTable(); err != nil {
+		log.Fatal(`error initializing stock table`, err)
+		return
+	}
+
+	if err := initializeRefundsTable(); err != nil {
+		log.Fatal(`error initializing refunds table`, err)
+		return
+	}
+
+	if err := initializeReturnsTables(); err != nil {
+		log.Fatal(`error initializing returns tables`, err)
+		return
+	}
+
+	if err := initializeInvoicesTable(); err != nil {
+		log.Fatal(`error initializing invoices table`, err)
+		return
+	}
+
+	if err := initializeSessionsTable(); err != nil {
+		log.Fatal(`error initializing sessions table`, err)
+		return
+	}
+
+	if err := initializeStreamTicketsTable(); err != nil {
+		log.Fatal(`error initializing stream_tickets table`, err)
+		return
+	}
+
+	if err := initializeRolesTable(); err != nil {
+		log.Fatal(`error initializing roles table`, err)
+		return
+	}
+
+	if err := initializeFulfillmentTables(); err != nil {
+		log.Fatal(`error initializing fulfillment tables`, err)
+		return
+	}
+
+	if err := initializeJobsTables(); err != nil {
+		log.Fatal(`error initializing jobs tables`, err)
+		return
+	}
+
+	if err := initializeWebhooksTables(); err != nil {
+		log.Fatal(`error initializing webhooks tables`, err)
+		return
+	}
+
+	if err := initializeEmailTables(); err != nil {
+		log.Fatal(`error initializing email tables`, err)
+		return
+	}
+
+	if err := initializeAddressesTable(); err != nil {
+		log.Fatal(`error initializing addresses tables`, err)
+		return
+	}
+
+	if err := initializeDeliveryZonesTable(); err != nil {
+		log.Fatal(`error initializing delivery_zones table`, err)
+		return
+	}
+
+	if err := initializePickupTables(); err != nil {
+		log.Fatal(`error initializing pickup tables`, err)
+		return
 	}
 
-	return userID, cartID
+	if err := initializeOrderNotesTable(); err != nil {
+		log.Fatal(`error initializing order_notes table`, err)
+		return
+	}
+
+	if err := initializeOrderDiscountsTable(); err != nil {
+		log.Fatal(`error initializing order_discounts table`, err)
+		return
+	}
+
+	if err := initializeCouponsTable(); err != nil {
+		log.Fatal(`error initializing coupons table`, err)
+		return
+	}
+
+	if err := initializePromotionsTable(); err != nil {
+		log.Fatal(`error initializing promotions table`, err)
+		return
+	}
 }
 
 // Utils
@@ -296,29 +727,17 @@ func countRows(table string) (int, error) {
 	return count, nil
 }
 
+// getCount returns the counter's value and moves it on by one, in a single statement
+// so two callers never get the same number.
 func getCount(column string) (int, error) {
-	//Generate temporary UserID
-	SQL := fmt.Sprintf(`SELECT %s FROM counter WHERE id = ?`, column)
-	rows, err := db.Query(SQL, 1)
-	if err != nil {
-		return 0, err
-	}
+	SQL := fmt.Sprintf(`UPDATE counter SET %s = COALESCE(%s, 0) + 1 WHERE id = ? RETURNING %s`, column, column, column)
 
 	var count int
-	for rows.Next() {
-		err := rows.Scan(&count)
-		if err != nil {
-			return 0, err
-		}
-	}
-
-	SQL_1 := fmt.Sprintf(`UPDATE counter SET %s = %d WHERE id = ?`, column, count+1)
-	_, err_1 := db.Query(SQL_1, 1)
-	if err_1 != nil {
-		return 0, err_1
+	if err := db.QueryRow(SQL, 1).Scan(&count); err != nil {
+		return 0, err
 	}
 
-	return count, nil
+	return count - 1, nil
 }
 
 func parseToInt(value string) (int64, error) {
@@ -329,3 +748,87 @@ func parseToInt(value string) (int64, error) {
 		return valueInt, nil
 	}
 }
+
+// addColumn migrates tables created before a column existed, CREATE TABLE IF NOT EXISTS
+// leaves them untouched.
+func addColumn(table string, column string, definition string) error {
+	SQL := fmt.Sprintf(`SELECT COUNT(*) FROM pragma_table_info('%s') WHERE name = ?`, table)
+
+	var count int
+	if err := db.QueryRow(SQL, column).Scan(&count); err != nil {
+		return err
+	}
+
+	if count > 0 {
+		return nil
+	}
+
+	SQL_1 := fmt.Sprintf(`ALTER TABLE %s ADD COLUMN %s %s`, table, column, definition)
+	_, err := db.Exec(SQL_1)
+	if err != nil {
+		return fmt.Errorf("failed to add %s.%s: %v", table, column, err)
+	} else {
+		return nil
+	}
+}
+
+// envInt reads a whole number setting from .env, falling back when it's missing or malformed.
+func envInt(name string, fallback int) int {
+	value, err := strconv.Atoi(os.Getenv(name))
+	if err != nil {
+		return fallback
+	}
+
+	return value
+}
+
+// envString reads a text setting from .env, falling back when it's missing or empty.
+func envString(name string, fallback string) string {
+	if value := os.Getenv(name); value != "" {
+		return value
+	}
+
+	return fallback
+}
+
+// shopURL is where the frontend lives, used for redirects and links in emails.
+func shopURL() string {
+	if url := os.Getenv("SHOP_URL"); url != "" {
+		return strings.TrimSuffix(url, "/")
+	}
+
+	return "http://localhost:5173"
+}
+
+// formatMoney prints an amount in cents as dollars, negative amounts as -$1.50.
+func formatMoney(cents int) string {
+	sign := ""
+	if cents < 0 {
+		sign, cents = "-", -cents
+	}
+
+	return fmt.Sprintf("%s$%d.%02d", sign, cents/100, cents%100)
+}
+
+// splitList reads the comma separated lists stored in TEXT columns.
+func splitList(value string) []string {
+	list := []string{}
+	for _, v := range strings.Split(value, ",") {
+		v = strings.TrimSpace(v)
+		if v != "" {
+			list = append(list, v)
+		}
+	}
+
+	return list
+}
+
+func contains(list []string, value string) bool {
+	for _, v := range list {
+		if strings.EqualFold(v, value) {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,312 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	_ "modernc.org/sqlite"
+)
+
+type Invoice struct {
+	InvoiceNumber string
+	OrderID       string
+	Path          string
+	CreatedAt     time.Time
+}
+
+func initializeInvoicesTable() error {
+	SQL := `
+		CREATE TABLE IF NOT EXISTS invoices (
+			invoice_number TEXT PRIMARY KEY,
+			order_id TEXT UNIQUE,
+			path TEXT,
+			created_at TIMESTAMP
+		)`
+	_, err := db.Exec(SQL)
+	if err != nil {
+		return err
+	}
+
+	return addColumn("counter", "invoices", "INT DEFAULT 0")
+}
+
+// getInvoicePDF serves an order's invoice to its customer or to staff managing
+// orders. The first request numbers and stores it, later ones get the same document back.
+func getInvoicePDF(c *gin.Context) {
+	p, err := currentPrincipal(c)
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": err.Error()})
+		return
+	}
+	userID, isAdmin := p.UserID, p.Can(PermOrdersManage)
+
+	orderID := c.Param("order_id")
+	order, err := getOrder(orderID)
+	if err == sql.ErrNoRows || (err == nil && !isAdmin && order.UserID != userID) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "order not found: " + orderID})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	if order.Status == StatusPendingPayment {
+		c.JSON(http.StatusConflict, gin.H{"error": "orders get an invoice once they're paid"})
+		return
+	}
+	history, err := getOrderStatusHistory(orderID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if paymentState(order, history) == "not_paid" {
+		c.JSON(http.StatusConflict, gin.H{"error": "order was never paid"})
+		return
+	}
+
+	invoice, err := getOrCreateInvoice(orderID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"message": "error creating invoice", "error": err.Error()})
+		return
+	}
+
+	document, err := os.ReadFile(invoice.Path)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"message": "error reading invoice", "error": err.Error()})
+		return
+	}
+
+	c.Header("Content-Disposition", `inline; filename="`+invoice.InvoiceNumber+`.pdf"`)
+	c.Data(http.StatusOK, "application/pdf", document)
+}
+
+// getOrCreateInvoice returns the stored invoice for an order, numbering and rendering
+// it the first time. The number is taken in the same transaction as the invoice row
+// so numbers have no gaps.
+func getOrCreateInvoice(orderID string) (Invoice, error) {
+	invoice, err := getInvoice(orderID)
+	if err == nil {
+		if _, err := os.Stat(invoice.Path); err == nil {
+			return invoice, nil
+		}
+		// the file went missing, render it again under the same number
+		return invoice, writeInvoice(invoice)
+	}
+	if err != sql.ErrNoRows {
+		return Invoice{}, err
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return Invoice{}, err
+	}
+	defer tx.Rollback()
+
+	var count int
+	if err := tx.QueryRow(`SELECT COALESCE(invoices, 0) FROM counter WHERE id = 1`).Scan(&count); err != nil {
+		return Invoice{}, err
+	}
+	if _, err := tx.Exec(`UPDATE counter SET invoices = ? WHERE id = 1`, count+1); err != nil {
+		return Invoice{}, err
+	}
+
+	number := fmt.Sprintf("INV-%06d", count+1)
+	invoice = Invoice{
+		InvoiceNumber: number,
+		OrderID:       orderID,
+		Path:          filepath.Join(invoiceDir(), number+".pdf"),
+		CreatedAt:     time.Now(),
+	}
+
+	SQL := `INSERT INTO invoices (invoice_number, order_id, path, created_at) VALUES (?, ?, ?, ?)`
+	if _, err := tx.Exec(SQL, invoice.InvoiceNumber, invoice.OrderID, invoice.Path, invoice.CreatedAt); err != nil {
+		return Invoice{}, err
+	}
+
+	if err := writeInvoice(invoice); err != nil {
+		return Invoice{}, err
+	}
+
+	return invoice, tx.Commit()
+}
+
+func getInvoice(orderID string) (Invoice, error) {
+	var invoice Invoice
+	SQL := `SELECT * FROM invoices WHERE order_id = ?`
+	err := db.QueryRow(SQL, orderID).Scan(&invoice.InvoiceNumber, &invoice.OrderID, &invoice.Path, &invoice.CreatedAt)
+
+	return invoice, err
+}
+
+// invoices are kept under INVOICE_DIR, "invoices" by default
+func invoiceDir() string {
+	return envString("INVOICE_DIR", "invoices")
+}
+
+func writeInvoice(invoice Invoice) error {
+	document, err := renderInvoice(invoice)
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(invoice.Path), 0o755); err != nil {
+		return err
+	}
+
+	return os.WriteFile(invoice.Path, document, 0o644)
+}
+
+// renderInvoice lays out the invoice: store details and HST number, who it's for,
+// the order lines as bought, the tax breakdown, totals and the payment reference.
+// Store details come from STORE_NAME, STORE_ADDRESS and HST_NUMBER.
+func renderInvoice(invoice Invoice) ([]byte, error) {
+	detail, err := getOrderDetail(invoice.OrderID)
+	if err != nil {
+		return nil, err
+	}
+	order := detail.Order
+
+	name, email, err := getUserContact(order.UserID)
+	if err != nil {
+		return nil, err
+	}
+
+	pdf := NewPDF()
+	pdf.AddPage()
+	left, right := 50.0, float64(pdfPageWidth-50)
+	y := float64(pdfPageHeight - 60)
+
+	pdf.Text(FontBold, 18, left, y, envString("STORE_NAME", "Incense Web Shop"))
+	pdf.Text(FontBold, 18, right-150, y, "Invoice")
+	y -= 16
+	for _, line := range splitList(strings.ReplaceAll(envString("STORE_ADDRESS", ""), "\n", ",")) {
+		pdf.Text(FontRegular, 9, left, y, line)
+		y -= 12
+	}
+	pdf.Text(FontRegular, 9, left, y, "HST No. "+envString("HST_NUMBER", "not registered"))
+
+	meta := [][2]string{
+		{"Invoice", invoice.InvoiceNumber},
+		{"Date", invoice.CreatedAt.Format("Jan 2, 2006")},
+		{"Order", order.OrderID},
+		{"Ordered", order.CreatedAt.Format("Jan 2, 2006")},
+	}
+	metaY := float64(pdfPageHeight - 76)
+	for _, m := range meta {
+		pdf.Text(FontRegular, 9, right-150, metaY, m[0])
+		pdf.Text(FontRegular, 9, right-90, metaY, m[1])
+		metaY -= 12
+	}
+
+	y = min(y, metaY) - 24
+	pdf.Text(FontBold, 10, left, y, "Bill to")
+	if isDelivery, _ := strconv.ParseBool(order.IsDelivery); isDelivery {
+		pdf.Text(FontBold, 10, left+250, y, "Deliver to")
+	} else {
+		pdf.Text(FontBold, 10, left+250, y, "Pickup")
+	}
+	y -= 13
+
+	billTo := []string{name, email}
+	shipTo := []string{"Ready " + order.ReadyDate.Local().Format("Mon Jan 2, 3:04 PM")}
+	if detail.ShippingAddress != nil {
+		a := detail.ShippingAddress
+		shipTo = []string{a.Name, a.Street, a.City + ", " + a.Province + " " + a.PostalCode}
+		if a.Unit != "" {
+			shipTo[1] = a.Unit + "-" + a.Street
+		}
+	} else if order.DeliveryAddress != "" {
+		shipTo = []string{order.DeliveryAddress}
+	}
+	for i := 0; i < max(len(billTo), len(shipTo)); i++ {
+		if i < len(billTo) {
+			pdf.Text(FontRegular, 9, left, y, billTo[i])
+		}
+		if i < len(shipTo) {
+			pdf.Text(FontRegular, 9, left+250, y, shipTo[i])
+		}
+		y -= 12
+	}
+
+	header := func() {
+		y -= 14
+		pdf.Text(FontBold, 9, left, y, "Item")
+		pdf.Text(FontBold, 9, left+250, y, "Qty")
+		pdf.Text(FontBold, 9, left+300, y, "Price")
+		pdf.Text(FontBold, 9, left+380, y, "Discount")
+		pdf.Text(FontBold, 9, right-30, y, "Total")
+		y -= 5
+		pdf.Line(left, y, right, y)
+		y -= 13
+	}
+	header()
+
+	itemsTotal := 0
+	for _, item := range detail.Items {
+		if y < 140 {
+			pdf.AddPage()
+			y = float64(pdfPageHeight - 50)
+			header()
+		}
+
+		label := item.Name
+		if item.VariantLabel != "" {
+			label += " (" + item.VariantLabel + ")"
+		}
+		lineTotal := item.Price * item.Quantity
+		itemsTotal += lineTotal
+
+		pdf.Text(FontRegular, 9, left, y, label)
+		pdf.TextRight(9, left+265, y, strconv.Itoa(item.Quantity))
+		pdf.TextRight(9, left+350, y, formatMoney(item.Price))
+		if item.Discount > 0 {
+			pdf.TextRight(9, left+430, y, "-"+formatMoney(item.Discount))
+		}
+		pdf.TextRight(9, right, y, formatMoney(lineTotal-item.Discount))
+		y -= 13
+	}
+
+	y += 5
+	pdf.Line(left, y, right, y)
+	y -= 16
+
+	taxBase := order.Subtotal + order.DeliveryFee
+	totals := [][2]string{{"Subtotal", formatMoney(itemsTotal)}}
+	if order.Discount > 0 {
+		totals = append(totals, [2]string{"Discounts", "-" + formatMoney(order.Discount)})
+	}
+	if order.DeliveryFee > 0 {
+		totals = append(totals, [2]string{"Delivery", formatMoney(order.DeliveryFee)})
+	}
+	totals = append(totals,
+		[2]string{fmt.Sprintf("HST %d%% on %s", taxRate, formatMoney(taxBase)), formatMoney(order.Tax)},
+		[2]string{"Total (CAD)", formatMoney(order.TotalPrice)},
+	)
+	if order.Refunded > 0 {
+		totals = append(totals, [2]string{"Refunded", "-" + formatMoney(order.Refunded)})
+	}
+	for _, t := range totals {
+		font := FontRegular
+		if strings.HasPrefix(t[0], "Total") {
+			font = FontBold
+		}
+		pdf.Text(font, 9, right-200, y, t[0])
+		pdf.TextRight(9, right, y, t[1])
+		y -= 13
+	}
+
+	y -= 20
+	pdf.Text(FontRegular, 8, left, y, "Payment reference: "+order.PaymentID)
+	y -= 11
+	pdf.Text(FontRegular, 8, left, y, "Thank you for your order.")
+
+	return pdf.Bytes(), nil
+}
@@ -0,0 +1,538 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	_ "modernc.org/sqlite"
+)
+
+const (
+	JobQueued  = "queued"
+	JobRunning = "running"
+	JobDone    = "done"
+	JobDead    = "dead"
+)
+
+const (
+	JobSendEmail          = "email.send"
+	JobOrderStatusChanged = "order.status_changed"
+	JobCartCleanup        = "carts.cleanup"
+	JobCartReminders      = "carts.remind"
+)
+
+// Job is a side effect waiting to happen. Jobs are rows so they can be written in
+// the same transaction as the change that causes them, nothing is lost if the
+// process stops before a worker gets to them.
+type Job struct {
+	JobID       int
+	Kind        string
+	Payload     string
+	Status      string
+	Attempts    int
+	MaxAttempts int
+	LastError   string
+	RunAt       time.Time
+	LockedAt    sql.NullTime
+	CreatedAt   time.Time
+	FinishedAt  sql.NullTime
+}
+
+type JobSchedule struct {
+	Kind            string
+	IntervalSeconds int
+	NextRunAt       time.Time
+	LastRunAt       sql.NullTime
+}
+
+type JobHandler func(job Job) error
+
+// jobHandlers maps each kind of job to the function that runs it. A handler that
+// returns an error is retried, so it should be safe to run twice.
+var jobHandlers = map[string]JobHandler{
+	JobSendEmail:          deliverEmail,
+	JobOrderStatusChanged: notifyStatusChange,
+	JobCartCleanup:        cleanupCartsJob,
+	JobCartReminders:      cartRemindersJob,
+	JobWebhookPublish:     fanOutEvent,
+	JobWebhookDeliver:     deliverWebhook,
+}
+
+// execer is a *sql.DB or a *sql.Tx, so jobs can be queued inside a transaction.
+type execer interface {
+	Exec(query string, args ...any) (sql.Result, error)
+}
+
+// querier is a *sql.DB or a *sql.Tx, for reads that may run inside a transaction.
+type querier interface {
+	QueryRow(query string, args ...any) *sql.Row
+}
+
+// jobWake nudges an idle worker when a job is queued, so they don't wait a whole poll.
+var jobWake = make(chan struct{}, 1)
+
+func initializeJobsTables() error {
+	SQL_0 := `CREATE TABLE IF NOT EXISTS jobs (
+				job_id INTEGER PRIMARY KEY AUTOINCREMENT,
+				kind TEXT,
+				payload TEXT,
+				status TEXT,
+				attempts INT,
+				max_attempts INT,
+				last_error TEXT,
+				run_at INT,
+				locked_at INT,
+				created_at TIMESTAMP,
+				finished_at TIMESTAMP
+			)`
+	_, err_0 := db.Exec(SQL_0)
+	if err_0 != nil {
+		return fmt.Errorf("failed to create jobs table: %v", err_0)
+	}
+
+	SQL_1 := `CREATE INDEX IF NOT EXISTS jobs_due ON jobs (status, run_at)`
+	_, err_1 := db.Exec(SQL_1)
+	if err_1 != nil {
+		return fmt.Errorf("failed to index jobs table: %v", err_1)
+	}
+
+	SQL_2 := `CREATE TABLE IF NOT EXISTS job_schedules (
+				kind TEXT PRIMARY KEY,
+				interval_seconds INT,
+				next_run_at INT,
+				last_run_at TIMESTAMP
+			)`
+	_, err_2 := db.Exec(SQL_2)
+	if err_2 != nil {
+		return fmt.Errorf("failed to create job_schedules table: %v", err_2)
+	}
+
+	for _, column := range [][3]string{{"jobs", "job_id", "run_at"}, {"jobs", "job_id", "locked_at"}, {"job_schedules", "kind", "next_run_at"}} {
+		if err := unixTimeColumn(column[0], column[1], column[2]); err != nil {
+			return fmt.Errorf("failed to migrate %s.%s: %v", column[0], column[2], err)
+		}
+	}
+
+	return nil
+}
+
+// unixTimeColumn rewrites times older builds saved as text into unix seconds. The
+// due and lease checks compare these columns, and the text forms don't compare as times.
+func unixTimeColumn(table string, key string, column string) error {
+	SQL_0 := fmt.Sprintf(`SELECT %s, CAST(%s AS TEXT) FROM %s WHERE typeof(%s) = 'text'`, key, column, table, column)
+	rows, err := db.Query(SQL_0)
+	if err != nil {
+		return err
+	}
+	stored := map[string]string{}
+	for rows.Next() {
+		var id, value string
+		if err := rows.Scan(&id, &value); err != nil {
+			rows.Close()
+			return err
+		}
+		stored[id] = value
+	}
+	rows.Close()
+
+	SQL_1 := fmt.Sprintf(`UPDATE %s SET %s = ? WHERE %s = ?`, table, column, key)
+	for id, value := range stored {
+		// time.Time.String(), with the monotonic clock reading on the end
+		value, _, _ = strings.Cut(value, " m=")
+		t, err := time.Parse("2006-01-02 15:04:05.999999999 -0700 MST", value)
+		if err != nil {
+			return err
+		}
+		if _, err := db.Exec(SQL_1, t.Unix(), id); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// enqueueJob queues a job to run at runAt. Pass the transaction making the change
+// the job belongs to, so the two are saved together or not at all.
+// Jobs get JOB_MAX_ATTEMPTS (8) tries before they're dead lettered.
+func enqueueJob(ex execer, kind string, payload any, runAt time.Time) error {
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+
+	SQL := `INSERT INTO jobs (kind, payload, status, attempts, max_attempts, last_error, run_at, created_at)
+			VALUES (?, ?, ?, 0, ?, '', ?, ?)`
+	_, err = ex.Exec(SQL, kind, string(body), JobQueued, envInt("JOB_MAX_ATTEMPTS", 8), runAt.Unix(), time.Now())
+	if err != nil {
+		return err
+	}
+
+	select {
+	case jobWake <- struct{}{}:
+	default:
+	}
+
+	return nil
+}
+
+// scheduleJob makes kind run every interval. The next run time is kept across
+// restarts, changing the interval only applies from the next run.
+func scheduleJob(kind string, interval time.Duration) error {
+	SQL := `INSERT INTO job_schedules (kind, interval_seconds, next_run_at) VALUES (?, ?, ?)
+			ON CONFLICT (kind) DO UPDATE SET interval_seconds = excluded.interval_seconds`
+	_, err := db.Exec(SQL, kind, int(interval.Seconds()), time.Now().Unix())
+	if err != nil {
+		return err
+	} else {
+		return nil
+	}
+}
+
+// WORKERS
+
+// runJobWorkers starts the worker pool and then keeps the schedule, until the
+// process exits. Configured with JOB_WORKERS and JOB_POLL_SECONDS.
+func runJobWorkers(workers int, poll time.Duration) {
+	for i := 0; i < workers; i++ {
+		go jobWorker(poll)
+	}
+
+	ticker := time.NewTicker(poll)
+	defer ticker.Stop()
+
+	for {
+		if err := releaseStaleJobs(); err != nil {
+			log.Printf("releasing stale jobs failed: %v", err)
+		}
+		if err := enqueueScheduledJobs(); err != nil {
+			log.Printf("scheduling jobs failed: %v", err)
+		}
+
+		<-ticker.C
+	}
+}
+
+func jobWorker(poll time.Duration) {
+	for {
+		job, err := claimJob()
+		if err == nil {
+			runJob(job)
+			continue
+		}
+		if err != sql.ErrNoRows {
+			log.Printf("claiming job failed: %v", err)
+		}
+
+		select {
+		case <-jobWake:
+		case <-time.After(poll):
+		}
+	}
+}
+
+// claimLock keeps this process's workers from claiming at the same time, SQLite
+// answers concurrent writers with busy errors rather than queueing them.
+var claimLock sync.Mutex
+
+// claimJob takes the next due job and starts its lease. Picking and locking it are
+// one statement, so two workers can't take the same job.
+func claimJob() (Job, error) {
+	claimLock.Lock()
+	defer claimLock.Unlock()
+
+	SQL := `UPDATE jobs SET (status, attempts, locked_at) = (?, attempts + 1, ?)
+			WHERE job_id = (SELECT job_id FROM jobs WHERE status = ? AND run_at <= ? ORDER BY run_at, job_id LIMIT 1)
+			AND status = ?
+			RETURNING *`
+	now := time.Now().Unix()
+
+	return scanJob(db.QueryRow(SQL, JobRunning, now, JobQueued, now, JobQueued).Scan)
+}
+
+// scanJob reads a jobs row, turning the unix times back into times.
+func scanJob(scan func(dest ...any) error) (Job, error) {
+	var job Job
+	var runAt int64
+	var lockedAt sql.NullInt64
+	err := scan(&job.JobID, &job.Kind, &job.Payload, &job.Status, &job.Attempts, &job.MaxAttempts,
+		&job.LastError, &runAt, &lockedAt, &job.CreatedAt, &job.FinishedAt)
+	if err != nil {
+		return job, err
+	}
+
+	job.RunAt = time.Unix(runAt, 0)
+	if lockedAt.Valid {
+		job.LockedAt = sql.NullTime{Time: time.Unix(lockedAt.Int64, 0), Valid: true}
+	}
+
+	return job, nil
+}
+
+// runJob runs a claimed job and records the outcome. Failures are retried with
+// exponential backoff until the job runs out of attempts and is dead lettered.
+// The outcome only lands while the job is still this attempt's, a worker that lost
+// its lease leaves the job to whoever has it now.
+func runJob(job Job) {
+	stop := make(chan struct{})
+	go heartbeatJob(job, stop)
+	err := callJobHandler(job)
+	close(stop)
+
+	if err == nil {
+		SQL := `UPDATE jobs SET (status, last_error, finished_at) = (?, '', ?) WHERE job_id = ? AND status = ? AND attempts = ?`
+		if _, err := db.Exec(SQL, JobDone, time.Now(), job.JobID, JobRunning, job.Attempts); err != nil {
+			log.Printf("job %d: %v", job.JobID, err)
+		}
+		return
+	}
+
+	if job.Attempts >= job.MaxAttempts {
+		log.Printf("job %d (%s) is dead after %d attempts: %v", job.JobID, job.Kind, job.Attempts, err)
+		SQL := `UPDATE jobs SET (status, last_error, finished_at) = (?, ?, ?) WHERE job_id = ? AND status = ? AND attempts = ?`
+		if _, err := db.Exec(SQL, JobDead, err.Error(), time.Now(), job.JobID, JobRunning, job.Attempts); err != nil {
+			log.Printf("job %d: %v", job.JobID, err)
+		}
+		return
+	}
+
+	log.Printf("job %d (%s) failed, attempt %d of %d: %v", job.JobID, job.Kind, job.Attempts, job.MaxAttempts, err)
+	SQL := `UPDATE jobs SET (status, last_error, run_at) = (?, ?, ?) WHERE job_id = ? AND status = ? AND attempts = ?`
+	runAt := time.Now().Add(jobBackoff(job.Attempts)).Unix()
+	if _, err := db.Exec(SQL, JobQueued, err.Error(), runAt, job.JobID, JobRunning, job.Attempts); err != nil {
+		log.Printf("job %d: %v", job.JobID, err)
+	}
+}
+
+// jobLease is how long a running job is held without a heartbeat, JOB_LEASE_SECONDS (60).
+func jobLease() time.Duration {
+	return time.Duration(envInt("JOB_LEASE_SECONDS", 60)) * time.Second
+}
+
+// heartbeatJob renews the job's lease every third of jobLease until stop closes, so
+// a handler may run as long as it needs without releaseStaleJobs taking it back.
+func heartbeatJob(job Job, stop chan struct{}) {
+	ticker := time.NewTicker(jobLease() / 3)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+
+		SQL := `UPDATE jobs SET locked_at = ? WHERE job_id = ? AND status = ? AND attempts = ?`
+		result, err := db.Exec(SQL, time.Now().Unix(), job.JobID, JobRunning, job.Attempts)
+		if err != nil {
+			log.Printf("job %d: renewing lease failed: %v", job.JobID, err)
+			continue
+		}
+		if n, _ := result.RowsAffected(); n == 0 {
+			log.Printf("job %d (%s) lost its lease, its outcome will be dropped", job.JobID, job.Kind)
+			return
+		}
+	}
+}
+
+// callJobHandler turns a panicking handler into a failed attempt instead of a dead worker.
+func callJobHandler(job Job) (err error) {
+	handler, ok := jobHandlers[job.Kind]
+	if !ok {
+		return fmt.Errorf("unknown job kind: %s", job.Kind)
+	}
+
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("panic: %v", r)
+		}
+	}()
+
+	return handler(job)
+}
+
+// jobBackoff doubles the wait after every failed attempt, starting at
+// JOB_BACKOFF_SECONDS (15) and never more than 6 hours.
+func jobBackoff(attempts int) time.Duration {
+	wait := time.Duration(envInt("JOB_BACKOFF_SECONDS", 15)) * time.Second
+	for i := 1; i < attempts && wait < 6*time.Hour; i++ {
+		wait *= 2
+	}
+
+	return min(wait, 6*time.Hour)
+}
+
+// releaseStaleJobs puts back jobs whose worker went away mid run. Running jobs renew
+// their lease while they work, one whose lease ran out has no worker left to finish
+// it. The attempt still counts.
+func releaseStaleJobs() error {
+	cutoff := time.Now().Add(-jobLease()).Unix()
+
+	SQL := `UPDATE jobs SET (status, last_error) = (?, 'worker stopped renewing its lease') WHERE status = ? AND locked_at < ?`
+	_, err := db.Exec(SQL, JobQueued, JobRunning, cutoff)
+	if err != nil {
+		return err
+	} else {
+		return nil
+	}
+}
+
+// enqueueScheduledJobs queues every schedule that is due. A schedule whose last job
+// hasn't finished yet is skipped, so slow jobs don't pile up.
+func enqueueScheduledJobs() error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	SQL_0 := `SELECT kind, interval_seconds FROM job_schedules
+			WHERE next_run_at <= ?
+			AND NOT EXISTS (SELECT 1 FROM jobs WHERE jobs.kind = job_schedules.kind AND jobs.status IN (?, ?))`
+	rows, err := tx.Query(SQL_0, time.Now().Unix(), JobQueued, JobRunning)
+	if err != nil {
+		return err
+	}
+	due := []JobSchedule{}
+	for rows.Next() {
+		var schedule JobSchedule
+		if err := rows.Scan(&schedule.Kind, &schedule.IntervalSeconds); err != nil {
+			rows.Close()
+			return err
+		}
+		due = append(due, schedule)
+	}
+	rows.Close()
+
+	for _, schedule := range due {
+		if err := enqueueJob(tx, schedule.Kind, nil, time.Now()); err != nil {
+			return err
+		}
+
+		SQL_1 := `UPDATE job_schedules SET (next_run_at, last_run_at) = (?, ?) WHERE kind = ?`
+		next := time.Now().Add(time.Duration(schedule.IntervalSeconds) * time.Second)
+		if _, err := tx.Exec(SQL_1, next.Unix(), time.Now(), schedule.Kind); err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// ADMIN
+
+func adminGetJobs(c *gin.Context) {
+	where, args := "1 = 1", []any{}
+	if status := c.Query("status"); status != "" {
+		where, args = where+" AND status = ?", append(args, status)
+	}
+	if kind := c.Query("kind"); kind != "" {
+		where, args = where+" AND kind = ?", append(args, kind)
+	}
+
+	SQL := `SELECT * FROM jobs WHERE ` + where + ` ORDER BY job_id DESC LIMIT 200`
+	rows, err := db.Query(SQL, args...)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	defer rows.Close()
+
+	jobs := []Job{}
+	for rows.Next() {
+		job, err := scanJob(rows.Scan)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		jobs = append(jobs, job)
+	}
+
+	counts := map[string]int{}
+	countRows, err := db.Query(`SELECT status, COUNT(*) FROM jobs GROUP BY status`)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	defer countRows.Close()
+	for countRows.Next() {
+		var status string
+		var count int
+		if err := countRows.Scan(&status, &count); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		counts[status] = count
+	}
+
+	c.IndentedJSON(http.StatusOK, gin.H{"counts": counts, "jobs": jobs})
+}
+
+func adminGetJob(c *gin.Context) {
+	jobID := c.Param("job_id")
+
+	SQL := `SELECT * FROM jobs WHERE job_id = ?`
+	job, err := scanJob(db.QueryRow(SQL, jobID).Scan)
+	if err == sql.ErrNoRows {
+		c.JSON(http.StatusNotFound, gin.H{"error": "job not found: " + jobID})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.IndentedJSON(http.StatusOK, job)
+}
+
+// adminRetryJob runs a dead or waiting job again now, with a fresh set of attempts.
+func adminRetryJob(c *gin.Context) {
+	jobID := c.Param("job_id")
+
+	SQL := `UPDATE jobs SET (status, attempts, run_at, finished_at) = (?, 0, ?, NULL) WHERE job_id = ? AND status IN (?, ?)`
+	result, err := db.Exec(SQL, JobQueued, time.Now().Unix(), jobID, JobDead, JobQueued)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "no dead or queued job " + jobID})
+		return
+	}
+
+	select {
+	case jobWake <- struct{}{}:
+	default:
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "retrying job " + jobID})
+}
+
+func adminGetJobSchedules(c *gin.Context) {
+	rows, err := db.Query(`SELECT * FROM job_schedules ORDER BY kind`)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	defer rows.Close()
+
+	schedules := []JobSchedule{}
+	for rows.Next() {
+		var schedule JobSchedule
+		var nextRunAt int64
+		if err := rows.Scan(&schedule.Kind, &schedule.IntervalSeconds, &nextRunAt, &schedule.LastRunAt); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		schedule.NextRunAt = time.Unix(nextRunAt, 0)
+		schedules = append(schedules, schedule)
+	}
+
+	c.IndentedJSON(http.StatusOK, schedules)
+}
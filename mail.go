@@ -0,0 +1,137 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/smtp"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+type Mail struct {
+	To      string
+	Subject string
+	Text    string
+	HTML    string
+}
+
+type MailSender interface {
+	Send(mail Mail) error
+}
+
+var mailer MailSender
+
+// newMailSender sends through SMTP when SMTP_HOST is set, otherwise every message is
+// written to MAIL_DIR (default ./mail) so nothing leaves the machine in development.
+func newMailSender() MailSender {
+	from := os.Getenv("MAIL_FROM")
+	if from == "" {
+		from = "shop@localhost"
+	}
+
+	host := os.Getenv("SMTP_HOST")
+	if host == "" {
+		dir := os.Getenv("MAIL_DIR")
+		if dir == "" {
+			dir = "mail"
+		}
+		return &FileSender{Dir: dir, From: from}
+	}
+
+	return &SMTPSender{
+		Host:     host,
+		Port:     envInt("SMTP_PORT", 587),
+		Username: os.Getenv("SMTP_USERNAME"),
+		Password: os.Getenv("SMTP_PASSWORD"),
+		From:     from,
+	}
+}
+
+type SMTPSender struct {
+	Host     string
+	Port     int
+	Username string
+	Password string
+	From     string
+}
+
+func (s *SMTPSender) Send(mail Mail) error {
+	if err := checkHeaders(mail); err != nil {
+		return err
+	}
+
+	var auth smtp.Auth
+	if s.Username != "" {
+		auth = smtp.PlainAuth("", s.Username, s.Password, s.Host)
+	}
+
+	addr := fmt.Sprintf("%s:%d", s.Host, s.Port)
+	return smtp.SendMail(addr, auth, s.From, []string{mail.To}, buildMessage(s.From, mail))
+}
+
+// FileSender writes each message as an .eml file and logs it, for development and tests.
+type FileSender struct {
+	Dir  string
+	From string
+}
+
+func (s *FileSender) Send(mail Mail) error {
+	if err := checkHeaders(mail); err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(s.Dir, 0o755); err != nil {
+		return err
+	}
+
+	name := fmt.Sprintf("%d-%s.eml", time.Now().UnixNano(), strings.ReplaceAll(mail.To, "@", "_at_"))
+	path := filepath.Join(s.Dir, name)
+	if err := os.WriteFile(path, buildMessage(s.From, mail), 0o644); err != nil {
+		return err
+	}
+
+	log.Printf("mail to %s (%s) written to %s", mail.To, mail.Subject, path)
+	return nil
+}
+
+// checkHeaders refuses a recipient or subject with a line break in it, which would
+// let whoever wrote it add headers of their own.
+func checkHeaders(mail Mail) error {
+	if strings.ContainsAny(mail.To, "\r\n") {
+		return fmt.Errorf("recipient %q has a line break in it", mail.To)
+	}
+	if strings.ContainsAny(mail.Subject, "\r\n") {
+		return fmt.Errorf("subject %q has a line break in it", mail.Subject)
+	}
+
+	return nil
+}
+
+// buildMessage renders a multipart/alternative message with the text and HTML bodies.
+func buildMessage(from string, mail Mail) []byte {
+	boundary := fmt.Sprintf("boundary-%d", time.Now().UnixNano())
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "From: %s\r\n", from)
+	fmt.Fprintf(&b, "To: %s\r\n", mail.To)
+	fmt.Fprintf(&b, "Subject: %s\r\n", mail.Subject)
+	fmt.Fprintf(&b, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	b.WriteString("MIME-Version: 1.0\r\n")
+	fmt.Fprintf(&b, "Content-Type: multipart/alternative; boundary=%q\r\n\r\n", boundary)
+
+	fmt.Fprintf(&b, "--%s\r\n", boundary)
+	b.WriteString("Content-Type: text/plain; charset=utf-8\r\n\r\n")
+	b.WriteString(mail.Text + "\r\n")
+
+	if mail.HTML != "" {
+		fmt.Fprintf(&b, "--%s\r\n", boundary)
+		b.WriteString("Content-Type: text/html; charset=utf-8\r\n\r\n")
+		b.WriteString(mail.HTML + "\r\n")
+	}
+
+	fmt.Fprintf(&b, "--%s--\r\n", boundary)
+
+	return []byte(b.String())
+}
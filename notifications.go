@@ -0,0 +1,544 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	htmltemplate "html/template"
+	"log"
+	"net/http"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	_ "modernc.org/sqlite"
+)
+
+const (
+	EmailPending = "pending"
+	EmailSent    = "sent"
+	EmailFailed  = "failed"
+)
+
+const (
+	EmailOrderConfirmation = "order_confirmation"
+	EmailPaymentFailed     = "payment_failed"
+	EmailReadyForPickup    = "ready_for_pickup"
+	EmailOutForDelivery    = "out_for_delivery"
+	EmailRefunded          = "refunded"
+	EmailPasswordReset     = "password_reset"
+	EmailCartReminder      = "cart_reminder"
+)
+
+// EmailMessage is one row of the delivery log, every email the shop sends goes
+// through it so failed sends can be retried and inspected.
+type EmailMessage struct {
+	MessageID     int
+	Kind          string
+	OrderID       string
+	Recipient     string
+	Subject       string
+	Text          string
+	HTML          string
+	Status        string
+	Attempts      int
+	LastError     string
+	NextAttemptAt time.Time
+	CreatedAt     time.Time
+	SentAt        sql.NullTime
+}
+
+type emailTemplate struct {
+	Subject *template.Template
+	Text    *template.Template
+	HTML    *htmltemplate.Template
+}
+
+type orderEmailData struct {
+	Username string
+	Order    Order
+	Items    []OrderItem
+	Address  *Address
+	OrderURL string
+}
+
+type passwordResetData struct {
+	Username string
+	ResetURL string
+}
+
+type PasswordForgot struct {
+	Email string
+}
+
+type PasswordReset struct {
+	Token    string
+	Password string
+}
+
+var emailFuncs = template.FuncMap{"money": formatMoney}
+
+func newEmailTemplate(name string, subject string, text string, html string) emailTemplate {
+	return emailTemplate{
+		Subject: template.Must(template.New(name).Funcs(emailFuncs).Parse(subject)),
+		Text:    template.Must(template.New(name).Funcs(emailFuncs).Parse(text)),
+		HTML:    htmltemplate.Must(htmltemplate.New(name).Funcs(htmltemplate.FuncMap(emailFuncs)).Parse(html)),
+	}
+}
+
+const orderLinesText = `{{range .Items}}
+  {{.Quantity}} x {{.Name}} ({{.VariantLabel}})  {{money .Price}}{{end}}
+`
+
+const orderLinesHTML = `<table>
+{{range .Items}}<tr><td>{{.Quantity}} x {{.Name}} ({{.VariantLabel}})</td><td>{{money .Price}}</td></tr>
+{{end}}</table>
+`
+
+var emailTemplates = map[string]emailTemplate{
+	EmailOrderConfirmation: newEmailTemplate(EmailOrderConfirmation,
+		`Order {{.Order.OrderID}} confirmed`,
+		`Hi {{.Username}},
+
+Thanks for your order! We've received your payment of {{money .Order.TotalPrice}}.
+`+orderLinesText+`
+{{if .Address}}We'll deliver to {{.Address}}.{{else}}Pick it up from {{.Order.ReadyDate.Local.Format "Mon Jan 2, 3:04 PM"}}.{{end}}
+
+Order details: {{.OrderURL}}
+`,
+		`<p>Hi {{.Username}},</p>
+<p>Thanks for your order! We've received your payment of {{money .Order.TotalPrice}}.</p>
+`+orderLinesHTML+`
+<p>{{if .Address}}We'll deliver to {{.Address}}.{{else}}Pick it up from {{.Order.ReadyDate.Local.Format "Mon Jan 2, 3:04 PM"}}.{{end}}</p>
+<p><a href="{{.OrderURL}}">Order details</a></p>
+`),
+
+	EmailPaymentFailed: newEmailTemplate(EmailPaymentFailed,
+		`Payment for order {{.Order.OrderID}} didn't go through`,
+		`Hi {{.Username}},
+
+We couldn't take payment for order {{.Order.OrderID}}, so it has been cancelled and nothing was charged.
+Your cart is still there if you'd like to try again: {{.OrderURL}}
+`,
+		`<p>Hi {{.Username}},</p>
+<p>We couldn't take payment for order {{.Order.OrderID}}, so it has been cancelled and nothing was charged.</p>
+<p>Your cart is still there if you'd like to <a href="{{.OrderURL}}">try again</a>.</p>
+`),
+
+	EmailReadyForPickup: newEmailTemplate(EmailReadyForPickup,
+		`Order {{.Order.OrderID}} is ready for pickup`,
+		`Hi {{.Username}},
+
+Your order {{.Order.OrderID}} is packed and waiting for you at the store.
+`+orderLinesText+`
+Order details: {{.OrderURL}}
+`,
+		`<p>Hi {{.Username}},</p>
+<p>Your order {{.Order.OrderID}} is packed and waiting for you at the store.</p>
+`+orderLinesHTML+`
+<p><a href="{{.OrderURL}}">Order details</a></p>
+`),
+
+	EmailOutForDelivery: newEmailTemplate(EmailOutForDelivery,
+		`Order {{.Order.OrderID}} is out for delivery`,
+		`Hi {{.Username}},
+
+Your order {{.Order.OrderID}} is on its way{{if .Address}} to {{.Address}}{{end}}.
+
+Order details: {{.OrderURL}}
+`,
+		`<p>Hi {{.Username}},</p>
+<p>Your order {{.Order.OrderID}} is on its way{{if .Address}} to {{.Address}}{{end}}.</p>
+<p><a href="{{.OrderURL}}">Order details</a></p>
+`),
+
+	EmailRefunded: newEmailTemplate(EmailRefunded,
+		`Refund for order {{.Order.OrderID}}`,
+		`Hi {{.Username}},
+
+We've refunded {{money .Order.Refunded}} for order {{.Order.OrderID}}. It can take 5 to 10 business days to show up on your statement.
+
+Order details: {{.OrderURL}}
+`,
+		`<p>Hi {{.Username}},</p>
+<p>We've refunded {{money .Order.Refunded}} for order {{.Order.OrderID}}. It can take 5 to 10 business days to show up on your statement.</p>
+<p><a href="{{.OrderURL}}">Order details</a></p>
+`),
+
+	EmailPasswordReset: newEmailTemplate(EmailPasswordReset,
+		`Reset your password`,
+		`Hi {{.Username}},
+
+Someone asked to reset the password for your account. If it was you, choose a new one here within the hour:
+{{.ResetURL}}
+
+If it wasn't you, you can ignore this email.
+`,
+		`<p>Hi {{.Username}},</p>
+<p>Someone asked to reset the password for your account. If it was you, <a href="{{.ResetURL}}">choose a new one</a> within the hour.</p>
+<p>If it wasn't you, you can ignore this email.</p>
+`),
+}
+
+func initializeEmailTables() error {
+	SQL_0 := `CREATE TABLE IF NOT EXISTS email_log (
+				message_id INTEGER PRIMARY KEY AUTOINCREMENT,
+				kind TEXT,
+				order_id TEXT,
+				recipient TEXT,
+				subject TEXT,
+				text TEXT,
+				html TEXT,
+				status TEXT,
+				attempts INT,
+				last_error TEXT,
+				next_attempt_at TIMESTAMP,
+				created_at TIMESTAMP,
+				sent_at TIMESTAMP
+			)`
+	_, err_0 := db.Exec(SQL_0)
+	if err_0 != nil {
+		return fmt.Errorf("failed to create email_log table: %v", err_0)
+	}
+
+	// only a hash of the token is kept, the link in the email is the only copy
+	SQL_1 := `CREATE TABLE IF NOT EXISTS password_resets (
+				token_hash TEXT PRIMARY KEY,
+				user_id TEXT,
+				expires_at TIMESTAMP,
+				used_at TIMESTAMP
+			)`
+	_, err_1 := db.Exec(SQL_1)
+	if err_1 != nil {
+		return fmt.Errorf("failed to create password_resets table: %v", err_1)
+	}
+
+	return nil
+}
+
+// DELIVERY
+
+// queueEmail renders a template into the delivery log and queues it to be sent.
+func queueEmail(ex execer, kind string, orderID string, to string, data any) error {
+	tmpl, ok := emailTemplates[kind]
+	if !ok {
+		return fmt.Errorf("unknown email template: %s", kind)
+	}
+
+	var subject, text, html bytes.Buffer
+	if err := tmpl.Subject.Execute(&subject, data); err != nil {
+		return err
+	}
+	if err := tmpl.Text.Execute(&text, data); err != nil {
+		return err
+	}
+	if err := tmpl.HTML.Execute(&html, data); err != nil {
+		return err
+	}
+
+	return queueMail(ex, kind, orderID, Mail{To: to, Subject: subject.String(), Text: text.String(), HTML: html.String()})
+}
+
+type emailJob struct {
+	MessageID int
+}
+
+func queueMail(ex execer, kind string, orderID string, mail Mail) error {
+	if err := checkHeaders(mail); err != nil {
+		return err
+	}
+
+	SQL := `INSERT INTO email_log (kind, order_id, recipient, subject, text, html, status, attempts, last_error, next_attempt_at, created_at)
+			VALUES (?, ?, ?, ?, ?, ?, ?, 0, '', ?, ?)`
+	result, err := ex.Exec(SQL, kind, orderID, mail.To, mail.Subject, mail.Text, mail.HTML, EmailPending, time.Now(), time.Now())
+	if err != nil {
+		return err
+	}
+	messageID, err := result.LastInsertId()
+	if err != nil {
+		return err
+	}
+
+	return enqueueJob(ex, JobSendEmail, emailJob{MessageID: int(messageID)}, time.Now())
+}
+
+// deliverEmail sends one logged message. Retries are the job queue's, the log only
+// mirrors them: the message is failed once its job has no attempts left.
+func deliverEmail(job Job) error {
+	var payload emailJob
+	if err := json.Unmarshal([]byte(job.Payload), &payload); err != nil {
+		return err
+	}
+
+	var mail Mail
+	var status string
+	SQL_0 := `SELECT recipient, subject, text, html, status FROM email_log WHERE message_id = ?`
+	err := db.QueryRow(SQL_0, payload.MessageID).Scan(&mail.To, &mail.Subject, &mail.Text, &mail.HTML, &status)
+	if err != nil {
+		return err
+	}
+	if status == EmailSent {
+		return nil
+	}
+
+	if err := mailer.Send(mail); err != nil {
+		status := EmailPending
+		if job.Attempts >= job.MaxAttempts {
+			status = EmailFailed
+		}
+		next := time.Now().Add(jobBackoff(job.Attempts))
+
+		SQL_1 := `UPDATE email_log SET (status, attempts, last_error, next_attempt_at) = (?, attempts + 1, ?, ?) WHERE message_id = ?`
+		if _, err := db.Exec(SQL_1, status, err.Error(), next, payload.MessageID); err != nil {
+			log.Printf("email %d: %v", payload.MessageID, err)
+		}
+		return err
+	}
+
+	SQL_2 := `UPDATE email_log SET (status, attempts, last_error, sent_at) = (?, attempts + 1, '', ?) WHERE message_id = ?`
+	_, err = db.Exec(SQL_2, EmailSent, time.Now(), payload.MessageID)
+
+	return err
+}
+
+// ORDER EMAILS
+
+// notifyStatusChange emails the customer about the status changes they care about.
+// It runs as a job queued with the change, so a failure never undoes the change.
+func notifyStatusChange(job Job) error {
+	var change OrderStatusChange
+	if err := json.Unmarshal([]byte(job.Payload), &change); err != nil {
+		return err
+	}
+	orderID, from, to, actorID := change.OrderID, change.FromStatus, change.ToStatus, change.ActorID
+
+	kind := ""
+	switch {
+	case to == StatusPaid:
+		kind = EmailOrderConfirmation
+	case to == StatusCancelled && from == StatusPendingPayment && actorID == systemActor:
+		kind = EmailPaymentFailed
+	case to == StatusReadyForPickup:
+		kind = EmailReadyForPickup
+	case to == StatusOutForDelivery:
+		kind = EmailOutForDelivery
+	case to == StatusRefunded:
+		kind = EmailRefunded
+	default:
+		return nil
+	}
+
+	return sendOrderEmail(kind, orderID)
+}
+
+func sendOrderEmail(kind string, orderID string) error {
+	detail, err := getOrderDetail(orderID)
+	if err != nil {
+		return err
+	}
+
+	username, email, err := getUserContact(detail.Order.UserID)
+	if err != nil {
+		return err
+	}
+	if email == "" {
+		return nil
+	}
+
+	data := orderEmailData{
+		Username: username,
+		Order:    detail.Order,
+		Items:    detail.Items,
+		Address:  detail.ShippingAddress,
+		OrderURL: shopURL() + "/orders/" + orderID,
+	}
+
+	return queueEmail(db, kind, orderID, email, data)
+}
+
+// PASSWORD RESET
+
+// forgotPassword emails a reset link if the address belongs to an account. It answers
+// the same either way so it can't be used to find out who has an account.
+func forgotPassword(c *gin.Context) {
+	var body PasswordForgot
+	if err := c.ShouldBindBodyWithJSON(&body); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	message := gin.H{"message": "if that email has an account, a reset link is on its way"}
+
+	var userID, username, email string
+	SQL_0 := `SELECT id, COALESCE(username, ''), email FROM users WHERE LOWER(email) = LOWER(?) AND is_registered = true LIMIT 1`
+	err := db.QueryRow(SQL_0, strings.TrimSpace(body.Email)).Scan(&userID, &username, &email)
+	if err == sql.ErrNoRows {
+		c.JSON(http.StatusOK, message)
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	token, err := randomToken()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	SQL_1 := `INSERT INTO password_resets (token_hash, user_id, expires_at) VALUES (?, ?, ?)`
+	if _, err := db.Exec(SQL_1, hashToken(token), userID, time.Now().Add(time.Hour)); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	data := passwordResetData{Username: username, ResetURL: shopURL() + "/reset-password?token=" + token}
+	if err := queueEmail(db, EmailPasswordReset, "", email, data); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, message)
+}
+
+func resetPassword(c *gin.Context) {
+	var body PasswordReset
+	if err := c.ShouldBindBodyWithJSON(&body); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if len(body.Password) < 8 {
+		validationFailed(c, []ValidationError{{Field: "Password", Message: "must be at least 8 characters"}})
+		return
+	}
+
+	hashed, err := hashPassword(body.Password)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	defer tx.Rollback()
+
+	// using the token and checking it are one statement, so a link works once
+	SQL_0 := `UPDATE password_resets SET used_at = ? WHERE token_hash = ? AND used_at IS NULL AND expires_at > ? RETURNING user_id`
+	var userID string
+	err = tx.QueryRow(SQL_0, time.Now(), hashToken(body.Token), time.Now()).Scan(&userID)
+	if err == sql.ErrNoRows {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "this reset link is invalid or has expired"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	if _, err := tx.Exec(`UPDATE users SET password = ? WHERE id = ?`, hashed, userID); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	// whoever knew the old password may still be logged in somewhere
+	if err := revokeSessions(tx, `user_id = ?`, userID); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "password updated"})
+}
+
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// ADMIN
+
+func adminGetEmails(c *gin.Context) {
+	where, args := "1 = 1", []any{}
+	if status := c.Query("status"); status != "" {
+		where, args = where+" AND status = ?", append(args, status)
+	}
+	if orderID := c.Query("order_id"); orderID != "" {
+		where, args = where+" AND order_id = ?", append(args, orderID)
+	}
+
+	SQL := `SELECT * FROM email_log WHERE ` + where + ` ORDER BY message_id DESC LIMIT 200`
+	rows, err := db.Query(SQL, args...)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	defer rows.Close()
+
+	messages := []EmailMessage{}
+	for rows.Next() {
+		var m EmailMessage
+		err := rows.Scan(&m.MessageID, &m.Kind, &m.OrderID, &m.Recipient, &m.Subject, &m.Text, &m.HTML, &m.Status,
+			&m.Attempts, &m.LastError, &m.NextAttemptAt, &m.CreatedAt, &m.SentAt)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		messages = append(messages, m)
+	}
+
+	c.IndentedJSON(http.StatusOK, messages)
+}
+
+// adminRetryEmail queues a failed message again with a fresh job, and so a fresh set of attempts.
+func adminRetryEmail(c *gin.Context) {
+	messageID := c.Param("message_id")
+
+	id, err := parseToInt(messageID)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	defer tx.Rollback()
+
+	SQL := `UPDATE email_log SET (status, next_attempt_at) = (?, ?) WHERE message_id = ? AND status = ?`
+	result, err := tx.Exec(SQL, EmailPending, time.Now(), id, EmailFailed)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "no failed email " + messageID})
+		return
+	}
+
+	if err := enqueueJob(tx, JobSendEmail, emailJob{MessageID: int(id)}, time.Now()); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "retrying email " + messageID})
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"time"
+
+	_ "modernc.org/sqlite"
+)
+
+type OrderDiscount struct {
+	DiscountID  int
+	OrderID     string
+	Source      string
+	Code        string
+	Description string
+	Amount      int
+	CreatedAt   time.Time
+}
+
+func initializeOrderDiscountsTable() error {
+	SQL := `
+		CREATE TABLE IF NOT EXISTS order_discounts (
+			discount_id INTEGER PRIMARY KEY AUTOINCREMENT,
+			order_id TEXT,
+			source TEXT,
+			code TEXT,
+			description TEXT,
+			amount INT,
+			created_at TIMESTAMP
+		)`
+	_, err := db.Exec(SQL)
+	if err != nil {
+		return err
+	} else {
+		return nil
+	}
+}
+
+func pushOrderDiscounts(ex execer, discounts []Discount, orderID string) error {
+	SQL := `INSERT INTO order_discounts (order_id, source, code, description, amount, created_at) VALUES (?, ?, ?, ?, ?, ?)`
+	for _, v := range discounts {
+		_, err := ex.Exec(SQL, orderID, v.Source, v.Code, v.Description, v.Amount, time.Now())
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func getOrderDiscounts(orderID string) ([]OrderDiscount, error) {
+	SQL := `SELECT * FROM order_discounts WHERE order_id = ? ORDER BY discount_id`
+	rows, err := db.Query(SQL, orderID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	discounts := []OrderDiscount{}
+	for rows.Next() {
+		var discount OrderDiscount
+		err := rows.Scan(&discount.DiscountID, &discount.OrderID, &discount.Source, &discount.Code, &discount.Description, &discount.Amount, &discount.CreatedAt)
+		if err != nil {
+			return discounts, err
+		}
+		discounts = append(discounts, discount)
+	}
+
+	return discounts, nil
+}
@@ -4,14 +4,22 @@ import (
 	_ "modernc.org/sqlite"
 )
 
+// OrderItem is a line as it was bought. Name, VariantLabel, Image, TaxClass and
+// Discount are copied from the catalogue at checkout and never read from it again.
 type OrderItem struct {
-	OrderItemID int
-	OrderID     string
-	ProductID   string
-	Size        string
-	Price       int
-	Quantity    int
-	Notes       string
+	OrderItemID      int
+	OrderID          string
+	ProductID        string
+	Size             string
+	Price            int
+	Quantity         int
+	Notes            string
+	Name             string
+	VariantLabel     string
+	Image            string
+	TaxClass         string
+	Discount         int
+	RefundedQuantity int
 }
 
 func initializeOrderItemsTable() error {
@@ -23,12 +31,68 @@ func initializeOrderItemsTable() error {
 			size TEXT,
 			price TEXT,
 			quantity INT,
-			notes TEXT
+			notes TEXT,
+			name TEXT,
+			variant_label TEXT,
+			image TEXT,
+			tax_class TEXT,
+			discount INT
 		)`
 	_, err := db.Exec(SQL)
+	if err != nil {
+		return err
+	}
+
+	columns := [][2]string{
+		{"name", "TEXT"},
+		{"variant_label", "TEXT"},
+		{"image", "TEXT"},
+		{"tax_class", "TEXT"},
+		{"discount", "INT DEFAULT 0"},
+	}
+	for _, column := range columns {
+		if err := addColumn("order_items", column[0], column[1]); err != nil {
+			return err
+		}
+	}
+
+	// lines bought before snapshots existed take what the catalogue says now, once
+	SQL_1 := `UPDATE order_items SET
+				name = COALESCE((SELECT name FROM products WHERE products.product_id = order_items.product_id), product_id),
+				variant_label = size,
+				image = COALESCE((SELECT image FROM products WHERE products.product_id = order_items.product_id), ''),
+				tax_class = ?
+			WHERE name IS NULL`
+	_, err = db.Exec(SQL_1, defaultTaxClass)
 	if err != nil {
 		return err
 	} else {
 		return nil
 	}
 }
+
+func getOrderItems(orderID string) ([]OrderItem, error) {
+	SQL := `SELECT item_id, order_id, product_id, size, price, quantity, COALESCE(notes, ''),
+				name, variant_label, image, tax_class, COALESCE(discount, 0), COALESCE(refunded_quantity, 0)
+			FROM order_items
+			WHERE order_id = ?
+			ORDER BY item_id`
+	rows, err := db.Query(SQL, orderID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	items := []OrderItem{}
+	for rows.Next() {
+		var item OrderItem
+		err := rows.Scan(&item.OrderItemID, &item.OrderID, &item.ProductID, &item.Size, &item.Price, &item.Quantity, &item.Notes,
+			&item.Name, &item.VariantLabel, &item.Image, &item.TaxClass, &item.Discount, &item.RefundedQuantity)
+		if err != nil {
+			return items, err
+		}
+		items = append(items, item)
+	}
+
+	return items, nil
+}
@@ -0,0 +1,224 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+
+	_ "modernc.org/sqlite"
+)
+
+const (
+	StatusPendingPayment = "pending_payment"
+	StatusPaid           = "paid"
+	StatusPreparing      = "preparing"
+	StatusReadyForPickup = "ready_for_pickup"
+	StatusOutForDelivery = "out_for_delivery"
+	StatusCompleted      = "completed"
+	StatusCancelled      = "cancelled"
+	StatusRefunded       = "refunded"
+)
+
+// actor recorded for transitions made by the shop itself, like payment callbacks
+const systemActor = "system"
+
+// orderTransitions is the order lifecycle, every status change goes through it.
+var orderTransitions = map[string][]string{
+	StatusPendingPayment: {StatusPaid, StatusCancelled},
+	StatusPaid:           {StatusPreparing, StatusCancelled, StatusRefunded},
+	StatusPreparing:      {StatusReadyForPickup, StatusOutForDelivery, StatusCancelled, StatusRefunded},
+	StatusReadyForPickup: {StatusCompleted, StatusCancelled, StatusRefunded},
+	StatusOutForDelivery: {StatusCompleted, StatusRefunded},
+	StatusCompleted:      {StatusRefunded},
+	StatusCancelled:      {StatusRefunded},
+	StatusRefunded:       {},
+}
+
+// customerTransitions are the only ones a shopper may make on their own order,
+// everything else needs an admin or the system.
+var customerTransitions = map[string][]string{
+	StatusPendingPayment: {StatusCancelled},
+}
+
+type OrderStatusChange struct {
+	HistoryID  int
+	OrderID    string
+	FromStatus string
+	ToStatus   string
+	ActorID    string
+	Note       string
+	CreatedAt  time.Time
+}
+
+type TransitionError struct {
+	From string
+	To   string
+}
+
+func (e *TransitionError) Error() string {
+	return fmt.Sprintf("order can't go from %s to %s", e.From, e.To)
+}
+
+func initializeOrderStatusHistoryTable() error {
+	SQL := `
+		CREATE TABLE IF NOT EXISTS order_status_history (
+			history_id INTEGER PRIMARY KEY AUTOINCREMENT,
+			order_id TEXT,
+			from_status TEXT,
+			to_status TEXT,
+			actor_id TEXT,
+			note TEXT,
+			created_at TIMESTAMP
+		)`
+	_, err := db.Exec(SQL)
+	if err != nil {
+		return err
+	}
+
+	// statuses written before the lifecycle existed
+	SQL_1 := `UPDATE orders SET status = ? WHERE status = 'payment failed'`
+	if _, err := db.Exec(SQL_1, StatusCancelled); err != nil {
+		return err
+	}
+
+	SQL_2 := `UPDATE orders SET status = ? WHERE COALESCE(status, '') = ''`
+	_, err = db.Exec(SQL_2, StatusPendingPayment)
+	if err != nil {
+		return err
+	} else {
+		return nil
+	}
+}
+
+func isOrderStatus(status string) bool {
+	_, ok := orderTransitions[status]
+	return ok
+}
+
+// canTransition checks the move against the lifecycle. Customers are limited to
+// customerTransitions, admins and the system can make any allowed move.
+func canTransition(from string, to string, isAdmin bool) error {
+	allowed := orderTransitions
+	if !isAdmin {
+		allowed = customerTransitions
+	}
+
+	for _, status := range allowed[from] {
+		if status == to {
+			return nil
+		}
+	}
+
+	return &TransitionError{From: from, To: to}
+}
+
+// transitionOrder moves an order to a new status and records who did it. The update
+// only applies if the order is still in the status that was checked, so two
+// concurrent changes can't both win.
+func transitionOrder(orderID string, to string, actorID string, isAdmin bool, note string) error {
+	if !isOrderStatus(to) {
+		return fmt.Errorf("unknown order status: %s", to)
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var from string
+	err = tx.QueryRow(`SELECT status FROM orders WHERE order_id = ?`, orderID).Scan(&from)
+	if err == sql.ErrNoRows {
+		return fmt.Errorf("order %s doesn't exist", orderID)
+	}
+	if err != nil {
+		return err
+	}
+
+	if err := canTransition(from, to, isAdmin); err != nil {
+		return err
+	}
+
+	result, err := tx.Exec(`UPDATE orders SET (status, updated_at) = (?, ?) WHERE order_id = ? AND status = ?`, to, time.Now(), orderID, from)
+	if err != nil {
+		return err
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		return fmt.Errorf("order %s changed while updating, try again", orderID)
+	}
+
+	change, err := recordStatusChange(tx, orderID, from, to, actorID, note)
+	if err != nil {
+		return err
+	}
+
+	// whatever is cancelled goes back on the shelf, and its coupons can be used again
+	if to == StatusCancelled {
+		if err := restockOrder(tx, orderID); err != nil {
+			return err
+		}
+		if err := releaseOrderCoupons(tx, orderID); err != nil {
+			return err
+		}
+	}
+
+	// the card is refunded by then, the store credit the order spent comes back here
+	if to == StatusCancelled || to == StatusRefunded {
+		if err := releaseStoreCredit(tx, orderID); err != nil {
+			return err
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+
+	orderBroker.Publish(change)
+
+	return nil
+}
+
+// recordStatusChange writes the history row and queues the change for anything that
+// reacts to it, both in the caller's transaction. Once that commits, the caller hands
+// the returned change to orderBroker for the live streams.
+func recordStatusChange(tx *sql.Tx, orderID string, from string, to string, actorID string, note string) (OrderStatusChange, error) {
+	change := OrderStatusChange{OrderID: orderID, FromStatus: from, ToStatus: to, ActorID: actorID, Note: note, CreatedAt: time.Now()}
+
+	SQL := `INSERT INTO order_status_history (order_id, from_status, to_status, actor_id, note, created_at) VALUES (?, ?, ?, ?, ?, ?)`
+	result, err := tx.Exec(SQL, orderID, from, to, actorID, note, change.CreatedAt)
+	if err != nil {
+		return change, err
+	}
+	historyID, err := result.LastInsertId()
+	if err != nil {
+		return change, err
+	}
+	change.HistoryID = int(historyID)
+
+	if err := enqueueJob(tx, JobOrderStatusChanged, change, time.Now()); err != nil {
+		return change, err
+	}
+
+	return change, publishOrderEvents(tx, change)
+}
+
+func getOrderStatusHistory(orderID string) ([]OrderStatusChange, error) {
+	SQL := `SELECT * FROM order_status_history WHERE order_id = ? ORDER BY history_id`
+	rows, err := db.Query(SQL, orderID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	history := []OrderStatusChange{}
+	for rows.Next() {
+		var change OrderStatusChange
+		err := rows.Scan(&change.HistoryID, &change.OrderID, &change.FromStatus, &change.ToStatus, &change.ActorID, &change.Note, &change.CreatedAt)
+		if err != nil {
+			return history, err
+		}
+		history = append(history, change)
+	}
+
+	return history, nil
+}
@@ -0,0 +1,292 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gin-contrib/sse"
+	"github.com/gin-gonic/gin"
+	_ "modernc.org/sqlite"
+)
+
+// OrderBroker fans saved order status changes out to the open streams in this
+// process. It only carries live changes, a stream that falls behind is dropped and
+// catches up from order_status_history when the client reconnects.
+type OrderBroker struct {
+	mu          sync.Mutex
+	subscribers map[chan OrderStatusChange]string
+}
+
+var orderBroker = &OrderBroker{subscribers: map[chan OrderStatusChange]string{}}
+
+// Subscribe returns a channel of changes to orderID, or to every order when orderID
+// is empty. Call Unsubscribe when done with it.
+func (b *OrderBroker) Subscribe(orderID string) chan OrderStatusChange {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	ch := make(chan OrderStatusChange, 16)
+	b.subscribers[ch] = orderID
+
+	return ch
+}
+
+func (b *OrderBroker) Unsubscribe(ch chan OrderStatusChange) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if _, ok := b.subscribers[ch]; ok {
+		delete(b.subscribers, ch)
+		close(ch)
+	}
+}
+
+// Publish hands a change to every interested subscriber without waiting on any of them.
+// Call it once the change is committed.
+func (b *OrderBroker) Publish(change OrderStatusChange) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	for ch, orderID := range b.subscribers {
+		if orderID != "" && orderID != change.OrderID {
+			continue
+		}
+
+		select {
+		case ch <- change:
+		default:
+			delete(b.subscribers, ch)
+			close(ch)
+		}
+	}
+}
+
+// streamMyOrder streams status changes of one of the customer's orders. EventSource
+// can't set headers, so it logs in with a ?ticket= from createStreamTicket.
+func streamMyOrder(c *gin.Context) {
+	userID, err := streamUserID(c)
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": err.Error()})
+		return
+	}
+
+	orderID := c.Param("order_id")
+	ownerID, err := getOrderOwner(orderID)
+	if err == sql.ErrNoRows || (err == nil && ownerID != userID) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "order not found: " + orderID})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	streamOrderChanges(c, orderID)
+}
+
+// streamAllOrders is the staff stream: every new order and every status change.
+func streamAllOrders(c *gin.Context) {
+	userID, err := streamUserID(c)
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": err.Error()})
+		return
+	}
+
+	allowed, err := userCan(userID, PermOrdersManage)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if !allowed {
+		c.JSON(http.StatusForbidden, gin.H{"error": "requires the " + PermOrdersManage + " permission"})
+		return
+	}
+
+	streamOrderChanges(c, "")
+}
+
+// streamOrderChanges writes changes as server-sent events until the client leaves.
+// Event ids are history ids, so a client reconnecting with Last-Event-ID first gets
+// whatever it missed. New orders are "order.created" events, the rest "order.status_changed".
+func streamOrderChanges(c *gin.Context, orderID string) {
+	lastID, _ := strconv.Atoi(c.GetHeader("Last-Event-ID"))
+
+	// subscribing before reading the backlog means nothing falls in between, anything
+	// seen twice is skipped by id
+	ch := orderBroker.Subscribe(orderID)
+	defer orderBroker.Unsubscribe(ch)
+
+	backlog, err := getStatusChangesSince(orderID, lastID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.Header("Cache-Control", "no-cache")
+	c.Header("X-Accel-Buffering", "no")
+	c.Writer.Header().Set("Content-Type", "text/event-stream")
+	c.Status(http.StatusOK)
+
+	send := func(change OrderStatusChange) {
+		if change.HistoryID <= lastID {
+			return
+		}
+		lastID = change.HistoryID
+
+		event := EventOrderStatusChanged
+		if change.FromStatus == "" {
+			event = EventOrderCreated
+		}
+		c.Render(-1, sse.Event{Id: strconv.Itoa(change.HistoryID), Event: event, Data: change})
+	}
+
+	// tell EventSource how long to wait before reconnecting
+	fmt.Fprintf(c.Writer, "retry: %d\n\n", envInt("STREAM_RETRY_MS", 3000))
+	for _, change := range backlog {
+		send(change)
+	}
+	c.Writer.Flush()
+
+	keepAlive := time.NewTicker(time.Duration(envInt("STREAM_KEEPALIVE_SECONDS", 25)) * time.Second)
+	defer keepAlive.Stop()
+
+	c.Stream(func(w io.Writer) bool {
+		select {
+		case <-c.Request.Context().Done():
+			return false
+		case change, ok := <-ch:
+			if !ok {
+				// fell too far behind, the client reconnects and catches up
+				return false
+			}
+			send(change)
+			return true
+		case <-keepAlive.C:
+			// a comment line keeps proxies from closing an idle connection
+			fmt.Fprint(w, ": keep-alive\n\n")
+			return true
+		}
+	})
+}
+
+// streamUserID reads the logged in user from the token header, or redeems ?ticket= for
+// EventSource. Access tokens never go in the url, where access logs would keep them.
+func streamUserID(c *gin.Context) (string, error) {
+	if ticket := c.Query("ticket"); ticket != "" {
+		return redeemStreamTicket(ticket)
+	}
+
+	return currentUserID(c)
+}
+
+func initializeStreamTicketsTable() error {
+	SQL := `CREATE TABLE IF NOT EXISTS stream_tickets (
+				ticket_hash TEXT PRIMARY KEY,
+				user_id TEXT,
+				session_id TEXT,
+				expires_at INT,
+				used_at INT
+			)`
+	_, err := db.Exec(SQL)
+	if err != nil {
+		return fmt.Errorf("failed to create stream_tickets table: %v", err)
+	}
+
+	return nil
+}
+
+// createStreamTicket gives the logged in user a ticket to open one stream with. It
+// works once, within STREAM_TICKET_SECONDS (60), so a ticket left in a log is no use.
+func createStreamTicket(c *gin.Context) {
+	p, err := currentPrincipal(c)
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": err.Error()})
+		return
+	}
+
+	ticket, err := randomToken()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	lifetime := envInt("STREAM_TICKET_SECONDS", 60)
+	now := time.Now().Unix()
+
+	// spent and expired tickets are cleared as new ones are made
+	SQL_0 := `DELETE FROM stream_tickets WHERE expires_at <= ?`
+	if _, err := db.Exec(SQL_0, now); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	SQL_1 := `INSERT INTO stream_tickets (ticket_hash, user_id, session_id, expires_at) VALUES (?, ?, ?, ?)`
+	if _, err := db.Exec(SQL_1, hashToken(ticket), p.UserID, p.SessionID, now+int64(lifetime)); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"ticket": ticket, "expires_in": lifetime})
+}
+
+// redeemStreamTicket uses up a ticket and returns whose it was, as long as the login
+// it was made from hasn't ended since.
+func redeemStreamTicket(ticket string) (string, error) {
+	now := time.Now().Unix()
+
+	var userID, sessionID string
+	SQL := `UPDATE stream_tickets SET used_at = ? WHERE ticket_hash = ? AND used_at IS NULL AND expires_at > ? RETURNING user_id, session_id`
+	err := db.QueryRow(SQL, now, hashToken(ticket), now).Scan(&userID, &sessionID)
+	if err == sql.ErrNoRows {
+		return "", fmt.Errorf("stream ticket is invalid, used or expired")
+	}
+	if err != nil {
+		return "", err
+	}
+
+	active, err := sessionActive(sessionID)
+	if err != nil {
+		return "", err
+	}
+	if !active {
+		return "", fmt.Errorf("session has ended, log in again")
+	}
+
+	return userID, nil
+}
+
+// getStatusChangesSince returns the changes after historyID, for one order or all of
+// them. The staff backlog is capped at the last STREAM_BACKLOG (200) changes.
+func getStatusChangesSince(orderID string, historyID int) ([]OrderStatusChange, error) {
+	if historyID <= 0 && orderID == "" {
+		// a fresh staff stream starts from now, there's no history to catch up on
+		return []OrderStatusChange{}, nil
+	}
+
+	SQL := `SELECT * FROM (
+				SELECT * FROM order_status_history WHERE history_id > ? AND (? = '' OR order_id = ?)
+				ORDER BY history_id DESC LIMIT ?
+			) ORDER BY history_id`
+	rows, err := db.Query(SQL, historyID, orderID, orderID, envInt("STREAM_BACKLOG", 200))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	changes := []OrderStatusChange{}
+	for rows.Next() {
+		var change OrderStatusChange
+		err := rows.Scan(&change.HistoryID, &change.OrderID, &change.FromStatus, &change.ToStatus, &change.ActorID, &change.Note, &change.CreatedAt)
+		if err != nil {
+			return nil, err
+		}
+		changes = append(changes, change)
+	}
+
+	return changes, nil
+}
@@ -1,8 +1,10 @@
 package main
 
 import (
+	"database/sql"
 	"fmt"
 	"net/http"
+	"strconv"
 	"time"
 
 	"github.com/gin-gonic/gin"
@@ -18,12 +20,15 @@ type Order struct {
 	Notes           string
 	Subtotal        int
 	DeliveryFee     int
+	Discount        int
+	UserID          string
+	Refunded        int
 	Tax             int
 	TotalPrice      int
 	Status          string
 	CreatedAt       time.Time
 	UpdatedAt       time.Time
-	//13 fields
+	//16 fields
 }
 
 func initializeOrdersTable() error {
@@ -36,19 +41,106 @@ func initializeOrdersTable() error {
 				notes TEXT,
 				subtotal INT,
 				delivery_fee INT,
-				tax INT GENERATED ALWAYS AS (CAST((subtotal + delivery_fee) * 0.13 AS INT)) STORED,
-				total_price INT GENERATED ALWAYS AS (subtotal + tax) STORED,
+				tax INT,
+				total_price INT,
 				status TEXT,
 				created_at TIMESTAMP,
-				updated_at TIMESTAMP)
+				updated_at TIMESTAMP,
+				discount INT,
+				user_id TEXT)
 		`
 
 	_, err := db.Exec(SQL)
 	if err != nil {
 		return err
-	} else {
+	}
+
+	if err := addColumn("orders", "discount", "INT"); err != nil {
+		return err
+	}
+
+	if err := addColumn("orders", "user_id", "TEXT"); err != nil {
+		return err
+	}
+
+	if err := storeOrderTotals(); err != nil {
+		return err
+	}
+
+	SQL_1 := `CREATE UNIQUE INDEX IF NOT EXISTS orders_order_id ON orders (order_id)`
+	if _, err := db.Exec(SQL_1); err != nil {
+		return fmt.Errorf("failed to index orders: %v", err)
+	}
+
+	// the counter was added after orders existed, start it past the highest id in use
+	SQL_2 := `UPDATE counter SET orders = MAX(COALESCE(orders, 0), (SELECT COALESCE(MAX(CAST(substr(order_id, 2) AS INT)), 0) FROM orders))
+			WHERE id = 1`
+	_, err = db.Exec(SQL_2)
+	return err
+}
+
+// storeOrderTotals turns tax and total_price from generated columns into plain ones.
+// The generated total left the delivery fee out, checkout now writes both from the
+// cart pricing so they're exactly what was charged.
+func storeOrderTotals() error {
+	var generated int
+	SQL := `SELECT COUNT(*) FROM pragma_table_xinfo('orders') WHERE name = 'total_price' AND hidden != 0`
+	if err := db.QueryRow(SQL).Scan(&generated); err != nil {
+		return err
+	}
+	if generated == 0 {
 		return nil
 	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	steps := []string{
+		`ALTER TABLE orders ADD COLUMN tax_charged INT`,
+		`UPDATE orders SET tax_charged = tax`,
+		`ALTER TABLE orders DROP COLUMN total_price`,
+		`ALTER TABLE orders DROP COLUMN tax`,
+		`ALTER TABLE orders RENAME COLUMN tax_charged TO tax`,
+		`ALTER TABLE orders ADD COLUMN total_price INT`,
+		`UPDATE orders SET total_price = COALESCE(subtotal, 0) + COALESCE(delivery_fee, 0) + COALESCE(tax, 0)`,
+	}
+	for _, step := range steps {
+		if _, err := tx.Exec(step); err != nil {
+			return fmt.Errorf("failed to store order totals: %v", err)
+		}
+	}
+
+	return tx.Commit()
+}
+
+// OrderDetail is everything a customer sees about one of their orders.
+type OrderDetail struct {
+	Order           Order
+	ShippingAddress *Address
+	Items           []OrderItem
+	Discounts       []OrderDiscount
+	StatusHistory   []OrderStatusChange
+	PaymentState    string
+}
+
+// orderColumns lists orders columns in Order field order, for bindOrders.
+const orderColumns = `order_id, COALESCE(id_delivery, ''), COALESCE(delivery_address, ''), ready_date, COALESCE(payment_id, ''),
+	COALESCE(notes, ''), COALESCE(subtotal, 0), COALESCE(delivery_fee, 0), COALESCE(discount, 0), COALESCE(user_id, ''), COALESCE(refunded, 0),
+	COALESCE(tax, 0), COALESCE(total_price, 0), COALESCE(status, ''), created_at, updated_at`
+
+func generateOrderID() (string, error) {
+	count, err := getCount("orders")
+	if err != nil {
+		return "", err
+	}
+
+	orderID := fmt.Sprintf("%06d", count+1)
+	orderID = "O" + orderID
+
+	return orderID, nil
 }
 
 func getNumberOfOrders(c *gin.Context) {
@@ -63,14 +155,225 @@ func getNumberOfOrders(c *gin.Context) {
 func editOrderStatus(c *gin.Context) {
 	orderID := c.Param("order_id")
 	status := c.Param("status")
-	SQL := `UPDATE orders SET status = ? WHERE order_id = ?`
-	_, err := db.Exec(SQL, status, orderID)
+
+	p, err := currentPrincipal(c)
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": err.Error()})
+		return
+	}
+	userID := p.UserID
+
+	order, err := getOrder(orderID)
+	if err == sql.ErrNoRows {
+		c.JSON(http.StatusNotFound, gin.H{"error": "order not found: " + orderID})
+		return
+	}
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
 
+	// staff move any order within their permission, everyone else only their own
+	isAdmin := p.Can(statusPermission(status))
+	if !isAdmin && order.UserID != userID {
+		c.JSON(http.StatusForbidden, gin.H{"error": "not your order"})
+		return
+	}
+
+	var refunds []Refund
+	if isAdmin {
+		if needsRefund(order, status) && !p.Can(PermRefundsIssue) {
+			c.JSON(http.StatusForbidden, gin.H{"error": "the order is paid, cancelling it requires the " + PermRefundsIssue + " permission"})
+			return
+		}
+		refunds, err = transitionWithRefund(order, status, userID, c.Query("note"))
+	} else {
+		err = transitionOrder(orderID, status, userID, false, c.Query("note"))
+	}
+	if te, ok := err.(*TransitionError); ok {
+		c.JSON(http.StatusConflict, gin.H{"error": te.Error()})
+		return
+	}
+	if ve, ok := err.(*ValidationError); ok {
+		validationFailed(c, []ValidationError{*ve})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
 	message := fmt.Sprintf(`updated order %s's status to %s`, orderID, status)
 
-	c.JSON(http.StatusOK, gin.H{"message": message})
+	c.JSON(http.StatusOK, gin.H{"message": message, "refunds": refunds})
+}
+
+func getOrderOwner(orderID string) (string, error) {
+	SQL := `SELECT COALESCE(user_id, '') FROM orders WHERE order_id = ?`
+
+	var userID string
+	if err := db.QueryRow(SQL, orderID).Scan(&userID); err != nil {
+		return "", err
+	}
+
+	return userID, nil
+}
+
+func getMyOrders(c *gin.Context) {
+	userID, err := currentUserID(c)
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": err.Error()})
+		return
+	}
+
+	page, err := strconv.Atoi(c.DefaultQuery("page", "1"))
+	if err != nil || page < 1 {
+		validationFailed(c, []ValidationError{{Field: "page", Message: "must be 1 or more"}})
+		return
+	}
+	perPage, err := strconv.Atoi(c.DefaultQuery("per_page", "10"))
+	if err != nil || perPage < 1 || perPage > 50 {
+		validationFailed(c, []ValidationError{{Field: "per_page", Message: "must be between 1 and 50"}})
+		return
+	}
+
+	var total int
+	if err := db.QueryRow(`SELECT COUNT(*) FROM orders WHERE user_id = ?`, userID).Scan(&total); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	SQL := `SELECT ` + orderColumns + ` FROM orders WHERE user_id = ? ORDER BY created_at DESC LIMIT ? OFFSET ?`
+	rows, err := db.Query(SQL, userID, perPage, (page-1)*perPage)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	defer rows.Close()
+
+	orders, err := bindOrders(rows)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.IndentedJSON(http.StatusOK, gin.H{"orders": orders, "page": page, "per_page": perPage, "total": total})
+}
+
+func getMyOrder(c *gin.Context) {
+	userID, err := currentUserID(c)
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": err.Error()})
+		return
+	}
+
+	orderID := c.Param("order_id")
+	detail, err := getOrderDetail(orderID)
+	if err == sql.ErrNoRows || (err == nil && detail.Order.UserID != userID) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "order not found: " + orderID})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.IndentedJSON(http.StatusOK, detail)
+}
+
+func getOrder(orderID string) (Order, error) {
+	SQL := `SELECT ` + orderColumns + ` FROM orders WHERE order_id = ?`
+	rows, err := db.Query(SQL, orderID)
+	if err != nil {
+		return Order{}, err
+	}
+	defer rows.Close()
+
+	orders, err := bindOrders(rows)
+	if err != nil {
+		return Order{}, err
+	}
+	if len(orders) == 0 {
+		return Order{}, sql.ErrNoRows
+	}
+
+	return orders[0], nil
+}
+
+func getOrderDetail(orderID string) (OrderDetail, error) {
+	order, err := getOrder(orderID)
+	if err != nil {
+		return OrderDetail{}, err
+	}
+
+	items, err := getOrderItems(orderID)
+	if err != nil {
+		return OrderDetail{}, err
+	}
+
+	discounts, err := getOrderDiscounts(orderID)
+	if err != nil {
+		return OrderDetail{}, err
+	}
+
+	history, err := getOrderStatusHistory(orderID)
+	if err != nil {
+		return OrderDetail{}, err
+	}
+
+	address, err := getOrderAddress(orderID)
+	if err != nil {
+		return OrderDetail{}, err
+	}
+
+	return OrderDetail{
+		Order:           order,
+		ShippingAddress: address,
+		Items:           items,
+		Discounts:       discounts,
+		StatusHistory:   history,
+		PaymentState:    paymentState(order, history),
+	}, nil
+}
+
+// paymentState summarizes where the money is for an order from its status and history.
+func paymentState(order Order, history []OrderStatusChange) string {
+	if order.Refunded > 0 {
+		if order.Refunded >= order.TotalPrice {
+			return "refunded"
+		}
+		return "partially_refunded"
+	}
+
+	switch order.Status {
+	case StatusPendingPayment:
+		return "awaiting_payment"
+	case StatusRefunded:
+		return "refunded"
+	case StatusCancelled:
+		for _, change := range history {
+			if change.ToStatus == StatusPaid {
+				return "paid"
+			}
+		}
+		return "not_paid"
+	default:
+		return "paid"
+	}
+}
+
+func bindOrders(rows *sql.Rows) ([]Order, error) {
+	orders := []Order{}
+	for rows.Next() {
+		var order Order
+		err := rows.Scan(&order.OrderID, &order.IsDelivery, &order.DeliveryAddress, &order.ReadyDate, &order.PaymentID,
+			&order.Notes, &order.Subtotal, &order.DeliveryFee, &order.Discount, &order.UserID, &order.Refunded,
+			&order.Tax, &order.TotalPrice, &order.Status, &order.CreatedAt, &order.UpdatedAt)
+		if err != nil {
+			return orders, err
+		}
+		orders = append(orders, order)
+	}
+
+	return orders, nil
 }
@@ -1,50 +1,78 @@
 package main
 
 import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
 	"net/http"
+	"os"
+	"strings"
 
 	"github.com/gin-gonic/gin"
 	"github.com/stripe/stripe-go/v79"
 	"github.com/stripe/stripe-go/v79/checkout/session"
+	"github.com/stripe/stripe-go/v79/coupon"
+	"github.com/stripe/stripe-go/v79/refund"
+	"github.com/stripe/stripe-go/v79/webhook"
 )
 
-func createCheckoutSession(c *gin.Context) string {
-	orderID := c.Param("order_id")
-	SQL := `SELECT total FROM orders WHERE order_id = ?`
-	row, err := db.Query(SQL, orderID)
-	if err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"message": "error getting price", "error": err.Error()})
-		return ""
+func createCheckoutSession(c *gin.Context, orderID string, pricing CartPricing) string {
+	lineItems := []*stripe.CheckoutSessionLineItemParams{}
+	for _, line := range pricing.Lines {
+		lineItems = append(lineItems, checkoutLineItem(line.Name+" ("+line.Size+")", line.Price, line.Quantity))
 	}
-	defer row.Close()
 
-	var total int
+	if pricing.DeliveryFee > 0 {
+		lineItems = append(lineItems, checkoutLineItem("Delivery", pricing.DeliveryFee, 1))
+	}
 
-	if row.Next() {
-		err := row.Scan(&total)
-		if err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"message": "error scanning row", "error": err.Error()})
-			return ""
-		}
+	if pricing.Tax > 0 {
+		lineItems = append(lineItems, checkoutLineItem("HST", pricing.Tax, 1))
 	}
 
-	domain := "http://localhost:5173"
+	domain := shopURL()
 	params := &stripe.CheckoutSessionParams{
-		LineItems: []*stripe.CheckoutSessionLineItemParams{
-			{
-				PriceData: &stripe.CheckoutSessionLineItemPriceDataParams{
-					Currency: stripe.String("cad"),
-					ProductData: &stripe.CheckoutSessionLineItemPriceDataProductDataParams{
-						Name: stripe.String(orderID),
-					},
-					UnitAmount: stripe.Int64(int64(total)),
-				},
-				Quantity: stripe.Int64(1),
-			},
+		LineItems:         lineItems,
+		ClientReferenceID: stripe.String(orderID),
+		Mode:              stripe.String(string(stripe.CheckoutSessionModePayment)),
+		SuccessURL:        stripe.String(domain + "/success"),
+		CancelURL:         stripe.String(domain + "/cancel"),
+		// payment intent events only know the order through this
+		PaymentIntentData: &stripe.CheckoutSessionPaymentIntentDataParams{
+			Metadata: map[string]string{"order_id": orderID},
 		},
-		Mode:       stripe.String(string(stripe.CheckoutSessionModePayment)),
-		SuccessURL: stripe.String(domain + "/success"),
-		CancelURL:  stripe.String(domain + "/cancel"),
+	}
+
+	// free delivery is already taken off the delivery line, only item discounts go to stripe
+	if pricing.DiscountTotal > 0 {
+		codes := []string{}
+		for _, discount := range pricing.Discounts {
+			switch {
+			case discount.Delivery:
+			case discount.Source == DiscountStoreCredit:
+				// store credit has no code, and stripe won't take a coupon without a name
+				codes = append(codes, "Store credit")
+			default:
+				codes = append(codes, discount.Code)
+			}
+		}
+
+		cp, err := coupon.New(&stripe.CouponParams{
+			AmountOff: stripe.Int64(int64(pricing.DiscountTotal)),
+			Currency:  stripe.String("cad"),
+			Duration:  stripe.String(string(stripe.CouponDurationOnce)),
+			Name:      stripe.String(strings.Join(codes, ", ")),
+		})
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"message": "error creating discount", "error": err.Error()})
+			return ""
+		}
+
+		params.Discounts = []*stripe.CheckoutSessionDiscountParams{
+			{Coupon: stripe.String(cp.ID)},
+		}
 	}
 
 	s, err := session.New(params)
@@ -56,7 +84,190 @@ func createCheckoutSession(c *gin.Context) string {
 
 	c.Redirect(303, s.URL)
 
+	if s.PaymentIntent == nil {
+		return s.ID
+	}
+
 	paymentIntentID := s.PaymentIntent.ID
 
 	return paymentIntentID
 }
+
+func checkoutLineItem(name string, amount int, quantity int) *stripe.CheckoutSessionLineItemParams {
+	return &stripe.CheckoutSessionLineItemParams{
+		PriceData: &stripe.CheckoutSessionLineItemPriceDataParams{
+			Currency: stripe.String("cad"),
+			ProductData: &stripe.CheckoutSessionLineItemPriceDataProductDataParams{
+				Name: stripe.String(name),
+			},
+			UnitAmount: stripe.Int64(int64(amount)),
+		},
+		Quantity: stripe.Int64(int64(quantity)),
+	}
+}
+
+// refundPayment refunds amount cents of an order's payment and returns the provider's
+// refund id. Orders store a checkout session id when stripe hadn't made a payment
+// intent yet, so that's looked up first.
+func refundPayment(paymentID string, amount int, orderID string) (string, error) {
+	paymentIntentID := paymentID
+	if strings.HasPrefix(paymentID, "cs_") {
+		s, err := session.Get(paymentID, nil)
+		if err != nil {
+			return "", err
+		}
+		if s.PaymentIntent == nil {
+			return "", fmt.Errorf("checkout session %s has no payment", paymentID)
+		}
+		paymentIntentID = s.PaymentIntent.ID
+	}
+
+	params := &stripe.RefundParams{
+		PaymentIntent: stripe.String(paymentIntentID),
+		Amount:        stripe.Int64(int64(amount)),
+	}
+	params.AddMetadata("order_id", orderID)
+
+	r, err := refund.New(params)
+	if err != nil {
+		return "", err
+	}
+
+	return r.ID, nil
+}
+
+// stripeWebhook moves pending orders along as stripe reports on their payment: paid
+// once checkout completes, cancelled when the payment fails or the session expires,
+// which gives back the stock, coupons and store credit. Events are signed with
+// STRIPE_WEBHOOK_SECRET. Stripe resends events, an order already past pending payment
+// is left as it is and the event still answered 200.
+func stripeWebhook(c *gin.Context) {
+	secret := os.Getenv("STRIPE_WEBHOOK_SECRET")
+	if secret == "" {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "stripe webhooks aren't configured"})
+		return
+	}
+
+	payload, err := io.ReadAll(io.LimitReader(c.Request.Body, 64<<10))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	event, err := webhook.ConstructEvent(payload, c.GetHeader("Stripe-Signature"), secret)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	var orderID, paymentID, status, note string
+	switch event.Type {
+	case stripe.EventTypeCheckoutSessionCompleted, stripe.EventTypeCheckoutSessionAsyncPaymentSucceeded,
+		stripe.EventTypeCheckoutSessionAsyncPaymentFailed, stripe.EventTypeCheckoutSessionExpired:
+		var s stripe.CheckoutSession
+		if err := json.Unmarshal(event.Data.Raw, &s); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		orderID, paymentID = s.ClientReferenceID, s.ID
+
+		switch {
+		case event.Type == stripe.EventTypeCheckoutSessionExpired:
+			status, note = StatusCancelled, "checkout expired"
+		case event.Type == stripe.EventTypeCheckoutSessionAsyncPaymentFailed:
+			status, note = StatusCancelled, "payment failed"
+		case s.PaymentStatus == stripe.CheckoutSessionPaymentStatusUnpaid:
+			// delayed payment methods complete unpaid, async_payment_succeeded follows
+		default:
+			status, note = StatusPaid, "payment received"
+		}
+
+	case stripe.EventTypePaymentIntentPaymentFailed:
+		var pi stripe.PaymentIntent
+		if err := json.Unmarshal(event.Data.Raw, &pi); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		orderID, paymentID = pi.Metadata["order_id"], pi.ID
+		status, note = StatusCancelled, "payment failed"
+	}
+
+	if status == "" {
+		c.JSON(http.StatusOK, gin.H{"message": "ignored " + string(event.Type)})
+		return
+	}
+
+	if err := settlePayment(event.Type, orderID, paymentID, status, note); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "handled " + string(event.Type)})
+}
+
+// settlePayment moves a pending payment order to status. The order comes from the
+// event, or failing that from the payment id stored at checkout.
+func settlePayment(eventType stripe.EventType, orderID string, paymentID string, status string, note string) error {
+	if orderID == "" {
+		SQL := `SELECT order_id FROM orders WHERE payment_id = ?`
+		err := db.QueryRow(SQL, paymentID).Scan(&orderID)
+		if err == sql.ErrNoRows {
+			log.Printf("stripe: no order for payment %s", paymentID)
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	order, err := getOrder(orderID)
+	if err == sql.ErrNoRows {
+		log.Printf("stripe: no order %s for payment %s", orderID, paymentID)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	if order.Status == StatusCancelled && status == StatusPaid {
+		// the checkout was paid after all, the order stays cancelled and the money goes back
+		request := RefundRequest{Full: true, Reason: "paid after the order was cancelled", SkipRestock: true, LatePayment: true}
+		refunds, err := issueRefund(order, request, systemActor)
+		if ve, ok := err.(*ValidationError); ok {
+			log.Printf("stripe: not refunding late payment for order %s: %v", orderID, ve)
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		log.Printf("stripe: refunded late payment for cancelled order %s in %d refund(s)", orderID, len(refunds))
+		return nil
+	}
+
+	if order.Status != StatusPendingPayment {
+		if order.Status != status {
+			log.Printf("stripe: order %s is %s, not moving it to %s (%s)", orderID, order.Status, status, note)
+		}
+		return nil
+	}
+
+	if eventType == stripe.EventTypePaymentIntentPaymentFailed {
+		// a failed attempt leaves the checkout open, close it so a retry can't pay a cancelled order
+		if err := expireCheckout(order.PaymentID); err != nil {
+			log.Printf("stripe: expiring checkout %s for order %s: %v", order.PaymentID, orderID, err)
+		}
+	}
+
+	return transitionOrder(orderID, status, systemActor, true, note)
+}
+
+// expireCheckout closes an order's open stripe checkout so it can't be paid anymore.
+// Orders without a checkout session have nothing to close.
+func expireCheckout(paymentID string) error {
+	if !strings.HasPrefix(paymentID, "cs_") {
+		return nil
+	}
+
+	_, err := session.Expire(paymentID, nil)
+	return err
+}
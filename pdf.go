@@ -0,0 +1,129 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+)
+
+// PDF is just enough of a PDF writer for invoices: US letter pages, the standard
+// Helvetica and Courier fonts, text and lines. Coordinates are points from the
+// bottom left corner.
+type PDF struct {
+	pages []*bytes.Buffer
+}
+
+const (
+	pdfPageWidth  = 612
+	pdfPageHeight = 792
+)
+
+// fonts every PDF reader has built in, referenced by name in page content
+var pdfFonts = []string{"Helvetica", "Helvetica-Bold", "Courier"}
+
+const (
+	FontRegular = "F1"
+	FontBold    = "F2"
+	FontMono    = "F3"
+)
+
+func NewPDF() *PDF {
+	return &PDF{}
+}
+
+func (p *PDF) AddPage() {
+	p.pages = append(p.pages, &bytes.Buffer{})
+}
+
+func (p *PDF) page() *bytes.Buffer {
+	if len(p.pages) == 0 {
+		p.AddPage()
+	}
+	return p.pages[len(p.pages)-1]
+}
+
+func (p *PDF) Text(font string, size float64, x float64, y float64, text string) {
+	if text == "" {
+		return
+	}
+	fmt.Fprintf(p.page(), "BT /%s %.1f Tf %.2f %.2f Td (%s) Tj ET\n", font, size, x, y, pdfEscape(text))
+}
+
+// TextRight right aligns monospaced text on x, for columns of amounts.
+func (p *PDF) TextRight(size float64, x float64, y float64, text string) {
+	width := float64(len(pdfEscape(text))-strings.Count(pdfEscape(text), `\`)) * size * 0.6
+	p.Text(FontMono, size, x-width, y, text)
+}
+
+func (p *PDF) Line(x1 float64, y1 float64, x2 float64, y2 float64) {
+	fmt.Fprintf(p.page(), "0.5 w %.2f %.2f m %.2f %.2f l S\n", x1, y1, x2, y2)
+}
+
+// Bytes lays the objects out as catalog, page tree, fonts, then a page and its
+// content stream for each page, followed by the cross reference table.
+func (p *PDF) Bytes() []byte {
+	if len(p.pages) == 0 {
+		p.AddPage()
+	}
+
+	objects := []string{}
+	fontsID := 3
+	firstPageID := fontsID + len(pdfFonts)
+
+	kids := []string{}
+	for i := range p.pages {
+		kids = append(kids, fmt.Sprintf("%d 0 R", firstPageID+i*2))
+	}
+	objects = append(objects, "<< /Type /Catalog /Pages 2 0 R >>")
+	objects = append(objects, fmt.Sprintf("<< /Type /Pages /Kids [%s] /Count %d >>", strings.Join(kids, " "), len(p.pages)))
+
+	fonts := []string{}
+	for i, name := range pdfFonts {
+		objects = append(objects, fmt.Sprintf("<< /Type /Font /Subtype /Type1 /BaseFont /%s /Encoding /WinAnsiEncoding >>", name))
+		fonts = append(fonts, fmt.Sprintf("/F%d %d 0 R", i+1, fontsID+i))
+	}
+
+	for i, content := range p.pages {
+		objects = append(objects, fmt.Sprintf("<< /Type /Page /Parent 2 0 R /MediaBox [0 0 %d %d] /Resources << /Font << %s >> >> /Contents %d 0 R >>",
+			pdfPageWidth, pdfPageHeight, strings.Join(fonts, " "), firstPageID+i*2+1))
+		objects = append(objects, fmt.Sprintf("<< /Length %d >>\nstream\n%sendstream", content.Len(), content.String()))
+	}
+
+	var out bytes.Buffer
+	out.WriteString("%PDF-1.4\n")
+	offsets := []int{}
+	for i, object := range objects {
+		offsets = append(offsets, out.Len())
+		fmt.Fprintf(&out, "%d 0 obj\n%s\nendobj\n", i+1, object)
+	}
+
+	xref := out.Len()
+	fmt.Fprintf(&out, "xref\n0 %d\n0000000000 65535 f \n", len(objects)+1)
+	for _, offset := range offsets {
+		fmt.Fprintf(&out, "%010d 00000 n \n", offset)
+	}
+	fmt.Fprintf(&out, "trailer\n<< /Size %d /Root 1 0 R >>\nstartxref\n%d\n%%%%EOF\n", len(objects)+1, xref)
+
+	return out.Bytes()
+}
+
+// pdfEscape escapes a string for a PDF literal. The fonts use WinAnsi, so Latin-1
+// passes through and anything else becomes "?".
+func pdfEscape(text string) string {
+	var b strings.Builder
+	for _, r := range text {
+		switch {
+		case r == '(' || r == ')' || r == '\\':
+			b.WriteByte('\\')
+			b.WriteRune(r)
+		case r == '\n' || r == '\r' || r == '\t':
+			b.WriteByte(' ')
+		case r < 32 || r > 255:
+			b.WriteByte('?')
+		default:
+			b.WriteByte(byte(r))
+		}
+	}
+
+	return b.String()
+}
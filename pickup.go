@@ -0,0 +1,377 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	_ "modernc.org/sqlite"
+)
+
+// StoreHours are the opening hours for one weekday, 0 is Sunday. Opens and Closes
+// are local times like "10:00".
+type StoreHours struct {
+	Weekday int
+	Opens   string
+	Closes  string
+	Closed  bool
+}
+
+type StoreClosure struct {
+	Date   string
+	Reason string
+}
+
+type PickupSlot struct {
+	Start     time.Time
+	End       time.Time
+	Capacity  int
+	Available int
+}
+
+type PickupDay struct {
+	Date   string
+	Closed bool
+	Reason string
+	Slots  []PickupSlot
+}
+
+func initializePickupTables() error {
+	SQL_0 := `CREATE TABLE IF NOT EXISTS store_hours (
+				weekday INT PRIMARY KEY,
+				opens TEXT,
+				closes TEXT,
+				closed BOOLEAN
+			)`
+	_, err_0 := db.Exec(SQL_0)
+	if err_0 != nil {
+		return fmt.Errorf("failed to create store_hours table: %v", err_0)
+	}
+
+	// open every day until the shop sets its real hours
+	SQL_1 := `INSERT OR IGNORE INTO store_hours (weekday, opens, closes, closed) VALUES (?, ?, ?, ?)`
+	for weekday := 0; weekday < 7; weekday++ {
+		if _, err := db.Exec(SQL_1, weekday, "10:00", "18:00", false); err != nil {
+			return fmt.Errorf("failed to seed store_hours table: %v", err)
+		}
+	}
+
+	SQL_2 := `CREATE TABLE IF NOT EXISTS store_closures (
+				date TEXT PRIMARY KEY,
+				reason TEXT
+			)`
+	_, err_2 := db.Exec(SQL_2)
+	if err_2 != nil {
+		return fmt.Errorf("failed to create store_closures table: %v", err_2)
+	}
+
+	SQL_3 := `CREATE TABLE IF NOT EXISTS pickup_reservations (
+				order_id TEXT PRIMARY KEY,
+				slot_start TEXT,
+				created_at TIMESTAMP
+			)`
+	_, err_3 := db.Exec(SQL_3)
+	if err_3 != nil {
+		return fmt.Errorf("failed to create pickup_reservations table: %v", err_3)
+	}
+
+	return nil
+}
+
+// slot settings come from PICKUP_SLOT_MINUTES, PICKUP_SLOT_CAPACITY and
+// PICKUP_LEAD_MINUTES, the shortest notice we need to pack an order
+func pickupSlotLength() time.Duration {
+	return time.Duration(envInt("PICKUP_SLOT_MINUTES", 30)) * time.Minute
+}
+
+func pickupSlotCapacity() int {
+	return envInt("PICKUP_SLOT_CAPACITY", 4)
+}
+
+func pickupLeadTime() time.Duration {
+	return time.Duration(envInt("PICKUP_LEAD_MINUTES", 60)) * time.Minute
+}
+
+// PUBLIC
+
+func getPickupSlots(c *gin.Context) {
+	days, err := strconv.Atoi(c.DefaultQuery("days", "7"))
+	if err != nil || days < 1 || days > 30 {
+		validationFailed(c, []ValidationError{{Field: "days", Message: "must be between 1 and 30"}})
+		return
+	}
+
+	today := time.Now()
+	schedule := []PickupDay{}
+	for i := 0; i < days; i++ {
+		day, err := getPickupDay(today.AddDate(0, 0, i))
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		schedule = append(schedule, day)
+	}
+
+	c.IndentedJSON(http.StatusOK, schedule)
+}
+
+// ADMIN
+
+func getStoreHours(c *gin.Context) {
+	SQL_0 := `SELECT * FROM store_hours ORDER BY weekday`
+	rows, err := db.Query(SQL_0)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	defer rows.Close()
+
+	hours := []StoreHours{}
+	for rows.Next() {
+		var h StoreHours
+		if err := rows.Scan(&h.Weekday, &h.Opens, &h.Closes, &h.Closed); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		hours = append(hours, h)
+	}
+
+	closures, err := getStoreClosures()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.IndentedJSON(http.StatusOK, gin.H{"hours": hours, "closures": closures})
+}
+
+func setStoreHours(c *gin.Context) {
+	var hours []StoreHours
+	if err := c.ShouldBindBodyWithJSON(&hours); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	errs := []ValidationError{}
+	for _, h := range hours {
+		field := fmt.Sprintf("hours[%d]", h.Weekday)
+		if h.Weekday < 0 || h.Weekday > 6 {
+			errs = append(errs, ValidationError{Field: field, Message: "weekday must be 0 (Sunday) to 6"})
+			continue
+		}
+		if h.Closed {
+			continue
+		}
+		opens, err_0 := time.Parse("15:04", h.Opens)
+		closes, err_1 := time.Parse("15:04", h.Closes)
+		if err_0 != nil || err_1 != nil || !closes.After(opens) {
+			errs = append(errs, ValidationError{Field: field, Message: "needs Opens before Closes, like 10:00 and 18:00"})
+		}
+	}
+	if len(errs) > 0 {
+		validationFailed(c, errs)
+		return
+	}
+
+	SQL := `INSERT OR REPLACE INTO store_hours (weekday, opens, closes, closed) VALUES (?, ?, ?, ?)`
+	for _, h := range hours {
+		if _, err := db.Exec(SQL, h.Weekday, h.Opens, h.Closes, h.Closed); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "store hours updated"})
+}
+
+func addStoreClosure(c *gin.Context) {
+	var closure StoreClosure
+	if err := c.ShouldBindBodyWithJSON(&closure); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if _, err := time.Parse("2006-01-02", closure.Date); err != nil {
+		validationFailed(c, []ValidationError{{Field: "Date", Message: "must be a date like 2024-12-25"}})
+		return
+	}
+
+	SQL := `INSERT OR REPLACE INTO store_closures (date, reason) VALUES (?, ?)`
+	_, err := db.Exec(SQL, closure.Date, closure.Reason)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "store closed on " + closure.Date})
+}
+
+func deleteStoreClosure(c *gin.Context) {
+	date := c.Param("date")
+	SQL := `DELETE FROM store_closures WHERE date = ?`
+
+	_, err := db.Exec(SQL, date)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "store open on " + date})
+}
+
+// SLOTS
+
+func getPickupDay(day time.Time) (PickupDay, error) {
+	day = day.In(time.Local)
+	date := day.Format("2006-01-02")
+	pickupDay := PickupDay{Date: date, Slots: []PickupSlot{}}
+
+	var reason string
+	err := db.QueryRow(`SELECT reason FROM store_closures WHERE date = ?`, date).Scan(&reason)
+	if err == nil {
+		pickupDay.Closed = true
+		pickupDay.Reason = reason
+		return pickupDay, nil
+	}
+	if err != sql.ErrNoRows {
+		return pickupDay, err
+	}
+
+	var h StoreHours
+	err = db.QueryRow(`SELECT * FROM store_hours WHERE weekday = ?`, int(day.Weekday())).Scan(&h.Weekday, &h.Opens, &h.Closes, &h.Closed)
+	if err == sql.ErrNoRows || (err == nil && h.Closed) {
+		pickupDay.Closed = true
+		return pickupDay, nil
+	}
+	if err != nil {
+		return pickupDay, err
+	}
+
+	opens, err := time.ParseInLocation("2006-01-02 15:04", date+" "+h.Opens, time.Local)
+	if err != nil {
+		return pickupDay, err
+	}
+	closes, err := time.ParseInLocation("2006-01-02 15:04", date+" "+h.Closes, time.Local)
+	if err != nil {
+		return pickupDay, err
+	}
+
+	length := pickupSlotLength()
+	capacity := pickupSlotCapacity()
+	earliest := time.Now().Add(pickupLeadTime())
+	for start := opens; !start.Add(length).After(closes); start = start.Add(length) {
+		if start.Before(earliest) {
+			continue
+		}
+
+		reserved, err := countSlotReservations(start)
+		if err != nil {
+			return pickupDay, err
+		}
+
+		pickupDay.Slots = append(pickupDay.Slots, PickupSlot{
+			Start:     start,
+			End:       start.Add(length),
+			Capacity:  capacity,
+			Available: max(capacity-reserved, 0),
+		})
+	}
+
+	return pickupDay, nil
+}
+
+// findPickupSlot returns the slot starting exactly at readyDate, or an error saying
+// why the shopper can't pick up then.
+func findPickupSlot(readyDate time.Time) (PickupSlot, error) {
+	if readyDate.IsZero() {
+		return PickupSlot{}, fmt.Errorf("pick a pickup time")
+	}
+
+	day, err := getPickupDay(readyDate)
+	if err != nil {
+		return PickupSlot{}, err
+	}
+	if day.Closed {
+		return PickupSlot{}, fmt.Errorf("the store is closed on %s", day.Date)
+	}
+
+	for _, slot := range day.Slots {
+		if slot.Start.Equal(readyDate) {
+			if slot.Available == 0 {
+				return PickupSlot{}, fmt.Errorf("the %s pickup slot is full", slot.Start.Format("Jan 2 15:04"))
+			}
+			return slot, nil
+		}
+	}
+
+	return PickupSlot{}, fmt.Errorf("%s is not an available pickup time", readyDate.In(time.Local).Format("Jan 2 15:04"))
+}
+
+func slotKey(start time.Time) string {
+	return start.In(time.Local).Format("2006-01-02T15:04")
+}
+
+// countSlotReservations counts the slot's reservations, except those of orders
+// that were cancelled or refunded.
+func countSlotReservations(start time.Time) (int, error) {
+	SQL := `SELECT COUNT(*) FROM pickup_reservations r LEFT JOIN orders o ON o.order_id = r.order_id
+			WHERE r.slot_start = ? AND COALESCE(o.status, '') NOT IN (?, ?)`
+
+	var count int
+	if err := db.QueryRow(SQL, slotKey(start), StatusCancelled, StatusRefunded).Scan(&count); err != nil {
+		return 0, err
+	}
+
+	return count, nil
+}
+
+// reservePickupSlot holds a place in the slot for the order, checking capacity again
+// inside the caller's transaction so two checkouts can't take the last place.
+func reservePickupSlot(tx *sql.Tx, orderID string, slot PickupSlot) error {
+	SQL_0 := `SELECT COUNT(*) FROM pickup_reservations r LEFT JOIN orders o ON o.order_id = r.order_id
+			WHERE r.slot_start = ? AND COALESCE(o.status, '') NOT IN (?, ?)`
+	var reserved int
+	if err := tx.QueryRow(SQL_0, slotKey(slot.Start), StatusCancelled, StatusRefunded).Scan(&reserved); err != nil {
+		return err
+	}
+	if reserved >= slot.Capacity {
+		return &ValidationError{Field: "ReadyDate", Message: fmt.Sprintf("the %s pickup slot is full", slot.Start.Format("Jan 2 15:04"))}
+	}
+
+	SQL_1 := `INSERT OR REPLACE INTO pickup_reservations (order_id, slot_start, created_at) VALUES (?, ?, ?)`
+	_, err := tx.Exec(SQL_1, orderID, slotKey(slot.Start), time.Now())
+	return err
+}
+
+func releasePickupSlot(orderID string) error {
+	SQL := `DELETE FROM pickup_reservations WHERE order_id = ?`
+	_, err := db.Exec(SQL, orderID)
+	if err != nil {
+		return err
+	} else {
+		return nil
+	}
+}
+
+func getStoreClosures() ([]StoreClosure, error) {
+	SQL := `SELECT * FROM store_closures ORDER BY date`
+	rows, err := db.Query(SQL)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	closures := []StoreClosure{}
+	for rows.Next() {
+		var closure StoreClosure
+		if err := rows.Scan(&closure.Date, &closure.Reason); err != nil {
+			return closures, err
+		}
+		closures = append(closures, closure)
+	}
+
+	return closures, nil
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"database/sql"
 	"fmt"
 	"net/http"
 	"time"
@@ -47,6 +48,7 @@ func setPrice(c *gin.Context) {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
+	publishProductUpdated(price.ProductID, "price")
 	c.JSON(http.StatusOK, gin.H{"message": "price set", "product": price.ProductID, "price": price.Price, "size": price.Size})
 }
 
@@ -65,6 +67,8 @@ func updatePriceBySize(c *gin.Context) {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error(), "message": "error updating price, error db"})
 		return
 	}
+	publishProductUpdated(productID, "price")
+
 	message := fmt.Sprintf(`updated %s's size %s price to %s`, productID, size, price)
 
 	c.JSON(http.StatusOK, gin.H{"message": message})
@@ -93,3 +97,20 @@ func getPrices(c *gin.Context) {
 
 	c.IndentedJSON(http.StatusOK, prices)
 }
+
+// getCurrentPrice returns the latest price set for a product size, found is false
+// when the size has never been priced.
+func getCurrentPrice(productID string, size string) (int, bool, error) {
+	SQL := `SELECT price FROM prices WHERE (product_id, size) = (?, ?) ORDER BY updated_at DESC LIMIT 1`
+
+	var price int
+	err := db.QueryRow(SQL, productID, size).Scan(&price)
+	if err == sql.ErrNoRows {
+		return 0, false, nil
+	}
+	if err != nil {
+		return 0, false, err
+	}
+
+	return price, true, nil
+}
@@ -0,0 +1,244 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+	_ "modernc.org/sqlite"
+)
+
+// HST in Ontario
+const taxRate = 13
+
+// every product is taxed the same way today, recorded on order lines so that can change
+const defaultTaxClass = "HST"
+
+const (
+	DiscountCoupon      = "coupon"
+	DiscountPromotion   = "promotion"
+	DiscountStoreCredit = "store_credit"
+)
+
+type Discount struct {
+	Source      string
+	Code        string
+	Description string
+	Amount      int
+	Delivery    bool
+}
+
+type PricingLine struct {
+	CartItemID int
+	ProductID  string
+	Name       string
+	Image      string
+	Size       string
+	Price      int
+	Quantity   int
+	LineTotal  int
+	Discount   int
+	TaxClass   string
+	Notes      string
+}
+
+type TaxLine struct {
+	Name   string
+	Rate   int
+	Base   int
+	Amount int
+}
+
+type CartPricing struct {
+	CartID        string
+	Items         []CartItem `json:"-"`
+	Lines         []PricingLine
+	Subtotal      int
+	Discounts     []Discount
+	DiscountTotal int
+	DeliveryFee   int
+	Taxes         []TaxLine
+	Tax           int
+	Total         int
+}
+
+// priceCart is the single place cart totals are computed. Checkout stores what it
+// returns on the order, so anything shown to the shopper should come from here too.
+func priceCart(cartID string, deliveryFee int) (CartPricing, error) {
+	items, err := getCartItemsByID(cartID)
+	if err != nil {
+		return CartPricing{}, err
+	}
+
+	// lines are charged at today's price list, never at the price stored on the cart line
+	for i, item := range items {
+		price, found, err := getCurrentPrice(item.ProductID, item.Size)
+		if err != nil {
+			return CartPricing{}, err
+		}
+		if !found {
+			return CartPricing{}, fmt.Errorf("%s isn't sold in size %s anymore, remove it from the cart", item.ProductID, item.Size)
+		}
+		items[i].Price = price
+	}
+
+	pricing := CartPricing{
+		CartID:      cartID,
+		Items:       items,
+		Lines:       []PricingLine{},
+		Subtotal:    sumCartItems(items),
+		Discounts:   []Discount{},
+		DeliveryFee: deliveryFee,
+	}
+
+	for _, item := range items {
+		product, err := getProduct(item.ProductID)
+		if err != nil {
+			product.Name = item.ProductID
+		}
+		pricing.Lines = append(pricing.Lines, PricingLine{
+			CartItemID: item.CartItemID,
+			ProductID:  item.ProductID,
+			Name:       product.Name,
+			Image:      product.Image,
+			Size:       item.Size,
+			Price:      item.Price,
+			Quantity:   item.Quantity,
+			LineTotal:  item.Price * item.Quantity,
+			TaxClass:   defaultTaxClass,
+			Notes:      item.Notes,
+		})
+	}
+
+	promotions, undiscounted, err := evaluatePromotions(items)
+	if err != nil {
+		return CartPricing{}, err
+	}
+	pricing.Discounts = append(pricing.Discounts, promotions...)
+
+	code, err := getCartCoupon(cartID)
+	if err != nil {
+		return CartPricing{}, err
+	}
+	if code != "" {
+		discount, err := evaluateCoupon(code, cartOwner(cartID), undiscounted, pricing.Subtotal, deliveryFee)
+		if err != nil {
+			return CartPricing{}, err
+		}
+		pricing.Discounts = append(pricing.Discounts, discount)
+	}
+
+	// store credit goes on last, on whatever the other discounts left
+	credit, err := storeCreditDiscount(cartOwner(cartID), pricing.Subtotal, pricing.Discounts)
+	if err != nil {
+		return CartPricing{}, err
+	}
+	if credit.Amount > 0 {
+		pricing.Discounts = append(pricing.Discounts, credit)
+	}
+
+	for _, discount := range pricing.Discounts {
+		if discount.Delivery {
+			pricing.DeliveryFee = max(pricing.DeliveryFee-discount.Amount, 0)
+		} else {
+			pricing.DiscountTotal += discount.Amount
+		}
+	}
+	pricing.DiscountTotal = min(pricing.DiscountTotal, pricing.Subtotal)
+	allocateDiscount(pricing.Lines, pricing.DiscountTotal, pricing.Subtotal)
+
+	taxBase := pricing.Subtotal - pricing.DiscountTotal + pricing.DeliveryFee
+	pricing.Tax = taxBase * taxRate / 100
+	pricing.Taxes = []TaxLine{{Name: "HST", Rate: taxRate, Base: taxBase, Amount: pricing.Tax}}
+	pricing.Total = pricing.Subtotal - pricing.DiscountTotal + pricing.DeliveryFee + pricing.Tax
+
+	return pricing, nil
+}
+
+// storeCreditDiscount spends the owner's store credit on what's left of the subtotal.
+// The discount is before HST, sized so it and the HST it saves fit in the balance.
+func storeCreditDiscount(ownerID string, subtotal int, discounts []Discount) (Discount, error) {
+	balance, err := storeCreditBalance(db, ownerID)
+	if err != nil || balance <= 0 {
+		return Discount{}, err
+	}
+
+	left := subtotal
+	for _, discount := range discounts {
+		if !discount.Delivery {
+			left -= discount.Amount
+		}
+	}
+
+	amount := min(balance*100/(100+taxRate), left)
+	if amount <= 0 {
+		return Discount{}, nil
+	}
+
+	return Discount{
+		Source:      DiscountStoreCredit,
+		Description: fmt.Sprintf("store credit, %s left after this order", formatMoney(balance-storeCreditValue(amount))),
+		Amount:      amount,
+	}, nil
+}
+
+// allocateDiscount spreads the order discount over the lines by their share of the
+// subtotal, the rounding remainder goes on the last line.
+func allocateDiscount(lines []PricingLine, discount int, subtotal int) {
+	if discount == 0 || subtotal == 0 || len(lines) == 0 {
+		return
+	}
+
+	allocated := 0
+	for i := range lines {
+		lines[i].Discount = discount * lines[i].LineTotal / subtotal
+		allocated += lines[i].Discount
+	}
+	lines[len(lines)-1].Discount += discount - allocated
+}
+
+func sumCartItems(items []CartItem) int {
+	subtotal := 0
+	for _, item := range items {
+		subtotal += item.Price * item.Quantity
+	}
+
+	return subtotal
+}
+
+// getCartSummary prices the cart for pickup, or for delivery to the zone of the
+// postal_code query when is_delivery is set.
+func getCartSummary(c *gin.Context) {
+	cartID := c.Param("cart_id")
+	isDelivery, _ := strconv.ParseBool(c.Query("is_delivery"))
+
+	var zone *DeliveryZone
+	if isDelivery {
+		postalCode, ok := findPostalCode(c.Query("postal_code"))
+		if !ok {
+			validationFailed(c, []ValidationError{{Field: "postal_code", Message: "is required for delivery, like M5V 2T6"}})
+			return
+		}
+
+		found, err := findDeliveryZone(postalCode, nil)
+		if err == sql.ErrNoRows {
+			validationFailed(c, []ValidationError{{Field: "postal_code", Message: "we don't deliver to " + postalCode + " yet"}})
+			return
+		}
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		zone = &found
+	}
+
+	pricing, err := priceCartForZone(cartID, zone)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"message": "error pricing cart", "error": err.Error()})
+		return
+	}
+
+	c.IndentedJSON(http.StatusOK, pricing)
+}
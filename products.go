@@ -6,6 +6,7 @@ import (
 	"fmt"
 	"io"
 	"net/http"
+	"strconv"
 	"time"
 
 	"github.com/gin-gonic/gin"
@@ -22,6 +23,7 @@ type Product struct {
 	Category    string
 	CreatedAt   time.Time
 	UpdatedAt   time.Time
+	MaxQuantity int
 }
 
 type ProductDelete struct {
@@ -37,15 +39,16 @@ func initializeProductsTable() error {
 			description TEXT,
 			category TEXT,
 			created_at TIMESTAMP,
-			updated_at TIMESTAMP
+			updated_at TIMESTAMP,
+			max_quantity INT
 		);
 	`
 	_, err := db.Exec(SQL)
 	if err != nil {
 		return err
-	} else {
-		return nil
 	}
+
+	return addColumn("products", "max_quantity", "INT DEFAULT 0")
 }
 
 // PRODUCTS
@@ -65,8 +68,8 @@ func addProducts(c *gin.Context) {
 	}
 
 	SQL := `
-		INSERT INTO products (product_id, image, name, description, category, created_at, updated_at)
-		VALUES (?, ?, ?, ?, ?, ?, ?);
+		INSERT INTO products (product_id, image, name, description, category, created_at, updated_at, max_quantity)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?);
 	`
 	var productsString string
 	countAdd := 1
@@ -74,7 +77,7 @@ func addProducts(c *gin.Context) {
 		productID := fmt.Sprintf("%04d", count+countAdd)
 		countAdd++
 		product.ProductID = productID
-		_, err := db.Exec(SQL, product.ProductID, product.Image, product.Name, product.Description, product.Category, time.Now(), time.Now())
+		_, err := db.Exec(SQL, product.ProductID, product.Image, product.Name, product.Description, product.Category, time.Now(), time.Now(), product.MaxQuantity)
 		if err != nil {
 			c.JSON(http.StatusInternalServerError, gin.H{"error_3": err.Error()})
 			return
@@ -171,7 +174,7 @@ func editProductString(c *gin.Context) {
 		return
 	}
 
-	SQL := fmt.Sprintf(`UPDATE products SET (%s, updated_at) = (?, ?) WHERE id = ?;`, column)
+	SQL := fmt.Sprintf(`UPDATE products SET (%s, updated_at) = (?, ?) WHERE product_id = ?;`, column)
 
 	_, err_2 := db.Exec(SQL, value, time.Now(), ID)
 	if err_2 != nil {
@@ -179,6 +182,8 @@ func editProductString(c *gin.Context) {
 		return
 	}
 
+	publishProductUpdated(ID, column)
+
 	message := fmt.Sprintf(`edited product %s's %s`, ID, column)
 
 	c.JSON(http.StatusOK, gin.H{"message": message})
@@ -198,11 +203,34 @@ func deleteProduct(c *gin.Context) {
 	c.JSON(http.StatusOK, "product deleted: "+productID)
 }
 
+func updateMaxQuantity(c *gin.Context) {
+	productID := c.Param("product_id")
+
+	maxQuantity, err := strconv.Atoi(c.Param("max_quantity"))
+	if err != nil || maxQuantity < 0 {
+		validationFailed(c, []ValidationError{{Field: "max_quantity", Message: "must be a whole number of 0 or more, 0 means no limit"}})
+		return
+	}
+
+	SQL := `UPDATE products SET (max_quantity, updated_at) = (?, ?) WHERE product_id = ?`
+	_, err = db.Exec(SQL, maxQuantity, time.Now(), productID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	publishProductUpdated(productID, "max_quantity")
+
+	message := fmt.Sprintf(`updated %s's max quantity to %d`, productID, maxQuantity)
+
+	c.JSON(http.StatusOK, gin.H{"message": message})
+}
+
 func bindProducts(rows *sql.Rows) ([]Product, error) {
 	products := []Product{}
 	for rows.Next() {
 		var product Product
-		err := rows.Scan(&product.ProductID, &product.Image, &product.Name, &product.Description, &product.Category, &product.CreatedAt, &product.UpdatedAt)
+		err := rows.Scan(&product.ProductID, &product.Image, &product.Name, &product.Description, &product.Category, &product.CreatedAt, &product.UpdatedAt, &product.MaxQuantity)
 		if err != nil {
 			return products, err
 		}
@@ -211,3 +239,52 @@ func bindProducts(rows *sql.Rows) ([]Product, error) {
 
 	return products, nil
 }
+
+func getProduct(productID string) (Product, error) {
+	SQL := `SELECT * FROM products WHERE product_id = ?`
+	rows, err := db.Query(SQL, productID)
+	if err != nil {
+		return Product{}, err
+	}
+	defer rows.Close()
+
+	products, err := bindProducts(rows)
+	if err != nil {
+		return Product{}, err
+	}
+	if len(products) == 0 {
+		return Product{}, sql.ErrNoRows
+	}
+
+	return products[0], nil
+}
+
+func getProductCategory(productID string) (string, error) {
+	SQL := `SELECT category FROM products WHERE product_id = ?`
+
+	var category string
+	err := db.QueryRow(SQL, productID).Scan(&category)
+	if err == sql.ErrNoRows {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+
+	return category, nil
+}
+
+func getProductMaxQuantity(productID string) (int, error) {
+	SQL := `SELECT max_quantity FROM products WHERE product_id = ?`
+
+	var maxQuantity int
+	err := db.QueryRow(SQL, productID).Scan(&maxQuantity)
+	if err == sql.ErrNoRows {
+		return 0, fmt.Errorf("product %s doesn't exist", productID)
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	return maxQuantity, nil
+}
@@ -0,0 +1,440 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	_ "modernc.org/sqlite"
+)
+
+const (
+	PromotionBuyXGetY = "buy_x_get_y"
+	PromotionTiered   = "tiered"
+	PromotionBundle   = "bundle"
+)
+
+// Promotion is a rule applied automatically to every cart.
+//
+//	buy_x_get_y: every BuyQuantity + FreeQuantity matching units, the cheapest FreeQuantity are free
+//	tiered:      Percent off the matching lines once at least MinQuantity units are in the cart
+//	bundle:      one unit of each of ProductIDs together costs BundlePrice
+//
+// ProductIDs and Size narrow which cart lines match, empty means any. A unit in the
+// cart only ever counts towards one promotion, and an Exclusive promotion doesn't
+// combine with any other.
+type Promotion struct {
+	PromotionID  int
+	Name         string
+	Kind         string
+	ProductIDs   string
+	Size         string
+	BuyQuantity  int
+	FreeQuantity int
+	MinQuantity  int
+	Percent      int
+	BundlePrice  int
+	Active       bool
+	StartsAt     time.Time
+	EndsAt       time.Time
+	CreatedAt    time.Time
+	UpdatedAt    time.Time
+	Exclusive    bool
+}
+
+// promotionUnit is one unit of a cart line, Line is its index in the cart items.
+type promotionUnit struct {
+	Line  int
+	Price int
+}
+
+// promotionPlan is one way of applying promotions to the cart, Left is how many
+// units of each line no promotion has used.
+type promotionPlan struct {
+	Discounts []Discount
+	Amount    int
+	Left      []int
+}
+
+func initializePromotionsTable() error {
+	SQL := `CREATE TABLE IF NOT EXISTS promotions (
+				promotion_id INTEGER PRIMARY KEY AUTOINCREMENT,
+				name TEXT,
+				kind TEXT,
+				product_ids TEXT,
+				size TEXT,
+				buy_quantity INT,
+				free_quantity INT,
+				min_quantity INT,
+				percent INT,
+				bundle_price INT,
+				active BOOLEAN,
+				starts_at TIMESTAMP,
+				ends_at TIMESTAMP,
+				created_at TIMESTAMP,
+				updated_at TIMESTAMP
+			)`
+	_, err := db.Exec(SQL)
+	if err != nil {
+		return err
+	}
+
+	return addColumn("promotions", "exclusive", "BOOLEAN DEFAULT 0")
+}
+
+// ADMIN
+
+func addPromotion(c *gin.Context) {
+	var promotion Promotion
+	if err := c.ShouldBindBodyWithJSON(&promotion); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	switch promotion.Kind {
+	case PromotionBuyXGetY:
+		if promotion.BuyQuantity <= 0 || promotion.FreeQuantity <= 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "buy_x_get_y needs a BuyQuantity and FreeQuantity"})
+			return
+		}
+	case PromotionTiered:
+		if promotion.MinQuantity <= 0 || promotion.Percent <= 0 || promotion.Percent > 100 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "tiered needs a MinQuantity and a Percent between 1 and 100"})
+			return
+		}
+	case PromotionBundle:
+		if len(splitList(promotion.ProductIDs)) < 2 || promotion.BundlePrice <= 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "bundle needs at least two ProductIDs and a BundlePrice"})
+			return
+		}
+	default:
+		c.JSON(http.StatusBadRequest, gin.H{"error": "unknown promotion kind: " + promotion.Kind})
+		return
+	}
+
+	SQL := `INSERT INTO promotions (
+				name,
+				kind,
+				product_ids,
+				size,
+				buy_quantity,
+				free_quantity,
+				min_quantity,
+				percent,
+				bundle_price,
+				active,
+				starts_at,
+				ends_at,
+				created_at,
+				updated_at,
+				exclusive) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`
+	result, err := db.Exec(SQL, promotion.Name, promotion.Kind, promotion.ProductIDs, promotion.Size, promotion.BuyQuantity,
+		promotion.FreeQuantity, promotion.MinQuantity, promotion.Percent, promotion.BundlePrice, promotion.Active,
+		promotion.StartsAt, promotion.EndsAt, time.Now(), time.Now(), promotion.Exclusive)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	id, _ := result.LastInsertId()
+
+	c.JSON(http.StatusOK, gin.H{"message": "promotion added: " + promotion.Name, "promotion_id": id})
+}
+
+func getPromotions(c *gin.Context) {
+	SQL := `SELECT * FROM promotions`
+	rows, err := db.Query(SQL)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	defer rows.Close()
+
+	promotions, err := bindPromotions(rows)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.IndentedJSON(http.StatusOK, promotions)
+}
+
+func setPromotionActive(c *gin.Context) {
+	promotionID := c.Param("promotion_id")
+	active := c.Param("active") == "true"
+
+	SQL := `UPDATE promotions SET (active, updated_at) = (?, ?) WHERE promotion_id = ?`
+	_, err := db.Exec(SQL, active, time.Now(), promotionID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	message := fmt.Sprintf(`set promotion %s active to %t`, promotionID, active)
+
+	c.JSON(http.StatusOK, gin.H{"message": message})
+}
+
+func deletePromotion(c *gin.Context) {
+	promotionID := c.Param("promotion_id")
+	SQL := `DELETE FROM promotions WHERE promotion_id = ?`
+
+	_, err := db.Exec(SQL, promotionID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "promotion deleted: " + promotionID})
+}
+
+// ENGINE
+
+func getActivePromotions() ([]Promotion, error) {
+	SQL := `SELECT * FROM promotions WHERE active = 1`
+	rows, err := db.Query(SQL)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	promotions, err := bindPromotions(rows)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	active := []Promotion{}
+	for _, promotion := range promotions {
+		if !promotion.StartsAt.IsZero() && now.Before(promotion.StartsAt) {
+			continue
+		}
+		if !promotion.EndsAt.IsZero() && now.After(promotion.EndsAt) {
+			continue
+		}
+		active = append(active, promotion)
+	}
+
+	return active, nil
+}
+
+// evaluatePromotions returns the promotions that apply to the cart and the units
+// none of them used, for the coupon. Of the ways the promotions can share out the
+// units, the one saving the shopper the most is kept.
+func evaluatePromotions(items []CartItem) ([]Discount, []CartItem, error) {
+	promotions, err := getActivePromotions()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	best := applyPromotions(nil, items)
+	stackable := []Promotion{}
+	for _, promotion := range promotions {
+		if !promotion.Exclusive {
+			stackable = append(stackable, promotion)
+			continue
+		}
+		if plan := applyPromotions([]Promotion{promotion}, items); plan.Amount > best.Amount {
+			best = plan
+		}
+	}
+
+	for _, order := range promotionOrders(stackable, items) {
+		if plan := applyPromotions(order, items); plan.Amount > best.Amount {
+			best = plan
+		}
+	}
+
+	undiscounted := []CartItem{}
+	for i, item := range items {
+		if best.Left[i] > 0 {
+			item.Quantity = best.Left[i]
+			undiscounted = append(undiscounted, item)
+		}
+	}
+
+	return best.Discounts, undiscounted, nil
+}
+
+// applyPromotions applies the promotions in order, each to the units the ones before
+// it left over.
+func applyPromotions(promotions []Promotion, items []CartItem) promotionPlan {
+	plan := promotionPlan{Discounts: []Discount{}, Left: make([]int, len(items))}
+	for i, item := range items {
+		plan.Left[i] = item.Quantity
+	}
+
+	for _, promotion := range promotions {
+		var discount Discount
+		var used []promotionUnit
+		switch promotion.Kind {
+		case PromotionBuyXGetY:
+			discount, used = evaluateBuyXGetY(promotion, items, plan.Left)
+		case PromotionTiered:
+			discount, used = evaluateTiered(promotion, items, plan.Left)
+		case PromotionBundle:
+			discount, used = evaluateBundle(promotion, items, plan.Left)
+		}
+
+		if discount.Amount <= 0 {
+			continue
+		}
+
+		for _, unit := range used {
+			plan.Left[unit.Line]--
+		}
+		plan.Discounts = append(plan.Discounts, discount)
+		plan.Amount += discount.Amount
+	}
+
+	return plan
+}
+
+// promotionOrders lists the orders worth trying the promotions in. Every order is
+// tried for the handful a shop runs at once, past that the biggest go first.
+func promotionOrders(promotions []Promotion, items []CartItem) [][]Promotion {
+	if len(promotions) > 6 {
+		sorted := append([]Promotion{}, promotions...)
+		sort.SliceStable(sorted, func(i, j int) bool {
+			return applyPromotions(sorted[i:i+1], items).Amount > applyPromotions(sorted[j:j+1], items).Amount
+		})
+		return [][]Promotion{sorted}
+	}
+
+	if len(promotions) <= 1 {
+		return [][]Promotion{promotions}
+	}
+
+	orders := [][]Promotion{}
+	for i := range promotions {
+		rest := append(append([]Promotion{}, promotions[:i]...), promotions[i+1:]...)
+		for _, order := range promotionOrders(rest, items) {
+			orders = append(orders, append([]Promotion{promotions[i]}, order...))
+		}
+	}
+
+	return orders
+}
+
+// evaluateBuyXGetY groups the cheapest matching units into sets, the cheapest
+// FreeQuantity of each set are free.
+func evaluateBuyXGetY(promotion Promotion, items []CartItem, left []int) (Discount, []promotionUnit) {
+	units := matchingUnits(promotion, items, left)
+
+	sets := len(units) / (promotion.BuyQuantity + promotion.FreeQuantity)
+	free := sets * promotion.FreeQuantity
+
+	amount := 0
+	for _, unit := range units[:free] {
+		amount += unit.Price
+	}
+
+	return Discount{
+		Source:      DiscountPromotion,
+		Code:        fmt.Sprint(promotion.PromotionID),
+		Description: fmt.Sprintf("%s: buy %d get %d free, %d free", promotion.Name, promotion.BuyQuantity, promotion.FreeQuantity, free),
+		Amount:      amount,
+	}, units[:sets*(promotion.BuyQuantity+promotion.FreeQuantity)]
+}
+
+func evaluateTiered(promotion Promotion, items []CartItem, left []int) (Discount, []promotionUnit) {
+	units := matchingUnits(promotion, items, left)
+	if len(units) < promotion.MinQuantity {
+		return Discount{}, nil
+	}
+
+	subtotal := 0
+	for _, unit := range units {
+		subtotal += unit.Price
+	}
+
+	return Discount{
+		Source:      DiscountPromotion,
+		Code:        fmt.Sprint(promotion.PromotionID),
+		Description: fmt.Sprintf("%s: %d%% off %d or more", promotion.Name, promotion.Percent, promotion.MinQuantity),
+		Amount:      subtotal * promotion.Percent / 100,
+	}, units
+}
+
+// evaluateBundle makes as many bundles as every product allows, each from the
+// cheapest units of the products.
+func evaluateBundle(promotion Promotion, items []CartItem, left []int) (Discount, []promotionUnit) {
+	productIDs := splitList(promotion.ProductIDs)
+
+	byProduct := [][]promotionUnit{}
+	bundles := -1
+	for _, productID := range productIDs {
+		units := matchingUnits(Promotion{ProductIDs: productID, Size: promotion.Size}, items, left)
+		byProduct = append(byProduct, units)
+		if bundles == -1 || len(units) < bundles {
+			bundles = len(units)
+		}
+	}
+	if bundles <= 0 {
+		return Discount{}, nil
+	}
+
+	used := []promotionUnit{}
+	regular := 0
+	for _, units := range byProduct {
+		for _, unit := range units[:bundles] {
+			regular += unit.Price
+		}
+		used = append(used, units[:bundles]...)
+	}
+
+	if regular <= bundles*promotion.BundlePrice {
+		return Discount{}, nil
+	}
+
+	return Discount{
+		Source:      DiscountPromotion,
+		Code:        fmt.Sprint(promotion.PromotionID),
+		Description: fmt.Sprintf("%s: bundle of %d for %s, applied %d time(s)", promotion.Name, len(productIDs), formatMoney(promotion.BundlePrice), bundles),
+		Amount:      regular - bundles*promotion.BundlePrice,
+	}, used
+}
+
+// matchingUnits expands the units left of matching cart lines, cheapest first.
+func matchingUnits(promotion Promotion, items []CartItem, left []int) []promotionUnit {
+	productIDs := splitList(promotion.ProductIDs)
+
+	units := []promotionUnit{}
+	for i, item := range items {
+		if len(productIDs) > 0 && !contains(productIDs, item.ProductID) {
+			continue
+		}
+		if !matchesSize(promotion, item) {
+			continue
+		}
+		for n := 0; n < left[i]; n++ {
+			units = append(units, promotionUnit{Line: i, Price: item.Price})
+		}
+	}
+	sort.SliceStable(units, func(i, j int) bool { return units[i].Price < units[j].Price })
+
+	return units
+}
+
+func matchesSize(promotion Promotion, item CartItem) bool {
+	return promotion.Size == "" || promotion.Size == item.Size
+}
+
+func bindPromotions(rows *sql.Rows) ([]Promotion, error) {
+	promotions := []Promotion{}
+	for rows.Next() {
+		var promotion Promotion
+		err := rows.Scan(&promotion.PromotionID, &promotion.Name, &promotion.Kind, &promotion.ProductIDs, &promotion.Size,
+			&promotion.BuyQuantity, &promotion.FreeQuantity, &promotion.MinQuantity, &promotion.Percent, &promotion.BundlePrice,
+			&promotion.Active, &promotion.StartsAt, &promotion.EndsAt, &promotion.CreatedAt, &promotion.UpdatedAt, &promotion.Exclusive)
+		if err != nil {
+			return promotions, err
+		}
+		promotions = append(promotions, promotion)
+	}
+
+	return promotions, nil
+}
@@ -0,0 +1,485 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	_ "modernc.org/sqlite"
+)
+
+const (
+	RefundItem     = "item"
+	RefundDelivery = "delivery"
+)
+
+// customers can cancel on their own until the shop starts preparing the order
+var cancellableStatuses = []string{StatusPendingPayment, StatusPaid}
+
+type Refund struct {
+	RefundID         int
+	OrderID          string
+	Kind             string
+	OrderItemID      int
+	Quantity         int
+	Amount           int
+	Reason           string
+	ProviderRefundID string
+	ActorID          string
+	CreatedAt        time.Time
+}
+
+type RefundLine struct {
+	OrderItemID int
+	Quantity    int
+}
+
+// RefundRequest refunds the listed Items and, with Delivery, the delivery fee.
+// Full refunds whatever is left on the order. SkipRestock is for goods that can't
+// go back on the shelf. LatePayment refunds a payment that came in after the order
+// was cancelled unpaid, which the order's history doesn't show.
+type RefundRequest struct {
+	Full        bool
+	Items       []RefundLine
+	Delivery    bool
+	Reason      string
+	SkipRestock bool
+	LatePayment bool `json:"-"`
+}
+
+func initializeRefundsTable() error {
+	SQL := `
+		CREATE TABLE IF NOT EXISTS refunds (
+			refund_id INTEGER PRIMARY KEY AUTOINCREMENT,
+			order_id TEXT,
+			kind TEXT,
+			order_item_id INT,
+			quantity INT,
+			amount INT,
+			reason TEXT,
+			provider_refund_id TEXT,
+			actor_id TEXT,
+			created_at TIMESTAMP
+		)`
+	_, err := db.Exec(SQL)
+	if err != nil {
+		return err
+	}
+
+	if err := addColumn("orders", "refunded", "INT DEFAULT 0"); err != nil {
+		return err
+	}
+	if err := addColumn("order_items", "refunded_quantity", "INT DEFAULT 0"); err != nil {
+		return err
+	}
+
+	return addColumn("order_items", "restocked", "INT DEFAULT 0")
+}
+
+// CUSTOMER
+
+// cancelMyOrder cancels the caller's order if it hasn't started being prepared,
+// refunding it in full when it was already paid.
+func cancelMyOrder(c *gin.Context) {
+	userID, err := currentUserID(c)
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": err.Error()})
+		return
+	}
+
+	orderID := c.Param("order_id")
+	order, err := getOrder(orderID)
+	if err == sql.ErrNoRows || (err == nil && order.UserID != userID) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "order not found: " + orderID})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	if !contains(cancellableStatuses, order.Status) {
+		c.JSON(http.StatusConflict, gin.H{"error": "order is already " + strings.ReplaceAll(order.Status, "_", " ") + " and can't be cancelled"})
+		return
+	}
+
+	refunds, err := transitionWithRefund(order, StatusCancelled, userID, "cancelled by customer")
+	if te, ok := err.(*TransitionError); ok {
+		c.JSON(http.StatusConflict, gin.H{"error": te.Error()})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusBadGateway, gin.H{"message": "error cancelling order", "error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "order cancelled: " + orderID, "refunds": refunds})
+}
+
+// ADMIN
+
+func adminRefundOrder(c *gin.Context) {
+	adminID, err := currentUserID(c)
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": err.Error()})
+		return
+	}
+
+	orderID := c.Param("order_id")
+
+	var request RefundRequest
+	if err := c.ShouldBindBodyWithJSON(&request); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	order, err := getOrder(orderID)
+	if err == sql.ErrNoRows {
+		c.JSON(http.StatusNotFound, gin.H{"error": "order not found: " + orderID})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	refunds, err := issueRefund(order, request, adminID)
+	if ve, ok := err.(*ValidationError); ok {
+		validationFailed(c, []ValidationError{*ve})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusBadGateway, gin.H{"message": "error refunding order", "error": err.Error()})
+		return
+	}
+
+	// nothing left to give back, the order is done
+	order, err = getOrder(orderID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if order.Refunded >= order.TotalPrice {
+		if err := transitionOrder(orderID, StatusRefunded, adminID, true, request.Reason); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "refunded " + formatMoney(sumRefunds(refunds)) + " on order " + orderID, "refunds": refunds})
+}
+
+func adminGetRefunds(c *gin.Context) {
+	refunds, err := getRefunds(c.Param("order_id"))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.IndentedJSON(http.StatusOK, refunds)
+}
+
+// REFUNDS
+
+// needsRefund reports whether moving the order to status has to give money back:
+// marking it refunded, or cancelling it after it was paid.
+func needsRefund(order Order, status string) bool {
+	if status == StatusRefunded {
+		return true
+	}
+
+	return status == StatusCancelled && order.Status != StatusPendingPayment
+}
+
+// transitionWithRefund makes a status change by hand. When the change needs a refund,
+// whatever is left on the order is refunded through issueRefund first, so an order
+// never reads refunded or cancelled with the customer's money still held.
+func transitionWithRefund(order Order, to string, actorID string, note string) ([]Refund, error) {
+	if to == StatusCancelled && order.Status == StatusPendingPayment {
+		// close the checkout so it can't be paid, a payment that still gets through is refunded by stripeWebhook
+		if err := expireCheckout(order.PaymentID); err != nil {
+			log.Printf("expiring checkout %s for order %s: %v", order.PaymentID, order.OrderID, err)
+		}
+	}
+
+	if !needsRefund(order, to) || order.Refunded >= order.TotalPrice {
+		return nil, transitionOrder(order.OrderID, to, actorID, true, note)
+	}
+
+	// check the move before any money does
+	if err := canTransition(order.Status, to, true); err != nil {
+		return nil, err
+	}
+
+	reason := note
+	if reason == "" {
+		reason = "order " + to
+	}
+	// goods the customer already has stay with them, cancelled goods never left
+	shipped := order.Status == StatusOutForDelivery || order.Status == StatusCompleted
+	refunds, err := issueRefund(order, RefundRequest{Full: true, Reason: reason, SkipRestock: shipped}, actorID)
+	if err != nil {
+		return nil, err
+	}
+
+	return refunds, transitionOrder(order.OrderID, to, actorID, true, note)
+}
+
+// issueRefund works out what the request is worth, reserves it on the order, refunds
+// it through the payment provider and then records it. Amounts include the HST that
+// was charged on them. Input problems come back as *ValidationError.
+func issueRefund(order Order, request RefundRequest, actorID string) ([]Refund, error) {
+	if order.PaymentID == "" || order.Status == StatusPendingPayment {
+		return nil, &ValidationError{Field: "order", Message: "hasn't been paid"}
+	}
+
+	history, err := getOrderStatusHistory(order.OrderID)
+	if err != nil {
+		return nil, err
+	}
+	if paymentState(order, history) == "not_paid" && !request.LatePayment {
+		return nil, &ValidationError{Field: "order", Message: "hasn't been paid"}
+	}
+
+	remaining := order.TotalPrice - order.Refunded
+	if remaining <= 0 {
+		return nil, &ValidationError{Field: "order", Message: "is already fully refunded"}
+	}
+
+	items, err := getOrderItems(order.OrderID)
+	if err != nil {
+		return nil, err
+	}
+
+	deliveryRefunded, err := isDeliveryRefunded(order.OrderID)
+	if err != nil {
+		return nil, err
+	}
+
+	lines := request.Items
+	delivery := request.Delivery
+	if request.Full {
+		lines = []RefundLine{}
+		for _, item := range items {
+			if left := item.Quantity - item.RefundedQuantity; left > 0 {
+				lines = append(lines, RefundLine{OrderItemID: item.OrderItemID, Quantity: left})
+			}
+		}
+		delivery = order.DeliveryFee > 0 && !deliveryRefunded
+	}
+
+	refunds := []Refund{}
+	for _, line := range lines {
+		var item *OrderItem
+		for i := range items {
+			if items[i].OrderItemID == line.OrderItemID {
+				item = &items[i]
+			}
+		}
+		field := fmt.Sprintf("Items[%d]", line.OrderItemID)
+		if item == nil {
+			return nil, &ValidationError{Field: field, Message: "is not on this order"}
+		}
+		if line.Quantity <= 0 || line.Quantity > item.Quantity-item.RefundedQuantity {
+			return nil, &ValidationError{Field: field, Message: fmt.Sprintf("can refund 1 to %d", item.Quantity-item.RefundedQuantity)}
+		}
+
+		refunds = append(refunds, Refund{
+			OrderID:     order.OrderID,
+			Kind:        RefundItem,
+			OrderItemID: item.OrderItemID,
+			Quantity:    line.Quantity,
+			Amount:      refundLineAmount(*item, line.Quantity),
+		})
+	}
+
+	if delivery {
+		if deliveryRefunded || order.DeliveryFee == 0 {
+			return nil, &ValidationError{Field: "Delivery", Message: "there's no delivery fee left to refund"}
+		}
+		refunds = append(refunds, Refund{
+			OrderID: order.OrderID,
+			Kind:    RefundDelivery,
+			Amount:  order.DeliveryFee + order.DeliveryFee*taxRate/100,
+		})
+	}
+
+	if len(refunds) == 0 {
+		return nil, &ValidationError{Field: "Items", Message: "choose what to refund"}
+	}
+
+	// rounding means line by line can drift a cent from what was charged, a full
+	// refund gives back exactly what's left
+	total := sumRefunds(refunds)
+	if request.Full || total > remaining {
+		refunds[len(refunds)-1].Amount += remaining - total
+		total = remaining
+	}
+
+	if err := reserveRefund(order, refunds, total); err != nil {
+		return nil, err
+	}
+
+	providerID, err := refundPayment(order.PaymentID, total, order.OrderID)
+	if err != nil {
+		if err := releaseRefund(order.OrderID, refunds, total); err != nil {
+			log.Printf("refund of %s on order %s failed and couldn't be released: %v", formatMoney(total), order.OrderID, err)
+		}
+		return nil, err
+	}
+
+	for i := range refunds {
+		refunds[i].Reason = request.Reason
+		refunds[i].ProviderRefundID = providerID
+		refunds[i].ActorID = actorID
+		refunds[i].CreatedAt = time.Now()
+	}
+
+	// the money has moved, so a failure here has to be fixed by hand
+	if err := recordRefunds(refunds, !request.SkipRestock); err != nil {
+		log.Printf("refund %s of %s on order %s went through but wasn't recorded: %v", providerID, formatMoney(total), order.OrderID, err)
+		return nil, err
+	}
+
+	return refunds, nil
+}
+
+// reserveRefund counts the refund against the order before any money moves. It only
+// applies while the order's refunded total is what the refund was worked out from,
+// so of two refunds racing on one order the second is turned away.
+func reserveRefund(order Order, refunds []Refund, total int) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	SQL_0 := `UPDATE orders SET (refunded, updated_at) = (COALESCE(refunded, 0) + ?, ?) WHERE order_id = ? AND COALESCE(refunded, 0) = ?`
+	result, err := tx.Exec(SQL_0, total, time.Now(), order.OrderID, order.Refunded)
+	if err != nil {
+		return err
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		return fmt.Errorf("order %s was refunded while this refund was being made, try again", order.OrderID)
+	}
+
+	SQL_1 := `UPDATE order_items SET refunded_quantity = COALESCE(refunded_quantity, 0) + ?
+			WHERE item_id = ? AND COALESCE(refunded_quantity, 0) + ? <= quantity`
+	for _, r := range refunds {
+		if r.Kind != RefundItem {
+			continue
+		}
+		result, err := tx.Exec(SQL_1, r.Quantity, r.OrderItemID, r.Quantity)
+		if err != nil {
+			return err
+		}
+		if n, _ := result.RowsAffected(); n == 0 {
+			return fmt.Errorf("order line %d was refunded while this refund was being made, try again", r.OrderItemID)
+		}
+	}
+
+	return tx.Commit()
+}
+
+// releaseRefund gives back a reservation the payment provider didn't go through with.
+func releaseRefund(orderID string, refunds []Refund, total int) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	SQL_0 := `UPDATE orders SET (refunded, updated_at) = (COALESCE(refunded, 0) - ?, ?) WHERE order_id = ?`
+	if _, err := tx.Exec(SQL_0, total, time.Now(), orderID); err != nil {
+		return err
+	}
+
+	SQL_1 := `UPDATE order_items SET refunded_quantity = COALESCE(refunded_quantity, 0) - ? WHERE item_id = ?`
+	for _, r := range refunds {
+		if r.Kind != RefundItem {
+			continue
+		}
+		if _, err := tx.Exec(SQL_1, r.Quantity, r.OrderItemID); err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// recordRefunds writes the refunds reserveRefund already counted, restocking the
+// refunded lines unless restock is off.
+func recordRefunds(refunds []Refund, restock bool) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	SQL := `INSERT INTO refunds (order_id, kind, order_item_id, quantity, amount, reason, provider_refund_id, actor_id, created_at)
+			VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)`
+	for _, r := range refunds {
+		if _, err := tx.Exec(SQL, r.OrderID, r.Kind, r.OrderItemID, r.Quantity, r.Amount, r.Reason, r.ProviderRefundID, r.ActorID, r.CreatedAt); err != nil {
+			return err
+		}
+		if r.Kind == RefundItem && restock {
+			if err := restockItem(tx, r.OrderItemID, r.Quantity); err != nil {
+				return err
+			}
+		}
+	}
+
+	return tx.Commit()
+}
+
+// refundLineAmount is what quantity units of a line cost the customer, their share
+// of the line discount taken off and HST added.
+func refundLineAmount(item OrderItem, quantity int) int {
+	net := item.Price*quantity - item.Discount*quantity/item.Quantity
+	return net + net*taxRate/100
+}
+
+func isDeliveryRefunded(orderID string) (bool, error) {
+	var count int
+	SQL := `SELECT COUNT(*) FROM refunds WHERE order_id = ? AND kind = ?`
+	if err := db.QueryRow(SQL, orderID, RefundDelivery).Scan(&count); err != nil {
+		return false, err
+	}
+
+	return count > 0, nil
+}
+
+func sumRefunds(refunds []Refund) int {
+	total := 0
+	for _, r := range refunds {
+		total += r.Amount
+	}
+
+	return total
+}
+
+func getRefunds(orderID string) ([]Refund, error) {
+	SQL := `SELECT * FROM refunds WHERE order_id = ? ORDER BY refund_id`
+	rows, err := db.Query(SQL, orderID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	refunds := []Refund{}
+	for rows.Next() {
+		var r Refund
+		err := rows.Scan(&r.RefundID, &r.OrderID, &r.Kind, &r.OrderItemID, &r.Quantity, &r.Amount, &r.Reason,
+			&r.ProviderRefundID, &r.ActorID, &r.CreatedAt)
+		if err != nil {
+			return refunds, err
+		}
+		refunds = append(refunds, r)
+	}
+
+	return refunds, nil
+}
@@ -0,0 +1,911 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	_ "modernc.org/sqlite"
+)
+
+const (
+	ReturnRequested = "requested"
+	ReturnApproved  = "approved"
+	ReturnRejected  = "rejected"
+	ReturnReceived  = "received"
+	ReturnResolved  = "resolved"
+)
+
+// returnTransitions is the return lifecycle, like orderTransitions for orders.
+var returnTransitions = map[string][]string{
+	ReturnRequested: {ReturnApproved, ReturnRejected},
+	ReturnApproved:  {ReturnReceived, ReturnRejected},
+	ReturnReceived:  {ReturnResolved},
+	ReturnRejected:  {},
+	ReturnResolved:  {},
+}
+
+var returnReasons = []string{"damaged", "wrong_item", "not_as_described", "changed_mind", "other"}
+
+// conditions a returned item can arrive in, only resellable goes back into stock
+var returnConditions = []string{"resellable", "damaged", "missing"}
+
+const (
+	ResolutionRefund      = "refund"
+	ResolutionReplacement = "replacement"
+	ResolutionStoreCredit = "store_credit"
+)
+
+type Return struct {
+	ReturnID      int
+	OrderID       string
+	UserID        string
+	Status        string
+	Reason        string
+	Comments      string
+	Condition     string
+	Resolution    string
+	ResolutionRef string
+	CreatedAt     time.Time
+	UpdatedAt     time.Time
+}
+
+type ReturnItem struct {
+	ReturnItemID int
+	ReturnID     int
+	OrderItemID  int
+	Quantity     int
+}
+
+type ReturnStatusChange struct {
+	HistoryID  int
+	ReturnID   int
+	FromStatus string
+	ToStatus   string
+	ActorID    string
+	Note       string
+	CreatedAt  time.Time
+}
+
+type ReturnDetail struct {
+	Return        Return
+	Items         []ReturnItem
+	Photos        []string
+	StatusHistory []ReturnStatusChange
+}
+
+type ReturnRequest struct {
+	Items    []RefundLine
+	Reason   string
+	Comments string
+	Photos   []string
+}
+
+// ReturnUpdate is the body for admin status changes. Condition is recorded when the
+// goods are received, Resolution when the return is resolved. A replacement goes out
+// at ReadyDate, in a pickup slot or on a delivery day like any order.
+type ReturnUpdate struct {
+	Note       string
+	Condition  string
+	Resolution string
+	ReadyDate  time.Time
+}
+
+func initializeReturnsTables() error {
+	SQL_0 := `CREATE TABLE IF NOT EXISTS returns (
+				return_id INTEGER PRIMARY KEY AUTOINCREMENT,
+				order_id TEXT,
+				user_id TEXT,
+				status TEXT,
+				reason TEXT,
+				comments TEXT,
+				condition TEXT,
+				resolution TEXT,
+				resolution_ref TEXT,
+				created_at TIMESTAMP,
+				updated_at TIMESTAMP
+			)`
+	_, err_0 := db.Exec(SQL_0)
+	if err_0 != nil {
+		return fmt.Errorf("failed to create returns table: %v", err_0)
+	}
+
+	SQL_1 := `CREATE TABLE IF NOT EXISTS return_items (
+				return_item_id INTEGER PRIMARY KEY AUTOINCREMENT,
+				return_id INT,
+				order_item_id INT,
+				quantity INT
+			)`
+	_, err_1 := db.Exec(SQL_1)
+	if err_1 != nil {
+		return fmt.Errorf("failed to create return_items table: %v", err_1)
+	}
+
+	SQL_2 := `CREATE TABLE IF NOT EXISTS return_photos (
+				photo_id INTEGER PRIMARY KEY AUTOINCREMENT,
+				return_id INT,
+				url TEXT,
+				created_at TIMESTAMP
+			)`
+	_, err_2 := db.Exec(SQL_2)
+	if err_2 != nil {
+		return fmt.Errorf("failed to create return_photos table: %v", err_2)
+	}
+
+	SQL_3 := `CREATE TABLE IF NOT EXISTS return_status_history (
+				history_id INTEGER PRIMARY KEY AUTOINCREMENT,
+				return_id INT,
+				from_status TEXT,
+				to_status TEXT,
+				actor_id TEXT,
+				note TEXT,
+				created_at TIMESTAMP
+			)`
+	_, err_3 := db.Exec(SQL_3)
+	if err_3 != nil {
+		return fmt.Errorf("failed to create return_status_history table: %v", err_3)
+	}
+
+	SQL_4 := `CREATE TABLE IF NOT EXISTS store_credits (
+				credit_id INTEGER PRIMARY KEY AUTOINCREMENT,
+				user_id TEXT,
+				amount INT,
+				source TEXT,
+				reference TEXT,
+				created_at TIMESTAMP
+			)`
+	_, err_4 := db.Exec(SQL_4)
+	if err_4 != nil {
+		return fmt.Errorf("failed to create store_credits table: %v", err_4)
+	}
+
+	return nil
+}
+
+// CUSTOMER
+
+// requestReturn opens a return on lines of one of the caller's completed orders,
+// within RETURN_WINDOW_DAYS (30) of it being completed.
+func requestReturn(c *gin.Context) {
+	userID, err := currentUserID(c)
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": err.Error()})
+		return
+	}
+
+	orderID := c.Param("order_id")
+
+	var request ReturnRequest
+	if err := c.ShouldBindBodyWithJSON(&request); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	detail, err := getOrderDetail(orderID)
+	if err == sql.ErrNoRows || (err == nil && detail.Order.UserID != userID) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "order not found: " + orderID})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	if detail.Order.Status != StatusCompleted {
+		c.JSON(http.StatusConflict, gin.H{"error": "only completed orders can be returned"})
+		return
+	}
+	window := time.Duration(envInt("RETURN_WINDOW_DAYS", 30)) * 24 * time.Hour
+	for _, change := range detail.StatusHistory {
+		if change.ToStatus == StatusCompleted && time.Since(change.CreatedAt) > window {
+			c.JSON(http.StatusConflict, gin.H{"error": "the return window for this order has closed"})
+			return
+		}
+	}
+
+	errs := []ValidationError{}
+	if !contains(returnReasons, request.Reason) {
+		errs = append(errs, ValidationError{Field: "Reason", Message: "must be one of " + strings.Join(returnReasons, ", ")})
+	}
+	if len(request.Items) == 0 {
+		errs = append(errs, ValidationError{Field: "Items", Message: "choose what to return"})
+	}
+	for _, photo := range request.Photos {
+		if !strings.HasPrefix(photo, "http://") && !strings.HasPrefix(photo, "https://") {
+			errs = append(errs, ValidationError{Field: "Photos", Message: "must be links to the uploaded photos"})
+			break
+		}
+	}
+
+	open, err := openReturnQuantities(orderID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	for _, line := range request.Items {
+		field := fmt.Sprintf("Items[%d]", line.OrderItemID)
+		var item *OrderItem
+		for i := range detail.Items {
+			if detail.Items[i].OrderItemID == line.OrderItemID {
+				item = &detail.Items[i]
+			}
+		}
+		if item == nil {
+			errs = append(errs, ValidationError{Field: field, Message: "is not on this order"})
+			continue
+		}
+		left := item.Quantity - item.RefundedQuantity - open[item.OrderItemID]
+		if line.Quantity <= 0 || line.Quantity > left {
+			errs = append(errs, ValidationError{Field: field, Message: fmt.Sprintf("can return 1 to %d", max(left, 0))})
+		}
+	}
+	if len(errs) > 0 {
+		validationFailed(c, errs)
+		return
+	}
+
+	returnID, err := pushReturn(orderID, userID, request)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "return requested", "return_id": returnID})
+}
+
+func getMyReturns(c *gin.Context) {
+	userID, err := currentUserID(c)
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": err.Error()})
+		return
+	}
+
+	returns, err := getReturns(`user_id = ?`, userID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.IndentedJSON(http.StatusOK, returns)
+}
+
+func getMyReturn(c *gin.Context) {
+	userID, err := currentUserID(c)
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": err.Error()})
+		return
+	}
+
+	returnID := c.Param("return_id")
+	detail, err := getReturnDetail(returnID)
+	if err == sql.ErrNoRows || (err == nil && detail.Return.UserID != userID) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "return not found: " + returnID})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.IndentedJSON(http.StatusOK, detail)
+}
+
+func getMyStoreCredit(c *gin.Context) {
+	userID, err := currentUserID(c)
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": err.Error()})
+		return
+	}
+
+	balance, err := storeCreditBalance(db, userID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"balance": balance})
+}
+
+// ADMIN
+
+func adminGetReturns(c *gin.Context) {
+	where, args := "1 = 1", []any{}
+	if status := c.Query("status"); status != "" {
+		where, args = "status = ?", []any{status}
+	}
+
+	returns, err := getReturns(where, args...)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.IndentedJSON(http.StatusOK, returns)
+}
+
+func adminGetReturn(c *gin.Context) {
+	returnID := c.Param("return_id")
+	detail, err := getReturnDetail(returnID)
+	if err == sql.ErrNoRows {
+		c.JSON(http.StatusNotFound, gin.H{"error": "return not found: " + returnID})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.IndentedJSON(http.StatusOK, detail)
+}
+
+// adminUpdateReturn moves a return along: approve or reject it, record the goods as
+// received and in what condition, or resolve it with a refund, a replacement order
+// or store credit.
+func adminUpdateReturn(c *gin.Context) {
+	adminID, err := currentUserID(c)
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": err.Error()})
+		return
+	}
+
+	returnID := c.Param("return_id")
+	status := c.Param("status")
+
+	var update ReturnUpdate
+	if err := c.ShouldBindBodyWithJSON(&update); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	detail, err := getReturnDetail(returnID)
+	if err == sql.ErrNoRows {
+		c.JSON(http.StatusNotFound, gin.H{"error": "return not found: " + returnID})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	if !contains(returnTransitions[detail.Return.Status], status) {
+		c.JSON(http.StatusConflict, gin.H{"error": fmt.Sprintf("return can't go from %s to %s", detail.Return.Status, status)})
+		return
+	}
+
+	var slot *PickupSlot
+	switch status {
+	case ReturnReceived:
+		if !contains(returnConditions, update.Condition) {
+			validationFailed(c, []ValidationError{{Field: "Condition", Message: "must be one of " + strings.Join(returnConditions, ", ")}})
+			return
+		}
+	case ReturnResolved:
+		resolutions := []string{ResolutionRefund, ResolutionReplacement, ResolutionStoreCredit}
+		if !contains(resolutions, update.Resolution) {
+			validationFailed(c, []ValidationError{{Field: "Resolution", Message: "must be one of " + strings.Join(resolutions, ", ")}})
+			return
+		}
+		if update.Resolution == ResolutionReplacement {
+			slot, err = checkReplacementDate(detail.Return.OrderID, update.ReadyDate)
+			if ve, ok := err.(*ValidationError); ok {
+				validationFailed(c, []ValidationError{*ve})
+				return
+			}
+			if err != nil {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+				return
+			}
+		}
+	}
+
+	// the return moves first, so of two requests to resolve it only one gets to move
+	// money or goods
+	if err := transitionReturn(detail, status, adminID, update); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	reference := ""
+	if status == ReturnResolved {
+		reference, err = resolveReturn(detail, update, slot, adminID)
+		if err != nil {
+			if err := reopenReturn(detail.Return.ReturnID, adminID, err); err != nil {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+				return
+			}
+		}
+		if ve, ok := err.(*ValidationError); ok {
+			validationFailed(c, []ValidationError{*ve})
+			return
+		}
+		if err != nil {
+			c.JSON(http.StatusBadGateway, gin.H{"message": "error resolving return", "error": err.Error()})
+			return
+		}
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": fmt.Sprintf("return %s is %s", returnID, status), "reference": reference})
+}
+
+// RETURNS
+
+func pushReturn(orderID string, userID string, request ReturnRequest) (int, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	SQL_0 := `INSERT INTO returns (order_id, user_id, status, reason, comments, condition, resolution, resolution_ref, created_at, updated_at)
+			VALUES (?, ?, ?, ?, ?, '', '', '', ?, ?)`
+	result, err := tx.Exec(SQL_0, orderID, userID, ReturnRequested, request.Reason, request.Comments, time.Now(), time.Now())
+	if err != nil {
+		return 0, err
+	}
+	returnID, _ := result.LastInsertId()
+
+	SQL_1 := `INSERT INTO return_items (return_id, order_item_id, quantity) VALUES (?, ?, ?)`
+	for _, line := range request.Items {
+		if _, err := tx.Exec(SQL_1, returnID, line.OrderItemID, line.Quantity); err != nil {
+			return 0, err
+		}
+	}
+
+	SQL_2 := `INSERT INTO return_photos (return_id, url, created_at) VALUES (?, ?, ?)`
+	for _, photo := range request.Photos {
+		if _, err := tx.Exec(SQL_2, returnID, photo, time.Now()); err != nil {
+			return 0, err
+		}
+	}
+
+	if err := recordReturnChange(tx, int(returnID), "", ReturnRequested, userID, request.Comments); err != nil {
+		return 0, err
+	}
+
+	return int(returnID), tx.Commit()
+}
+
+// transitionReturn saves the new status with whatever the step records, restocking
+// resellable goods when they're received.
+func transitionReturn(detail ReturnDetail, to string, actorID string, update ReturnUpdate) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	r := detail.Return
+	condition, resolution := r.Condition, r.Resolution
+	if to == ReturnReceived {
+		condition = update.Condition
+	}
+	if to == ReturnResolved {
+		resolution = update.Resolution
+	}
+
+	SQL := `UPDATE returns SET (status, condition, resolution, updated_at) = (?, ?, ?, ?)
+			WHERE return_id = ? AND status = ?`
+	result, err := tx.Exec(SQL, to, condition, resolution, time.Now(), r.ReturnID, r.Status)
+	if err != nil {
+		return err
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		return fmt.Errorf("return %d changed while updating, try again", r.ReturnID)
+	}
+
+	if to == ReturnReceived && condition == "resellable" {
+		for _, item := range detail.Items {
+			if err := restockItem(tx, item.OrderItemID, item.Quantity); err != nil {
+				return err
+			}
+		}
+	}
+
+	if err := recordReturnChange(tx, r.ReturnID, r.Status, to, actorID, update.Note); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// resolveReturn settles a return that was just marked resolved and records what was
+// done on it: the refund id, the replacement order id or the store credit id.
+func resolveReturn(detail ReturnDetail, update ReturnUpdate, slot *PickupSlot, actorID string) (string, error) {
+	order, err := getOrder(detail.Return.OrderID)
+	if err != nil {
+		return "", err
+	}
+
+	lines := []RefundLine{}
+	for _, item := range detail.Items {
+		lines = append(lines, RefundLine{OrderItemID: item.OrderItemID, Quantity: item.Quantity})
+	}
+
+	reference := ""
+	switch update.Resolution {
+	case ResolutionRefund:
+		// received goods were already restocked by condition
+		reason := fmt.Sprintf("return %d", detail.Return.ReturnID)
+		refunds, err := issueRefund(order, RefundRequest{Items: lines, Reason: reason, SkipRestock: true}, actorID)
+		if err != nil {
+			return "", err
+		}
+		reference = refunds[0].ProviderRefundID
+
+	case ResolutionReplacement:
+		reference, err = pushReplacementOrder(order, detail, update.ReadyDate, slot, actorID)
+		if err != nil {
+			return "", err
+		}
+
+	case ResolutionStoreCredit:
+		reference, err = creditReturn(detail)
+		if err != nil {
+			return "", err
+		}
+
+	default:
+		return "", &ValidationError{Field: "Resolution", Message: "unknown resolution: " + update.Resolution}
+	}
+
+	SQL := `UPDATE returns SET resolution_ref = ? WHERE return_id = ?`
+	_, err = db.Exec(SQL, reference, detail.Return.ReturnID)
+	return reference, err
+}
+
+// reopenReturn puts a return whose resolution failed back to received, so it can be
+// resolved again.
+func reopenReturn(returnID int, actorID string, cause error) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	SQL := `UPDATE returns SET (status, resolution, updated_at) = (?, '', ?) WHERE return_id = ? AND status = ?`
+	if _, err := tx.Exec(SQL, ReturnReceived, time.Now(), returnID, ReturnResolved); err != nil {
+		return err
+	}
+
+	if err := recordReturnChange(tx, returnID, ReturnResolved, ReturnReceived, actorID, "resolving failed: "+cause.Error()); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// creditReturn gives the returned lines' worth as store credit and counts them as
+// refunded, so the same units can't be refunded again later.
+func creditReturn(detail ReturnDetail) (string, error) {
+	items, err := getOrderItems(detail.Return.OrderID)
+	if err != nil {
+		return "", err
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return "", err
+	}
+	defer tx.Rollback()
+
+	amount := 0
+	SQL_0 := `UPDATE order_items SET refunded_quantity = COALESCE(refunded_quantity, 0) + ?
+			WHERE item_id = ? AND COALESCE(refunded_quantity, 0) + ? <= quantity`
+	for _, returned := range detail.Items {
+		for _, item := range items {
+			if item.OrderItemID != returned.OrderItemID {
+				continue
+			}
+			result, err := tx.Exec(SQL_0, returned.Quantity, item.OrderItemID, returned.Quantity)
+			if err != nil {
+				return "", err
+			}
+			if n, _ := result.RowsAffected(); n == 0 {
+				return "", &ValidationError{Field: "Items", Message: fmt.Sprintf("order line %d was already refunded", item.OrderItemID)}
+			}
+			amount += refundLineAmount(item, returned.Quantity)
+		}
+	}
+
+	SQL_1 := `INSERT INTO store_credits (user_id, amount, source, reference, created_at) VALUES (?, ?, ?, ?, ?)`
+	result, err := tx.Exec(SQL_1, detail.Return.UserID, amount, "return", fmt.Sprint(detail.Return.ReturnID), time.Now())
+	if err != nil {
+		return "", err
+	}
+	creditID, _ := result.LastInsertId()
+
+	return fmt.Sprintf("credit %d", creditID), tx.Commit()
+}
+
+// checkReplacementDate checks a replacement can go out when asked, the way the order
+// went: in an open pickup slot, or on a day its delivery zone gets deliveries. The
+// slot comes back for pickups so it can be reserved.
+func checkReplacementDate(orderID string, readyDate time.Time) (*PickupSlot, error) {
+	if readyDate.Before(time.Now()) {
+		return nil, &ValidationError{Field: "ReadyDate", Message: "pick when the replacement goes out"}
+	}
+
+	order, err := getOrder(orderID)
+	if err != nil {
+		return nil, err
+	}
+
+	if isDelivery, _ := strconv.ParseBool(order.IsDelivery); !isDelivery {
+		slot, err := findPickupSlot(readyDate)
+		if err != nil {
+			return nil, &ValidationError{Field: "ReadyDate", Message: err.Error()}
+		}
+		return &slot, nil
+	}
+
+	address, err := getOrderAddress(orderID)
+	if err != nil || address == nil {
+		return nil, err
+	}
+	zone, err := findDeliveryZone(address.PostalCode, nil)
+	if err == sql.ErrNoRows {
+		return nil, &ValidationError{Field: "ReadyDate", Message: "we don't deliver to " + address.PostalCode + " anymore"}
+	}
+	if err != nil {
+		return nil, err
+	}
+	// a replacement isn't held to the zone's minimum order, only to its delivery days
+	if errs := checkDeliveryOrder(zone, CartPricing{Subtotal: zone.MinimumOrder}, readyDate); len(errs) > 0 {
+		return nil, &errs[0]
+	}
+
+	return nil, nil
+}
+
+// pushReplacementOrder sends the returned lines out again at no charge, as a paid
+// order for the same customer and fulfillment as the original, ready at readyDate.
+func pushReplacementOrder(order Order, detail ReturnDetail, readyDate time.Time, slot *PickupSlot, actorID string) (string, error) {
+	items, err := getOrderItems(order.OrderID)
+	if err != nil {
+		return "", err
+	}
+
+	orderID, err := generateOrderID()
+	if err != nil {
+		return "", err
+	}
+
+	lines := []PricingLine{}
+	for _, returned := range detail.Items {
+		for _, item := range items {
+			if item.OrderItemID != returned.OrderItemID {
+				continue
+			}
+			lines = append(lines, PricingLine{
+				ProductID: item.ProductID,
+				Name:      item.Name,
+				Image:     item.Image,
+				Size:      item.Size,
+				Quantity:  returned.Quantity,
+				TaxClass:  item.TaxClass,
+				Notes:     item.Notes,
+			})
+		}
+	}
+
+	address, err := getOrderAddress(order.OrderID)
+	if err != nil {
+		return "", err
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return "", err
+	}
+	defer tx.Rollback()
+
+	if slot != nil {
+		if err := reservePickupSlot(tx, orderID, *slot); err != nil {
+			return "", err
+		}
+	}
+
+	if err := pushOrderItems(tx, lines, orderID); err != nil {
+		return "", err
+	}
+
+	SQL := `INSERT INTO orders (
+				order_id,
+				id_delivery,
+				delivery_address,
+				ready_date,
+				notes,
+				subtotal,
+				delivery_fee,
+				tax,
+				total_price,
+				discount,
+				status,
+				created_at,
+				updated_at,
+				user_id) VALUES (?, ?, ?, ?, ?, 0, 0, 0, 0, 0, ?, ?, ?, ?)`
+	note := fmt.Sprintf("replacement for order %s, return %d", order.OrderID, detail.Return.ReturnID)
+	_, err = tx.Exec(SQL, orderID, order.IsDelivery, order.DeliveryAddress, readyDate, note, StatusPaid, time.Now(), time.Now(), order.UserID)
+	if err != nil {
+		return "", err
+	}
+
+	if address != nil {
+		if err := pushOrderAddress(tx, orderID, *address); err != nil {
+			return "", err
+		}
+	}
+
+	change, err := recordStatusChange(tx, orderID, "", StatusPaid, actorID, note)
+	if err != nil {
+		return "", err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return "", err
+	}
+	orderBroker.Publish(change)
+
+	return orderID, nil
+}
+
+// storeCreditBalance is what the user has left to spend, credits less what checkouts took.
+func storeCreditBalance(q querier, userID string) (int, error) {
+	var balance int
+	err := q.QueryRow(`SELECT COALESCE(SUM(amount), 0) FROM store_credits WHERE user_id = ?`, userID).Scan(&balance)
+
+	return balance, err
+}
+
+// storeCreditValue is what a store credit discount takes off the balance. Credit is
+// given with its HST, so it also covers the HST the discount saves.
+func storeCreditValue(discount int) int {
+	return discount + discount*taxRate/100
+}
+
+// spendStoreCredit takes what the order's store credit discount is worth off the
+// user's balance, in the checkout's transaction, failing if the balance no longer
+// covers it.
+func spendStoreCredit(tx *sql.Tx, userID string, orderID string, discounts []Discount) error {
+	for _, discount := range discounts {
+		if discount.Source != DiscountStoreCredit {
+			continue
+		}
+
+		balance, err := storeCreditBalance(tx, userID)
+		if err != nil {
+			return err
+		}
+		value := storeCreditValue(discount.Amount)
+		if value > balance {
+			return &ValidationError{Field: "StoreCredit", Message: fmt.Sprintf("balance is %s, check the cart again", formatMoney(balance))}
+		}
+
+		SQL := `INSERT INTO store_credits (user_id, amount, source, reference, created_at) VALUES (?, ?, ?, ?, ?)`
+		if _, err := tx.Exec(SQL, userID, -value, "order", orderID, time.Now()); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// releaseStoreCredit gives back the credit an order spent, when it's cancelled or refunded.
+func releaseStoreCredit(tx *sql.Tx, orderID string) error {
+	_, err := tx.Exec(`DELETE FROM store_credits WHERE source = 'order' AND reference = ?`, orderID)
+	return err
+}
+
+func recordReturnChange(tx *sql.Tx, returnID int, from string, to string, actorID string, note string) error {
+	SQL := `INSERT INTO return_status_history (return_id, from_status, to_status, actor_id, note, created_at) VALUES (?, ?, ?, ?, ?, ?)`
+	_, err := tx.Exec(SQL, returnID, from, to, actorID, note, time.Now())
+	if err != nil {
+		return err
+	} else {
+		return nil
+	}
+}
+
+// openReturnQuantities counts what's already being returned per order line, so a
+// line can't be returned twice. Rejected returns don't count.
+func openReturnQuantities(orderID string) (map[int]int, error) {
+	SQL := `SELECT ri.order_item_id, SUM(ri.quantity) FROM return_items ri JOIN returns r ON r.return_id = ri.return_id
+			WHERE r.order_id = ? AND r.status != ? GROUP BY ri.order_item_id`
+	rows, err := db.Query(SQL, orderID, ReturnRejected)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	open := map[int]int{}
+	for rows.Next() {
+		var itemID, quantity int
+		if err := rows.Scan(&itemID, &quantity); err != nil {
+			return open, err
+		}
+		open[itemID] = quantity
+	}
+
+	return open, nil
+}
+
+func getReturns(where string, args ...any) ([]Return, error) {
+	SQL := `SELECT * FROM returns WHERE ` + where + ` ORDER BY return_id DESC`
+	rows, err := db.Query(SQL, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	returns := []Return{}
+	for rows.Next() {
+		var r Return
+		err := rows.Scan(&r.ReturnID, &r.OrderID, &r.UserID, &r.Status, &r.Reason, &r.Comments, &r.Condition,
+			&r.Resolution, &r.ResolutionRef, &r.CreatedAt, &r.UpdatedAt)
+		if err != nil {
+			return returns, err
+		}
+		returns = append(returns, r)
+	}
+
+	return returns, nil
+}
+
+func getReturnDetail(returnID string) (ReturnDetail, error) {
+	returns, err := getReturns(`return_id = ?`, returnID)
+	if err != nil {
+		return ReturnDetail{}, err
+	}
+	if len(returns) == 0 {
+		return ReturnDetail{}, sql.ErrNoRows
+	}
+	detail := ReturnDetail{Return: returns[0], Items: []ReturnItem{}, Photos: []string{}, StatusHistory: []ReturnStatusChange{}}
+
+	rows, err := db.Query(`SELECT * FROM return_items WHERE return_id = ? ORDER BY return_item_id`, returnID)
+	if err != nil {
+		return detail, err
+	}
+	for rows.Next() {
+		var item ReturnItem
+		if err := rows.Scan(&item.ReturnItemID, &item.ReturnID, &item.OrderItemID, &item.Quantity); err != nil {
+			rows.Close()
+			return detail, err
+		}
+		detail.Items = append(detail.Items, item)
+	}
+	rows.Close()
+
+	rows, err = db.Query(`SELECT url FROM return_photos WHERE return_id = ? ORDER BY photo_id`, returnID)
+	if err != nil {
+		return detail, err
+	}
+	for rows.Next() {
+		var url string
+		if err := rows.Scan(&url); err != nil {
+			rows.Close()
+			return detail, err
+		}
+		detail.Photos = append(detail.Photos, url)
+	}
+	rows.Close()
+
+	rows, err = db.Query(`SELECT * FROM return_status_history WHERE return_id = ? ORDER BY history_id`, returnID)
+	if err != nil {
+		return detail, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var change ReturnStatusChange
+		err := rows.Scan(&change.HistoryID, &change.ReturnID, &change.FromStatus, &change.ToStatus, &change.ActorID, &change.Note, &change.CreatedAt)
+		if err != nil {
+			return detail, err
+		}
+		detail.StatusHistory = append(detail.StatusHistory, change)
+	}
+
+	return detail, nil
+}
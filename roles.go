@@ -0,0 +1,241 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	_ "modernc.org/sqlite"
+)
+
+const (
+	RoleCustomer = "customer"
+	RoleStaff    = "staff"
+	RoleManager  = "manager"
+	RoleOwner    = "owner"
+)
+
+const (
+	PermCatalogWrite   = "catalog.write"
+	PermOrdersManage   = "orders.manage"
+	PermRefundsIssue   = "refunds.issue"
+	PermUsersManage    = "users.manage"
+	PermSettingsManage = "settings.manage"
+)
+
+// roles lists the roles from least to most trusted.
+var roles = []string{RoleCustomer, RoleStaff, RoleManager, RoleOwner}
+
+// rolePermissions is what each role may do. Customers only ever act on their own
+// carts, orders and addresses, which needs no permission.
+var rolePermissions = map[string][]string{
+	RoleCustomer: {},
+	RoleStaff:    {PermOrdersManage},
+	RoleManager:  {PermOrdersManage, PermCatalogWrite, PermRefundsIssue},
+	RoleOwner:    {PermOrdersManage, PermCatalogWrite, PermRefundsIssue, PermUsersManage, PermSettingsManage},
+}
+
+type UserRole struct {
+	UserID     string
+	Username   string
+	Email      string
+	Role       string
+	AssignedBy string
+	UpdatedAt  sql.NullTime
+}
+
+func initializeRolesTable() error {
+	SQL := `CREATE TABLE IF NOT EXISTS user_roles (
+				user_id TEXT PRIMARY KEY,
+				role TEXT,
+				assigned_by TEXT,
+				updated_at TIMESTAMP
+			)`
+	_, err := db.Exec(SQL)
+	if err != nil {
+		return fmt.Errorf("failed to create user_roles table: %v", err)
+	}
+
+	return nil
+}
+
+func isRole(role string) bool {
+	_, ok := rolePermissions[role]
+	return ok
+}
+
+func roleCan(role string, permission string) bool {
+	return contains(rolePermissions[role], permission)
+}
+
+// getRole returns the user's role. Users nobody has given a role yet are owners if
+// they were admins before roles existed, customers otherwise.
+func getRole(userID string) (string, error) {
+	SQL := `SELECT COALESCE(r.role, CASE WHEN u.is_admin THEN ? ELSE ? END)
+			FROM users u LEFT JOIN user_roles r ON r.user_id = u.id
+			WHERE u.id = ?`
+
+	var role string
+	err := db.QueryRow(SQL, RoleOwner, RoleCustomer, userID).Scan(&role)
+	if err == sql.ErrNoRows {
+		return RoleCustomer, nil
+	}
+	if err != nil {
+		return "", err
+	}
+
+	return role, nil
+}
+
+func userCan(userID string, permission string) (bool, error) {
+	role, err := getRole(userID)
+	if err != nil {
+		return false, err
+	}
+
+	return roleCan(role, permission), nil
+}
+
+// requirePermission lets the request through only for a logged in user whose role
+// has the permission.
+func requirePermission(permission string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		p, err := currentPrincipal(c)
+		if err != nil {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": err.Error()})
+			return
+		}
+
+		if !p.Can(permission) {
+			c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "requires the " + permission + " permission"})
+			return
+		}
+
+		c.Next()
+	}
+}
+
+// statusPermission is the permission needed to move an order to status by hand.
+// Refunding moves money, so it's kept apart from running orders.
+func statusPermission(status string) string {
+	if status == StatusRefunded {
+		return PermRefundsIssue
+	}
+
+	return PermOrdersManage
+}
+
+func getRoles(c *gin.Context) {
+	list := []gin.H{}
+	for _, role := range roles {
+		list = append(list, gin.H{"role": role, "permissions": rolePermissions[role]})
+	}
+
+	c.IndentedJSON(http.StatusOK, list)
+}
+
+// getUserRoles lists registered users with their roles, ?role= narrows it to one role.
+func getUserRoles(c *gin.Context) {
+	SQL := `SELECT u.id, u.username, COALESCE(u.email, ''), COALESCE(r.role, CASE WHEN u.is_admin THEN ? ELSE ? END),
+				COALESCE(r.assigned_by, ''), r.updated_at
+			FROM users u LEFT JOIN user_roles r ON r.user_id = u.id
+			WHERE u.username IS NOT NULL ORDER BY u.username`
+	rows, err := db.Query(SQL, RoleOwner, RoleCustomer)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	defer rows.Close()
+
+	users := []UserRole{}
+	for rows.Next() {
+		var user UserRole
+		err := rows.Scan(&user.UserID, &user.Username, &user.Email, &user.Role, &user.AssignedBy, &user.UpdatedAt)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+
+		if role := c.Query("role"); role != "" && role != user.Role {
+			continue
+		}
+		users = append(users, user)
+	}
+
+	c.IndentedJSON(http.StatusOK, users)
+}
+
+// setUserRole gives a registered user a role. is_admin follows along, so anything
+// still reading it sees staff of every role as admins. The last owner can't be
+// demoted, someone has to be left to manage users.
+func setUserRole(c *gin.Context) {
+	actorID, err := currentUserID(c)
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": err.Error()})
+		return
+	}
+
+	userID := c.Param("user_id")
+	role := c.Param("role")
+	if !isRole(role) {
+		validationFailed(c, []ValidationError{{Field: "role", Message: "must be one of customer, staff, manager, owner"}})
+		return
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	defer tx.Rollback()
+
+	var current string
+	SQL_0 := `SELECT COALESCE(r.role, CASE WHEN u.is_admin THEN ? ELSE ? END)
+			FROM users u LEFT JOIN user_roles r ON r.user_id = u.id
+			WHERE u.id = ? AND u.username IS NOT NULL`
+	err = tx.QueryRow(SQL_0, RoleOwner, RoleCustomer, userID).Scan(&current)
+	if err == sql.ErrNoRows {
+		c.JSON(http.StatusNotFound, gin.H{"error": "user not found: " + userID})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	if current == RoleOwner && role != RoleOwner {
+		var owners int
+		SQL_1 := `SELECT COUNT(*) FROM users u LEFT JOIN user_roles r ON r.user_id = u.id
+				WHERE u.username IS NOT NULL AND COALESCE(r.role, CASE WHEN u.is_admin THEN ? ELSE ? END) = ?`
+		if err := tx.QueryRow(SQL_1, RoleOwner, RoleCustomer, RoleOwner).Scan(&owners); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		if owners <= 1 {
+			c.JSON(http.StatusConflict, gin.H{"error": "can't demote the last owner"})
+			return
+		}
+	}
+
+	SQL_2 := `INSERT INTO user_roles (user_id, role, assigned_by, updated_at) VALUES (?, ?, ?, ?)
+			ON CONFLICT (user_id) DO UPDATE SET (role, assigned_by, updated_at) = (excluded.role, excluded.assigned_by, excluded.updated_at)`
+	if _, err := tx.Exec(SQL_2, userID, role, actorID, time.Now()); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	SQL_3 := `UPDATE users SET is_admin = ? WHERE id = ? AND username IS NOT NULL`
+	if _, err := tx.Exec(SQL_3, role != RoleCustomer, userID); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": userID + " is now " + role, "permissions": rolePermissions[role]})
+}
@@ -0,0 +1,296 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	_ "modernc.org/sqlite"
+)
+
+// Session is one login on one device. The access tokens it hands out are short
+// lived, the refresh token gets a new one and is replaced every time it's used.
+type Session struct {
+	SessionID  string
+	UserID     string
+	UserAgent  string
+	IP         string
+	CreatedAt  time.Time
+	LastUsedAt time.Time
+	ExpiresAt  time.Time
+	RevokedAt  sql.NullTime
+}
+
+type RefreshRequest struct {
+	RefreshToken string
+}
+
+// SigningKeys are the HMAC keys tokens are signed with, by kid. New tokens use
+// Current, the rest are kept so tokens signed before a rotation still verify.
+type SigningKeys struct {
+	Current string
+	Keys    map[string][]byte
+}
+
+var jwtKeys SigningKeys
+
+// minSigningKeyBytes is the shortest secret accepted, HS256 wants at least its 32 byte hash size.
+const minSigningKeyBytes = 32
+
+// loadSigningKeys reads JWT_SECRET as the current key, named by JWT_KEY_ID, and
+// JWT_PREVIOUS_KEYS ("kid:secret,kid:secret") as the retired ones. To rotate, give
+// the new secret a new JWT_KEY_ID and move the old pair to JWT_PREVIOUS_KEYS; it can
+// come out once the last refresh made with it is an access token lifetime old.
+// Secrets shorter than minSigningKeyBytes keep the shop from starting.
+func loadSigningKeys() error {
+	keys := SigningKeys{Current: envString("JWT_KEY_ID", "1"), Keys: map[string][]byte{}}
+
+	for _, pair := range splitList(os.Getenv("JWT_PREVIOUS_KEYS")) {
+		kid, secret, found := strings.Cut(pair, ":")
+		if !found || kid == "" || secret == "" {
+			return fmt.Errorf("JWT_PREVIOUS_KEYS entries look like kid:secret")
+		}
+		if len(secret) < minSigningKeyBytes {
+			return fmt.Errorf("JWT_PREVIOUS_KEYS secret for %s is shorter than %d bytes", kid, minSigningKeyBytes)
+		}
+		keys.Keys[kid] = []byte(secret)
+	}
+
+	if _, ok := keys.Keys[keys.Current]; ok {
+		return fmt.Errorf("JWT_KEY_ID %s is also in JWT_PREVIOUS_KEYS", keys.Current)
+	}
+	secret := os.Getenv("JWT_SECRET")
+	if len(secret) < minSigningKeyBytes {
+		return fmt.Errorf("JWT_SECRET must be at least %d bytes", minSigningKeyBytes)
+	}
+	keys.Keys[keys.Current] = []byte(secret)
+
+	jwtKeys = keys
+	return nil
+}
+
+func signingKey(kid string) ([]byte, error) {
+	secret, ok := jwtKeys.Keys[kid]
+	if !ok {
+		return nil, fmt.Errorf("unknown signing key: %q", kid)
+	}
+
+	return secret, nil
+}
+
+func initializeSessionsTable() error {
+	SQL := `CREATE TABLE IF NOT EXISTS sessions (
+				session_id TEXT PRIMARY KEY,
+				user_id TEXT,
+				refresh_hash TEXT,
+				user_agent TEXT,
+				ip TEXT,
+				created_at TIMESTAMP,
+				last_used_at TIMESTAMP,
+				expires_at TIMESTAMP,
+				revoked_at TIMESTAMP
+			)`
+	_, err := db.Exec(SQL)
+	if err != nil {
+		return fmt.Errorf("failed to create sessions table: %v", err)
+	}
+
+	return nil
+}
+
+// startSession records a login and returns its access and refresh tokens.
+func startSession(c *gin.Context, userID string) (string, string, error) {
+	sessionID, err := randomToken()
+	if err != nil {
+		return "", "", err
+	}
+	secret, err := randomToken()
+	if err != nil {
+		return "", "", err
+	}
+
+	expiresAt := time.Now().AddDate(0, 0, envInt("REFRESH_TOKEN_DAYS", 30))
+	SQL := `INSERT INTO sessions (session_id, user_id, refresh_hash, user_agent, ip, created_at, last_used_at, expires_at)
+			VALUES (?, ?, ?, ?, ?, ?, ?, ?)`
+	_, err = db.Exec(SQL, sessionID, userID, hashToken(secret), c.Request.UserAgent(), c.ClientIP(), time.Now(), time.Now(), expiresAt)
+	if err != nil {
+		return "", "", err
+	}
+
+	accessToken, err := generateJWT(userID, sessionID)
+	if err != nil {
+		return "", "", err
+	}
+
+	return accessToken, sessionID + "." + secret, nil
+}
+
+// refreshSession trades a refresh token for a new access token and a new refresh
+// token. A refresh token that was already used means it leaked, so the whole
+// session is revoked and both holders have to log in again.
+func refreshSession(c *gin.Context) {
+	var request RefreshRequest
+	if err := c.ShouldBindBodyWithJSON(&request); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	sessionID, secret, found := strings.Cut(request.RefreshToken, ".")
+	if !found {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "invalid refresh token"})
+		return
+	}
+
+	var userID string
+	var expiresAt time.Time
+	var revokedAt sql.NullTime
+	SQL_0 := `SELECT user_id, expires_at, revoked_at FROM sessions WHERE session_id = ?`
+	err := db.QueryRow(SQL_0, sessionID).Scan(&userID, &expiresAt, &revokedAt)
+	if err == sql.ErrNoRows {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "invalid refresh token"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	if revokedAt.Valid || time.Now().After(expiresAt) {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "session has ended, log in again"})
+		return
+	}
+
+	next, err := randomToken()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	// only the holder of the current token gets to replace it, even when two refreshes race
+	SQL_1 := `UPDATE sessions SET (refresh_hash, last_used_at) = (?, ?) WHERE session_id = ? AND refresh_hash = ? AND revoked_at IS NULL`
+	result, err := db.Exec(SQL_1, hashToken(next), time.Now(), sessionID, hashToken(secret))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		if err := revokeSessions(db, `session_id = ?`, sessionID); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "refresh token was already used, the session is revoked"})
+		return
+	}
+
+	accessToken, err := generateJWT(userID, sessionID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"token": accessToken, "refresh_token": sessionID + "." + next, "user_id": userID})
+}
+
+func logout(c *gin.Context) {
+	p, err := currentPrincipal(c)
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": err.Error()})
+		return
+	}
+
+	if err := revokeSessions(db, `session_id = ?`, p.SessionID); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "logged out"})
+}
+
+// logoutEverywhere ends every session of the user, this one included.
+func logoutEverywhere(c *gin.Context) {
+	p, err := currentPrincipal(c)
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": err.Error()})
+		return
+	}
+
+	if err := revokeSessions(db, `user_id = ?`, p.UserID); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "logged out of all devices"})
+}
+
+func getMySessions(c *gin.Context) {
+	p, err := currentPrincipal(c)
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": err.Error()})
+		return
+	}
+
+	SQL := `SELECT session_id, user_id, COALESCE(user_agent, ''), COALESCE(ip, ''), created_at, last_used_at, expires_at, revoked_at
+			FROM sessions WHERE user_id = ? AND revoked_at IS NULL AND expires_at > ? ORDER BY last_used_at DESC`
+	rows, err := db.Query(SQL, p.UserID, time.Now())
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	defer rows.Close()
+
+	sessions := []gin.H{}
+	for rows.Next() {
+		var s Session
+		err := rows.Scan(&s.SessionID, &s.UserID, &s.UserAgent, &s.IP, &s.CreatedAt, &s.LastUsedAt, &s.ExpiresAt, &s.RevokedAt)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		sessions = append(sessions, gin.H{"session": s, "current": s.SessionID == p.SessionID})
+	}
+
+	c.IndentedJSON(http.StatusOK, sessions)
+}
+
+func revokeMySession(c *gin.Context) {
+	p, err := currentPrincipal(c)
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": err.Error()})
+		return
+	}
+
+	sessionID := c.Param("session_id")
+	SQL := `UPDATE sessions SET revoked_at = ? WHERE session_id = ? AND user_id = ? AND revoked_at IS NULL`
+	result, err := db.Exec(SQL, time.Now(), sessionID, p.UserID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "session not found: " + sessionID})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "session revoked"})
+}
+
+// revokeSessions ends the sessions matching where. Their access tokens stop working
+// on the next request, not when they expire.
+func revokeSessions(ex execer, where string, args ...any) error {
+	SQL := `UPDATE sessions SET revoked_at = ? WHERE revoked_at IS NULL AND ` + where
+	_, err := ex.Exec(SQL, append([]any{time.Now()}, args...)...)
+	return err
+}
+
+// sessionActive reports whether an access token's session is still live.
+func sessionActive(sessionID string) (bool, error) {
+	var active bool
+	SQL := `SELECT EXISTS (SELECT 1 FROM sessions WHERE session_id = ? AND revoked_at IS NULL AND expires_at > ?)`
+	err := db.QueryRow(SQL, sessionID, time.Now()).Scan(&active)
+
+	return active, err
+}
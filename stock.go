@@ -0,0 +1,182 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	_ "modernc.org/sqlite"
+)
+
+// Stock is the on hand count for a product size. Sizes without a row aren't tracked
+// and never run out.
+type Stock struct {
+	ProductID string
+	Size      string
+	Quantity  int
+	UpdatedAt time.Time
+}
+
+func initializeStockTable() error {
+	SQL := `
+		CREATE TABLE IF NOT EXISTS stock (
+			product_id TEXT,
+			size TEXT,
+			quantity INT,
+			updated_at TIMESTAMP,
+			PRIMARY KEY (product_id, size)
+		)`
+	_, err := db.Exec(SQL)
+	if err != nil {
+		return err
+	} else {
+		return nil
+	}
+}
+
+func getStock(c *gin.Context) {
+	SQL := `SELECT * FROM stock ORDER BY product_id, size`
+	rows, err := db.Query(SQL)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	defer rows.Close()
+
+	stock := []Stock{}
+	for rows.Next() {
+		var s Stock
+		if err := rows.Scan(&s.ProductID, &s.Size, &s.Quantity, &s.UpdatedAt); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		stock = append(stock, s)
+	}
+
+	c.IndentedJSON(http.StatusOK, stock)
+}
+
+func setStock(c *gin.Context) {
+	productID := c.Param("product_id")
+	size := c.Param("size")
+
+	quantity, err := strconv.Atoi(c.Param("quantity"))
+	if err != nil || quantity < 0 {
+		validationFailed(c, []ValidationError{{Field: "quantity", Message: "must be 0 or more"}})
+		return
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	defer tx.Rollback()
+
+	// a size that wasn't tracked counts as plenty, so starting it low still warns
+	before := quantity + 1 + envInt("STOCK_LOW_THRESHOLD", 5)
+	err = tx.QueryRow(`SELECT quantity FROM stock WHERE (product_id, size) = (?, ?)`, productID, size).Scan(&before)
+	if err != nil && err != sql.ErrNoRows {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	SQL := `INSERT OR REPLACE INTO stock (product_id, size, quantity, updated_at) VALUES (?, ?, ?, ?)`
+	if _, err := tx.Exec(SQL, productID, size, quantity, time.Now()); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	if err := publishStockLow(tx, productID, size, before, quantity); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	message := fmt.Sprintf(`set %s's size %s stock to %d`, productID, size, quantity)
+
+	c.JSON(http.StatusOK, gin.H{"message": message})
+}
+
+// adjustStock adds delta to a tracked size, untracked sizes are left alone. Taking
+// out more than is left fails with a *ValidationError and changes nothing.
+func adjustStock(tx *sql.Tx, productID string, size string, delta int) error {
+	SQL_0 := `UPDATE stock SET (quantity, updated_at) = (quantity + ?, ?)
+			WHERE (product_id, size) = (?, ?) AND (? >= 0 OR quantity >= ?) RETURNING quantity`
+	var after int
+	err := tx.QueryRow(SQL_0, delta, time.Now(), productID, size, delta, -delta).Scan(&after)
+	if err == sql.ErrNoRows {
+		var left int
+		SQL_1 := `SELECT quantity FROM stock WHERE (product_id, size) = (?, ?)`
+		err := tx.QueryRow(SQL_1, productID, size).Scan(&left)
+		if err == sql.ErrNoRows {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		return &ValidationError{Field: "Quantity", Message: fmt.Sprintf("only %d of %s in size %s left", max(left, 0), productID, size)}
+	}
+	if err != nil {
+		return err
+	}
+
+	return publishStockLow(tx, productID, size, after-delta, after)
+}
+
+// restockItem puts up to quantity units of an order line back on the shelf, never
+// more than were taken out for it.
+func restockItem(tx *sql.Tx, itemID int, quantity int) error {
+	var productID, size string
+	var bought, restocked int
+	SQL_0 := `SELECT product_id, size, quantity, COALESCE(restocked, 0) FROM order_items WHERE item_id = ?`
+	if err := tx.QueryRow(SQL_0, itemID).Scan(&productID, &size, &bought, &restocked); err != nil {
+		return err
+	}
+
+	quantity = min(quantity, bought-restocked)
+	if quantity <= 0 {
+		return nil
+	}
+
+	SQL_1 := `UPDATE order_items SET restocked = COALESCE(restocked, 0) + ? WHERE item_id = ?`
+	if _, err := tx.Exec(SQL_1, quantity, itemID); err != nil {
+		return err
+	}
+
+	return adjustStock(tx, productID, size, quantity)
+}
+
+// restockOrder puts back everything from an order that hasn't been restocked yet.
+func restockOrder(tx *sql.Tx, orderID string) error {
+	rows, err := tx.Query(`SELECT item_id, quantity FROM order_items WHERE order_id = ?`, orderID)
+	if err != nil {
+		return err
+	}
+
+	lines := [][2]int{}
+	for rows.Next() {
+		var line [2]int
+		if err := rows.Scan(&line[0], &line[1]); err != nil {
+			rows.Close()
+			return err
+		}
+		lines = append(lines, line)
+	}
+	rows.Close()
+
+	for _, line := range lines {
+		if err := restockItem(tx, line[0], line[1]); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
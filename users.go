@@ -1,7 +1,7 @@
 package main
 
 import (
-	"fmt"
+	"database/sql"
 	"net/http"
 	"time"
 
@@ -24,6 +24,11 @@ type UserLogin struct {
 	Password string
 }
 
+// GuestCart is the cart a visitor filled before registering or logging in.
+type GuestCart struct {
+	CartID string `json:"cart_id"`
+}
+
 func initializeUserTable() error {
 	SQL := `
 		CREATE TABLE IF NOT EXISTS users (
@@ -37,6 +42,32 @@ func initializeUserTable() error {
 		)
 	`
 	_, err := db.Exec(SQL)
+	if err != nil {
+		return err
+	}
+
+	// guests used to be saved as admins, which roles read as owners
+	SQL_1 := `UPDATE users SET (is_admin, is_registered) = (0, 0) WHERE username IS NULL AND (is_admin OR is_registered)`
+	_, err = db.Exec(SQL_1)
+	if err != nil {
+		return err
+	}
+
+	// ids used to be counted up from the number of users, so two visitors could share
+	// one. A guest sharing an account's id is dropped, any other repeat gets a fresh id.
+	SQL_2 := `DELETE FROM users WHERE username IS NULL
+				AND id IN (SELECT id FROM users WHERE username IS NOT NULL)`
+	if _, err := db.Exec(SQL_2); err != nil {
+		return err
+	}
+	SQL_3 := `UPDATE users SET id = 'U' || lower(hex(randomblob(24)))
+				WHERE rowid NOT IN (SELECT MIN(rowid) FROM users GROUP BY id)`
+	if _, err := db.Exec(SQL_3); err != nil {
+		return err
+	}
+
+	SQL_4 := `CREATE UNIQUE INDEX IF NOT EXISTS users_id ON users (id)`
+	_, err = db.Exec(SQL_4)
 	if err != nil {
 		return err
 	} else {
@@ -44,10 +75,11 @@ func initializeUserTable() error {
 	}
 }
 
+// addCurrentUser saves a guest, who is neither registered nor staff.
 func addCurrentUser(userID string) error {
 	SQL := `INSERT INTO users (id, is_admin, is_registered, created_at) VALUES (?, ?, ?, ?)`
 
-	_, err := db.Exec(SQL, userID, 1, 1, time.Now())
+	_, err := db.Exec(SQL, userID, 0, 0, time.Now())
 	if err != nil {
 		return err
 	} else {
@@ -55,32 +87,81 @@ func addCurrentUser(userID string) error {
 	}
 }
 
+// generateUserID makes a random user id. Ids counted from the number of users were
+// handed out twice when two visitors arrived together.
 func generateUserID() (string, error) {
-	count, err := getCount("users")
+	token, err := randomToken()
 	if err != nil {
 		return "", err
 	}
 
-	userID := fmt.Sprintf("%06d", count+1)
-	userID = "U" + userID
+	return "U" + token, nil
+}
+
+// newGuest hands a new visitor a guest user and cart of their own to shop with until
+// they register or log in.
+func newGuest(c *gin.Context) {
+	userID, err := generateUserID()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	if err := addCurrentUser(userID); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	cartID, err := createCart(userID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
 
-	return userID, nil
+	c.JSON(http.StatusOK, gin.H{"user_id": userID, "cart_id": cartID})
 }
 
-func register(c *gin.Context, userID string) {
+// register makes an account under a user id of its own.
+func register(c *gin.Context) {
 	var user User
 	if err := c.ShouldBindBodyWithJSON(&user); err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error_1": err.Error()})
 		return
 	}
 
+	userID, err := generateUserID()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error_2": err.Error()})
+		return
+	}
+
 	hashedPassword, err := hashPassword(user.Password)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error_2": err.Error()})
 		return
 	}
 
-	SQL := `INSERT OR REPLACE INTO users (
+	tx, err := db.Begin()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error_2": err.Error()})
+		return
+	}
+	defer tx.Rollback()
+
+	// staff get their roles from an owner, only the very first account may make
+	// itself an admin so a new shop can be set up. Checking in the transaction that
+	// saves the account keeps two first registrations from both becoming owner.
+	if user.IsAdmin {
+		var staff int
+		SQL_0 := `SELECT COUNT(*) FROM users WHERE username IS NOT NULL AND is_admin`
+		if err := tx.QueryRow(SQL_0).Scan(&staff); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error_2": err.Error()})
+			return
+		}
+		user.IsAdmin = staff == 0
+	}
+
+	SQL := `INSERT INTO users (
 				id,
 				is_admin,
 				is_registered,
@@ -92,13 +173,26 @@ func register(c *gin.Context, userID string) {
 			VALUES (?, ?, ?, ?, ?, ?, ?)
 			`
 
-	_, err_1 := db.Exec(SQL, userID, user.IsAdmin, 1, user.Username, user.Email, hashedPassword, time.Now())
+	_, err_1 := tx.Exec(SQL, userID, user.IsAdmin, 1, user.Username, user.Email, hashedPassword, time.Now())
 	if err_1 != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error_3": err_1.Error()})
 		return
 	}
 
-	c.JSON(http.StatusOK, gin.H{"message": "User added.", "user_id": userID})
+	if err := tx.Commit(); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error_3": err.Error()})
+		return
+	}
+
+	var guest GuestCart
+	c.ShouldBindBodyWithJSON(&guest)
+	cartID, err := adoptGuestCart(userID, guest.CartID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error_4": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "User added.", "user_id": userID, "cart_id": cartID})
 }
 
 func login(c *gin.Context) {
@@ -129,31 +223,46 @@ func login(c *gin.Context) {
 	}
 
 	isCorrect := checkHashedPassword(login.Password, currentUser.Password)
-
-	var token string
-	if isCorrect {
-		result, err := generateJWT(currentUser.ID)
-		if err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"error_4": err.Error()})
-			return
-		}
-		token = result
-	} else {
+	if !isCorrect {
 		c.JSON(http.StatusBadRequest, gin.H{"message": "wrong password."})
 		return
 	}
 
-	loggedInID, err := validateLoggedIn(token)
+	token, refreshToken, err := startSession(c, currentUser.ID)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error_5": err.Error()})
+		c.JSON(http.StatusInternalServerError, gin.H{"error_4": err.Error()})
 		return
 	}
 
-	isAdmin, err := getAdmin(loggedInID)
+	role, err := getRole(currentUser.ID)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error_6": err.Error()})
 		return
 	}
 
-	c.JSON(http.StatusOK, gin.H{"token": token, "user_id": loggedInID, "is_admin": isAdmin})
+	var guest GuestCart
+	c.ShouldBindBodyWithJSON(&guest)
+	cartID, err := adoptGuestCart(currentUser.ID, guest.CartID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error_7": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"token": token, "refresh_token": refreshToken, "user_id": currentUser.ID, "cart_id": cartID, "is_admin": role != RoleCustomer, "role": role, "permissions": rolePermissions[role]})
+}
+
+// getUserContact returns the username and email of a registered user, both empty for guests.
+func getUserContact(userID string) (string, string, error) {
+	SQL := `SELECT COALESCE(username, ''), COALESCE(email, '') FROM users WHERE id = ?`
+
+	var username, email string
+	err := db.QueryRow(SQL, userID).Scan(&username, &email)
+	if err == sql.ErrNoRows {
+		return "", "", nil
+	}
+	if err != nil {
+		return "", "", err
+	}
+
+	return username, email, nil
 }
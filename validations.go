@@ -2,6 +2,7 @@ package main
 
 import (
 	"fmt"
+	"net/http"
 	"time"
 
 	"github.com/gin-gonic/gin"
@@ -11,6 +12,31 @@ import (
 	"golang.org/x/crypto/bcrypt"
 )
 
+type ValidationError struct {
+	Field   string
+	Message string
+}
+
+func (e *ValidationError) Error() string {
+	return e.Field + " " + e.Message
+}
+
+// validationFailed is the one response shape for rejected input, so the frontend
+// can show every problem next to its field.
+func validationFailed(c *gin.Context, errs []ValidationError) {
+	c.JSON(http.StatusBadRequest, gin.H{"error": "validation failed", "fields": errs})
+}
+
+// currentUserID returns the logged in user authenticate found on the request.
+func currentUserID(c *gin.Context) (string, error) {
+	p, err := currentPrincipal(c)
+	if err != nil {
+		return "", err
+	}
+
+	return p.UserID, nil
+}
+
 func hashPassword(password string) (string, error) {
 
 	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
@@ -27,16 +53,26 @@ func checkHashedPassword(password, hash string) bool {
 	return err == nil
 }
 
-func generateJWT(userID string) (string, error) {
+// generateJWT signs a short lived access token for a session with the current key,
+// named in the kid header.
+func generateJWT(userID string, sessionID string) (string, error) {
 	claims := jwt.MapClaims{
 		"user_id":   userID,
+		"sid":       sessionID,
 		"logged_in": true,
-		"exp":       time.Now().Add(time.Hour * 24).Unix(),
+		"iat":       time.Now().Unix(),
+		"exp":       time.Now().Add(time.Duration(envInt("ACCESS_TOKEN_MINUTES", 15)) * time.Minute).Unix(),
 	}
 
 	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
+	token.Header["kid"] = jwtKeys.Current
 
-	signedToken, err := token.SignedString(jwtSecret)
+	secret, err := signingKey(jwtKeys.Current)
+	if err != nil {
+		return "", err
+	}
+
+	signedToken, err := token.SignedString(secret)
 	if err != nil {
 		return "", err
 	}
@@ -49,7 +85,8 @@ func validateJWT(tokenString string) (*jwt.MapClaims, error) {
 		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
 			return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
 		}
-		return jwtSecret, nil
+		kid, _ := token.Header["kid"].(string)
+		return signingKey(kid)
 	})
 
 	if err != nil {
@@ -63,65 +100,27 @@ func validateJWT(tokenString string) (*jwt.MapClaims, error) {
 	return nil, fmt.Errorf("invalid token")
 }
 
-func validateLoggedIn(token string) (string, error) {
+// validateSession checks the access token and that its session hasn't been logged
+// out or revoked since it was issued.
+func validateSession(token string) (string, string, error) {
 	claims, err := validateJWT(token)
 	if err != nil {
-		return "", err
+		return "", "", err
 	}
 
-	loggedInID := (*claims)["user_id"].(string)
-	return loggedInID, nil
-}
-
-func validateAdmin(c *gin.Context) (bool, error) {
-	token := c.GetHeader("token")
-
-	id, err := validateLoggedIn(token)
-	if err != nil {
-		return false, err
+	userID, _ := (*claims)["user_id"].(string)
+	sessionID, _ := (*claims)["sid"].(string)
+	if userID == "" || sessionID == "" {
+		return "", "", fmt.Errorf("invalid token")
 	}
 
-	SQL_id := `SELECT is_admin FROM users WHERE id = ?`
-	rows, err := db.Query(SQL_id, id)
+	active, err := sessionActive(sessionID)
 	if err != nil {
-		return false, err
+		return "", "", err
 	}
-	defer rows.Close()
-
-	var isAdmin bool
-	if rows.Next() {
-		err = rows.Scan(&isAdmin)
-		if err != nil {
-			return false, err
-		}
-	}
-
-	if !isAdmin {
-		return false, fmt.Errorf("admin access only")
-	}
-
-	return isAdmin, nil
-}
-
-func getAdmin(id string) (bool, error) {
-	SQL_id := `SELECT is_admin FROM users WHERE id = ?`
-	rows, err := db.Query(SQL_id, id)
-	if err != nil {
-		return false, err
-	}
-	defer rows.Close()
-
-	var isAdmin bool
-	if rows.Next() {
-		err = rows.Scan(&isAdmin)
-		if err != nil {
-			return false, err
-		}
-	}
-
-	if !isAdmin {
-		return false, err
+	if !active {
+		return "", "", fmt.Errorf("session has ended, log in again")
 	}
 
-	return isAdmin, nil
+	return userID, sessionID, nil
 }
@@ -0,0 +1,692 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	_ "modernc.org/sqlite"
+)
+
+const (
+	EventOrderCreated       = "order.created"
+	EventOrderPaid          = "order.paid"
+	EventOrderStatusChanged = "order.status_changed"
+	EventProductUpdated     = "product.updated"
+	EventStockLow           = "stock.low"
+	EventWebhookTest        = "webhook.test"
+)
+
+var webhookEvents = []string{EventOrderCreated, EventOrderPaid, EventOrderStatusChanged, EventProductUpdated, EventStockLow}
+
+const (
+	DeliveryPending   = "pending"
+	DeliveryDelivered = "delivered"
+	DeliveryFailed    = "failed"
+)
+
+const (
+	JobWebhookPublish = "webhook.publish"
+	JobWebhookDeliver = "webhook.deliver"
+)
+
+// WebhookEndpoint is a URL that gets a signed POST for each event it subscribes to.
+// Events is a comma separated list like "order.paid,stock.low", "*" means all of them.
+type WebhookEndpoint struct {
+	EndpointID  int
+	URL         string
+	Events      string
+	Secret      string
+	Description string
+	Active      bool
+	CreatedAt   time.Time
+	UpdatedAt   time.Time
+}
+
+type WebhookDelivery struct {
+	DeliveryID     int
+	EndpointID     int
+	EventID        string
+	Event          string
+	Payload        string
+	Status         string
+	Attempts       int
+	ResponseStatus int
+	ResponseBody   string
+	Error          string
+	CreatedAt      time.Time
+	DeliveredAt    sql.NullTime
+}
+
+// WebhookEvent is the body every endpoint receives.
+type WebhookEvent struct {
+	ID        string
+	Type      string
+	CreatedAt time.Time
+	Data      json.RawMessage
+}
+
+// OrderEvent is the data of the order events. Order is filled in when the event is
+// sent out, so it's the order as it was just after the change.
+type OrderEvent struct {
+	Change OrderStatusChange
+	Order  *OrderDetail
+}
+
+type ProductEvent struct {
+	Product Product
+	Changed string
+}
+
+type StockEvent struct {
+	ProductID string
+	Size      string
+	Quantity  int
+	Threshold int
+}
+
+type webhookDeliveryJob struct {
+	DeliveryID int
+}
+
+func initializeWebhooksTables() error {
+	SQL_0 := `CREATE TABLE IF NOT EXISTS webhook_endpoints (
+				endpoint_id INTEGER PRIMARY KEY AUTOINCREMENT,
+				url TEXT,
+				events TEXT,
+				secret TEXT,
+				description TEXT,
+				active BOOLEAN,
+				created_at TIMESTAMP,
+				updated_at TIMESTAMP
+			)`
+	_, err_0 := db.Exec(SQL_0)
+	if err_0 != nil {
+		return fmt.Errorf("failed to create webhook_endpoints table: %v", err_0)
+	}
+
+	SQL_1 := `CREATE TABLE IF NOT EXISTS webhook_deliveries (
+				delivery_id INTEGER PRIMARY KEY AUTOINCREMENT,
+				endpoint_id INT,
+				event_id TEXT,
+				event TEXT,
+				payload TEXT,
+				status TEXT,
+				attempts INT,
+				response_status INT,
+				response_body TEXT,
+				error TEXT,
+				created_at TIMESTAMP,
+				delivered_at TIMESTAMP,
+				UNIQUE (endpoint_id, event_id)
+			)`
+	_, err_1 := db.Exec(SQL_1)
+	if err_1 != nil {
+		return fmt.Errorf("failed to create webhook_deliveries table: %v", err_1)
+	}
+
+	return nil
+}
+
+// ENDPOINTS
+
+func addWebhookEndpoint(c *gin.Context) {
+	var endpoint WebhookEndpoint
+	if err := c.ShouldBindBodyWithJSON(&endpoint); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if errs := validateWebhookEndpoint(&endpoint); len(errs) > 0 {
+		validationFailed(c, errs)
+		return
+	}
+
+	if endpoint.Secret == "" {
+		token, err := randomToken()
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		endpoint.Secret = "whsec_" + token
+	}
+
+	SQL := `INSERT INTO webhook_endpoints (url, events, secret, description, active, created_at, updated_at) VALUES (?, ?, ?, ?, ?, ?, ?)`
+	result, err := db.Exec(SQL, endpoint.URL, endpoint.Events, endpoint.Secret, endpoint.Description, endpoint.Active, time.Now(), time.Now())
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	endpointID, _ := result.LastInsertId()
+
+	c.JSON(http.StatusOK, gin.H{"message": "webhook endpoint saved", "endpoint_id": endpointID, "secret": endpoint.Secret})
+}
+
+// updateWebhookEndpoint replaces an endpoint's settings, an empty Secret keeps the current one.
+func updateWebhookEndpoint(c *gin.Context) {
+	endpointID := c.Param("endpoint_id")
+
+	var endpoint WebhookEndpoint
+	if err := c.ShouldBindBodyWithJSON(&endpoint); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if errs := validateWebhookEndpoint(&endpoint); len(errs) > 0 {
+		validationFailed(c, errs)
+		return
+	}
+
+	SQL := `UPDATE webhook_endpoints SET (url, events, secret, description, active, updated_at) =
+			(?, ?, COALESCE(NULLIF(?, ''), secret), ?, ?, ?) WHERE endpoint_id = ?`
+	result, err := db.Exec(SQL, endpoint.URL, endpoint.Events, endpoint.Secret, endpoint.Description, endpoint.Active, time.Now(), endpointID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "webhook endpoint not found: " + endpointID})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "webhook endpoint updated"})
+}
+
+func getWebhookEndpoints(c *gin.Context) {
+	endpoints, err := getEndpoints(false)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.IndentedJSON(http.StatusOK, endpoints)
+}
+
+// deleteWebhookEndpoint removes an endpoint, its delivery log goes with it.
+func deleteWebhookEndpoint(c *gin.Context) {
+	endpointID := c.Param("endpoint_id")
+
+	tx, err := db.Begin()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	defer tx.Rollback()
+
+	result, err := tx.Exec(`DELETE FROM webhook_endpoints WHERE endpoint_id = ?`, endpointID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "webhook endpoint not found: " + endpointID})
+		return
+	}
+
+	if _, err := tx.Exec(`DELETE FROM webhook_deliveries WHERE endpoint_id = ?`, endpointID); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "webhook endpoint deleted"})
+}
+
+func validateWebhookEndpoint(endpoint *WebhookEndpoint) []ValidationError {
+	errs := []ValidationError{}
+
+	endpoint.URL = strings.TrimSpace(endpoint.URL)
+	u, err := url.Parse(endpoint.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		errs = append(errs, ValidationError{Field: "URL", Message: "must be an http or https URL"})
+	}
+
+	events := []string{}
+	for _, event := range splitList(endpoint.Events) {
+		event = strings.ToLower(event)
+		if event != "*" && !contains(webhookEvents, event) {
+			errs = append(errs, ValidationError{Field: "Events", Message: "unknown event: " + event})
+			continue
+		}
+		events = append(events, event)
+	}
+	if len(events) == 0 {
+		errs = append(errs, ValidationError{Field: "Events", Message: "subscribe to at least one of " + strings.Join(webhookEvents, ", ")})
+	}
+	endpoint.Events = strings.Join(events, ",")
+
+	return errs
+}
+
+func getEndpoints(activeOnly bool) ([]WebhookEndpoint, error) {
+	SQL := `SELECT * FROM webhook_endpoints ORDER BY endpoint_id`
+	if activeOnly {
+		SQL = `SELECT * FROM webhook_endpoints WHERE active = true ORDER BY endpoint_id`
+	}
+	rows, err := db.Query(SQL)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	endpoints := []WebhookEndpoint{}
+	for rows.Next() {
+		var e WebhookEndpoint
+		err := rows.Scan(&e.EndpointID, &e.URL, &e.Events, &e.Secret, &e.Description, &e.Active, &e.CreatedAt, &e.UpdatedAt)
+		if err != nil {
+			return nil, err
+		}
+		endpoints = append(endpoints, e)
+	}
+
+	return endpoints, nil
+}
+
+func getEndpoint(endpointID int) (WebhookEndpoint, error) {
+	var e WebhookEndpoint
+	SQL := `SELECT * FROM webhook_endpoints WHERE endpoint_id = ?`
+	err := db.QueryRow(SQL, endpointID).Scan(&e.EndpointID, &e.URL, &e.Events, &e.Secret, &e.Description, &e.Active, &e.CreatedAt, &e.UpdatedAt)
+
+	return e, err
+}
+
+func (e WebhookEndpoint) subscribes(event string) bool {
+	events := splitList(e.Events)
+	return contains(events, "*") || contains(events, event)
+}
+
+// PUBLISHING
+
+// publishEvent queues an event for every endpoint subscribed to it. Like enqueueJob,
+// pass the transaction making the change so the event can't outlive a rollback.
+func publishEvent(ex execer, eventType string, data any) error {
+	body, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+
+	token, err := randomToken()
+	if err != nil {
+		return err
+	}
+
+	event := WebhookEvent{ID: "evt_" + token, Type: eventType, CreatedAt: time.Now(), Data: body}
+
+	return enqueueJob(ex, JobWebhookPublish, event, time.Now())
+}
+
+// publishOrderEvents turns an order status change into its webhook events: a new order
+// is order.created, paying it is order.paid and every later move is order.status_changed.
+func publishOrderEvents(tx *sql.Tx, change OrderStatusChange) error {
+	events := []string{}
+	if change.FromStatus == "" {
+		events = append(events, EventOrderCreated)
+	} else {
+		events = append(events, EventOrderStatusChanged)
+	}
+	if change.ToStatus == StatusPaid {
+		events = append(events, EventOrderPaid)
+	}
+
+	for _, event := range events {
+		if err := publishEvent(tx, event, OrderEvent{Change: change}); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// publishProductUpdated sends product.updated after an edit. The edit is already
+// saved, so a failure here is only logged.
+func publishProductUpdated(productID string, changed string) {
+	product, err := getProduct(productID)
+	if err != nil {
+		log.Printf("product.updated for %s failed: %v", productID, err)
+		return
+	}
+
+	if err := publishEvent(db, EventProductUpdated, ProductEvent{Product: product, Changed: changed}); err != nil {
+		log.Printf("product.updated for %s failed: %v", productID, err)
+	}
+}
+
+// publishStockLow sends stock.low when a size drops to STOCK_LOW_THRESHOLD (5) or
+// below. Only crossing the threshold counts, so selling the last few units doesn't
+// send one event per sale.
+func publishStockLow(ex execer, productID string, size string, before int, after int) error {
+	threshold := envInt("STOCK_LOW_THRESHOLD", 5)
+	if before <= threshold || after > threshold {
+		return nil
+	}
+
+	return publishEvent(ex, EventStockLow, StockEvent{ProductID: productID, Size: size, Quantity: after, Threshold: threshold})
+}
+
+// fanOutEvent is the webhook.publish job. It records one delivery per subscribed
+// endpoint and queues each to be sent on its own, so a slow or broken endpoint
+// doesn't hold up the others. Running it twice doesn't deliver anything twice.
+func fanOutEvent(job Job) error {
+	var event WebhookEvent
+	if err := json.Unmarshal([]byte(job.Payload), &event); err != nil {
+		return err
+	}
+
+	if strings.HasPrefix(event.Type, "order.") {
+		var data OrderEvent
+		if err := json.Unmarshal(event.Data, &data); err != nil {
+			return err
+		}
+		detail, err := getOrderDetail(data.Change.OrderID)
+		if err != nil {
+			return err
+		}
+		data.Order = &detail
+
+		body, err := json.Marshal(data)
+		if err != nil {
+			return err
+		}
+		event.Data = body
+	}
+
+	payload, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+
+	endpoints, err := getEndpoints(true)
+	if err != nil {
+		return err
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for _, endpoint := range endpoints {
+		if !endpoint.subscribes(event.Type) {
+			continue
+		}
+
+		deliveryID, err := pushWebhookDelivery(tx, endpoint.EndpointID, event, payload)
+		if err != nil {
+			return err
+		}
+		if deliveryID == 0 {
+			continue
+		}
+
+		if err := enqueueJob(tx, JobWebhookDeliver, webhookDeliveryJob{DeliveryID: deliveryID}, time.Now()); err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// pushWebhookDelivery records a pending delivery, returning 0 if the endpoint
+// already has one for this event.
+func pushWebhookDelivery(ex execer, endpointID int, event WebhookEvent, payload []byte) (int, error) {
+	SQL := `INSERT OR IGNORE INTO webhook_deliveries
+				(endpoint_id, event_id, event, payload, status, attempts, response_status, response_body, error, created_at)
+			VALUES (?, ?, ?, ?, ?, 0, 0, '', '', ?)`
+	result, err := ex.Exec(SQL, endpointID, event.ID, event.Type, string(payload), DeliveryPending, time.Now())
+	if err != nil {
+		return 0, err
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		return 0, nil
+	}
+
+	deliveryID, err := result.LastInsertId()
+
+	return int(deliveryID), err
+}
+
+// DELIVERY
+
+// deliverWebhook is the webhook.deliver job. Retries come from the job queue, the
+// delivery is failed once its job has no attempts left.
+func deliverWebhook(job Job) error {
+	var payload webhookDeliveryJob
+	if err := json.Unmarshal([]byte(job.Payload), &payload); err != nil {
+		return err
+	}
+
+	delivery, err := getWebhookDelivery(payload.DeliveryID)
+	if err == sql.ErrNoRows {
+		// the endpoint was deleted with its log, nothing left to send
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if delivery.Status == DeliveryDelivered {
+		return nil
+	}
+
+	return attemptWebhookDelivery(delivery, job.Attempts >= job.MaxAttempts)
+}
+
+// attemptWebhookDelivery POSTs a delivery once and records the response. The body is
+// signed with the endpoint's secret: X-Webhook-Signature is "t=<unix time>,v1=<hex>"
+// where v1 is the HMAC-SHA256 of "<unix time>.<body>". Receivers should check it and
+// reject old timestamps.
+func attemptWebhookDelivery(delivery WebhookDelivery, last bool) error {
+	endpoint, err := getEndpoint(delivery.EndpointID)
+	if err != nil {
+		return err
+	}
+
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	request, err := http.NewRequest(http.MethodPost, endpoint.URL, strings.NewReader(delivery.Payload))
+	if err != nil {
+		return recordWebhookAttempt(delivery, 0, "", err, last)
+	}
+	request.Header.Set("Content-Type", "application/json")
+	request.Header.Set("User-Agent", "incense-web-shop-webhooks")
+	request.Header.Set("X-Webhook-Event", delivery.Event)
+	request.Header.Set("X-Webhook-ID", delivery.EventID)
+	request.Header.Set("X-Webhook-Delivery", strconv.Itoa(delivery.DeliveryID))
+	request.Header.Set("X-Webhook-Signature", "t="+timestamp+",v1="+signWebhook(endpoint.Secret, timestamp, delivery.Payload))
+
+	client := http.Client{Timeout: time.Duration(envInt("WEBHOOK_TIMEOUT_SECONDS", 10)) * time.Second}
+	response, err := client.Do(request)
+	if err != nil {
+		return recordWebhookAttempt(delivery, 0, "", err, last)
+	}
+	defer response.Body.Close()
+
+	// only the start of the response is kept, it's there to help debug the receiver
+	body, _ := io.ReadAll(io.LimitReader(response.Body, 1024))
+	if response.StatusCode < 200 || response.StatusCode > 299 {
+		err = fmt.Errorf("endpoint answered %s", response.Status)
+	}
+
+	return recordWebhookAttempt(delivery, response.StatusCode, string(body), err, last)
+}
+
+func signWebhook(secret string, timestamp string, payload string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp + "." + payload))
+
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// recordWebhookAttempt saves the outcome of an attempt and hands back its error, so
+// the job is retried when the attempt failed.
+func recordWebhookAttempt(delivery WebhookDelivery, status int, body string, attemptErr error, last bool) error {
+	SQL := `UPDATE webhook_deliveries SET (status, attempts, response_status, response_body, error, delivered_at) =
+			(?, attempts + 1, ?, ?, ?, ?) WHERE delivery_id = ?`
+
+	if attemptErr == nil {
+		_, err := db.Exec(SQL, DeliveryDelivered, status, body, "", time.Now(), delivery.DeliveryID)
+		return err
+	}
+
+	state := DeliveryPending
+	if last {
+		state = DeliveryFailed
+	}
+	if _, err := db.Exec(SQL, state, status, body, attemptErr.Error(), nil, delivery.DeliveryID); err != nil {
+		log.Printf("webhook delivery %d: %v", delivery.DeliveryID, err)
+	}
+
+	return attemptErr
+}
+
+func getWebhookDelivery(deliveryID int) (WebhookDelivery, error) {
+	var d WebhookDelivery
+	SQL := `SELECT * FROM webhook_deliveries WHERE delivery_id = ?`
+	err := db.QueryRow(SQL, deliveryID).Scan(&d.DeliveryID, &d.EndpointID, &d.EventID, &d.Event, &d.Payload, &d.Status, &d.Attempts,
+		&d.ResponseStatus, &d.ResponseBody, &d.Error, &d.CreatedAt, &d.DeliveredAt)
+
+	return d, err
+}
+
+// ADMIN
+
+func getWebhookDeliveries(c *gin.Context) {
+	endpointID := c.Param("endpoint_id")
+
+	where, args := "endpoint_id = ?", []any{endpointID}
+	if status := c.Query("status"); status != "" {
+		where, args = where+" AND status = ?", append(args, status)
+	}
+	if event := c.Query("event"); event != "" {
+		where, args = where+" AND event = ?", append(args, event)
+	}
+
+	SQL := `SELECT * FROM webhook_deliveries WHERE ` + where + ` ORDER BY delivery_id DESC LIMIT 200`
+	rows, err := db.Query(SQL, args...)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	defer rows.Close()
+
+	deliveries := []WebhookDelivery{}
+	for rows.Next() {
+		var d WebhookDelivery
+		err := rows.Scan(&d.DeliveryID, &d.EndpointID, &d.EventID, &d.Event, &d.Payload, &d.Status, &d.Attempts,
+			&d.ResponseStatus, &d.ResponseBody, &d.Error, &d.CreatedAt, &d.DeliveredAt)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		deliveries = append(deliveries, d)
+	}
+
+	c.IndentedJSON(http.StatusOK, deliveries)
+}
+
+// redeliverWebhook sends a delivery again with a fresh job, whatever happened to it before.
+func redeliverWebhook(c *gin.Context) {
+	endpointID := c.Param("endpoint_id")
+	deliveryID, err := strconv.Atoi(c.Param("delivery_id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	defer tx.Rollback()
+
+	SQL := `UPDATE webhook_deliveries SET (status, delivered_at) = (?, NULL) WHERE delivery_id = ? AND endpoint_id = ?`
+	result, err := tx.Exec(SQL, DeliveryPending, deliveryID, endpointID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "webhook delivery not found"})
+		return
+	}
+
+	if err := enqueueJob(tx, JobWebhookDeliver, webhookDeliveryJob{DeliveryID: deliveryID}, time.Now()); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "redelivering"})
+}
+
+// sendTestWebhook sends a webhook.test event to one endpoint straight away and answers
+// with how it went. It's logged like any delivery but never retried.
+func sendTestWebhook(c *gin.Context) {
+	endpointID, err := strconv.Atoi(c.Param("endpoint_id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if _, err := getEndpoint(endpointID); err == sql.ErrNoRows {
+		c.JSON(http.StatusNotFound, gin.H{"error": "webhook endpoint not found: " + c.Param("endpoint_id")})
+		return
+	} else if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	token, err := randomToken()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	data, _ := json.Marshal(gin.H{"Message": "test event from " + envString("STORE_NAME", "Incense Web Shop")})
+	event := WebhookEvent{ID: "evt_" + token, Type: EventWebhookTest, CreatedAt: time.Now(), Data: data}
+
+	payload, err := json.Marshal(event)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	deliveryID, err := pushWebhookDelivery(db, endpointID, event, payload)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	delivery, err := getWebhookDelivery(deliveryID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	attemptWebhookDelivery(delivery, true)
+
+	delivery, err = getWebhookDelivery(deliveryID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.IndentedJSON(http.StatusOK, delivery)
+}
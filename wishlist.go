@@ -0,0 +1,386 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	_ "modernc.org/sqlite"
+)
+
+type WishlistItem struct {
+	WishlistItemID int
+	UserID         string
+	ProductID      string `json:"product_id"`
+	Size           string
+	SavedPrice     int
+	Notes          string
+	CreatedAt      time.Time
+}
+
+// WishlistEntry is a saved item as shown to the shopper, with the price it has now.
+type WishlistEntry struct {
+	WishlistItem
+	Name         string
+	Image        string
+	CurrentPrice int
+	PriceDropped bool
+}
+
+func initializeWishlistTables() error {
+	SQL_0 := `CREATE TABLE IF NOT EXISTS wishlist_items (
+				item_id INTEGER PRIMARY KEY AUTOINCREMENT,
+				user_id TEXT,
+				product_id TEXT,
+				size TEXT,
+				saved_price INT,
+				notes TEXT,
+				created_at TIMESTAMP
+			)`
+	_, err_0 := db.Exec(SQL_0)
+	if err_0 != nil {
+		return fmt.Errorf("failed to create wishlist_items table: %v", err_0)
+	}
+
+	SQL_1 := `CREATE TABLE IF NOT EXISTS wishlist_shares (
+				user_id TEXT PRIMARY KEY,
+				token TEXT UNIQUE,
+				created_at TIMESTAMP
+			)`
+	_, err_1 := db.Exec(SQL_1)
+	if err_1 != nil {
+		return fmt.Errorf("failed to create wishlist_shares table: %v", err_1)
+	}
+
+	return nil
+}
+
+func getWishlist(c *gin.Context) {
+	userID, err := currentUserID(c)
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": err.Error()})
+		return
+	}
+
+	entries, err := getWishlistEntries(userID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.IndentedJSON(http.StatusOK, entries)
+}
+
+func addToWishlist(c *gin.Context) {
+	userID, err := currentUserID(c)
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": err.Error()})
+		return
+	}
+
+	var item WishlistItem
+	if err := c.ShouldBindBodyWithJSON(&item); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	errs := []ValidationError{}
+	if item.ProductID == "" {
+		errs = append(errs, ValidationError{Field: "product_id", Message: "is required"})
+	}
+	if item.Size == "" {
+		errs = append(errs, ValidationError{Field: "Size", Message: "is required"})
+	}
+	if len(errs) > 0 {
+		validationFailed(c, errs)
+		return
+	}
+
+	price, found, err := getCurrentPrice(item.ProductID, item.Size)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if !found {
+		validationFailed(c, []ValidationError{{Field: "Size", Message: fmt.Sprintf("%s isn't sold in size %s", item.ProductID, item.Size)}})
+		return
+	}
+
+	item.UserID = userID
+	item.SavedPrice = price
+	if err := saveWishlistItem(item); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	message := fmt.Sprintf(`saved %s to %s's wishlist`, item.ProductID, userID)
+
+	c.JSON(http.StatusOK, gin.H{"message": message})
+}
+
+func removeFromWishlist(c *gin.Context) {
+	userID, err := currentUserID(c)
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": err.Error()})
+		return
+	}
+
+	itemID := c.Param("item_id")
+	SQL := `DELETE FROM wishlist_items WHERE (user_id, item_id) = (?, ?)`
+
+	_, err = db.Exec(SQL, userID, itemID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	message := fmt.Sprintf(`removed %s from %s's wishlist`, itemID, userID)
+
+	c.JSON(http.StatusOK, gin.H{"message": message})
+}
+
+// moveToCart puts a wishlist item in the user's cart at today's price.
+func moveToCart(c *gin.Context) {
+	userID, err := currentUserID(c)
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": err.Error()})
+		return
+	}
+
+	itemID := c.Param("item_id")
+	item, err := getWishlistItem(userID, itemID)
+	if err == sql.ErrNoRows {
+		c.JSON(http.StatusNotFound, gin.H{"error": fmt.Sprintf(`item %s is not in the wishlist`, itemID)})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	cartID, err := userCart(userID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	cartItem := CartItem{CartID: cartID, ProductID: item.ProductID, Size: item.Size, Quantity: 1, Notes: item.Notes}
+	_, err = addItemToCart(cartItem)
+	if ve, ok := err.(*ValidationError); ok {
+		validationFailed(c, []ValidationError{*ve})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	SQL := `DELETE FROM wishlist_items WHERE item_id = ?`
+	if _, err := db.Exec(SQL, item.WishlistItemID); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	message := fmt.Sprintf(`moved %s to cart %s`, item.ProductID, cartID)
+
+	c.JSON(http.StatusOK, gin.H{"message": message, "cart_id": cartID})
+}
+
+// saveForLater moves a cart line to the wishlist, remembering the price it had in the cart.
+func saveForLater(c *gin.Context) {
+	userID, err := currentUserID(c)
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": err.Error()})
+		return
+	}
+
+	cartID := c.Param("cart_id")
+	itemID := c.Param("item_id")
+
+	SQL := `SELECT * FROM cart_items WHERE (cart_id, item_id) = (?, ?)`
+	rows, err := db.Query(SQL, cartID, itemID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	items, err := bindCartItems(rows)
+	rows.Close()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if len(items) == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": fmt.Sprintf(`item %s is not in cart %s`, itemID, cartID)})
+		return
+	}
+
+	cartItem := items[0]
+	item := WishlistItem{UserID: userID, ProductID: cartItem.ProductID, Size: cartItem.Size, SavedPrice: cartItem.Price, Notes: cartItem.Notes}
+	if err := saveWishlistItem(item); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	if err := deleteCartItem(cartID, itemID); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	if err := touchCart(cartID); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	message := fmt.Sprintf(`saved %s for later`, cartItem.ProductID)
+
+	c.JSON(http.StatusOK, gin.H{"message": message})
+}
+
+// SHARING
+
+func shareWishlist(c *gin.Context) {
+	userID, err := currentUserID(c)
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": err.Error()})
+		return
+	}
+
+	SQL_0 := `SELECT token FROM wishlist_shares WHERE user_id = ?`
+	var token string
+	err = db.QueryRow(SQL_0, userID).Scan(&token)
+	if err == sql.ErrNoRows {
+		token, err = randomToken()
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+
+		SQL_1 := `INSERT INTO wishlist_shares (user_id, token, created_at) VALUES (?, ?, ?)`
+		_, err = db.Exec(SQL_1, userID, token, time.Now())
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"token": token, "url": shopURL() + "/wishlist/" + token})
+}
+
+func unshareWishlist(c *gin.Context) {
+	userID, err := currentUserID(c)
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": err.Error()})
+		return
+	}
+
+	SQL := `DELETE FROM wishlist_shares WHERE user_id = ?`
+	_, err = db.Exec(SQL, userID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "wishlist is private"})
+}
+
+func getSharedWishlist(c *gin.Context) {
+	token := c.Param("token")
+	SQL := `SELECT user_id FROM wishlist_shares WHERE token = ?`
+
+	var userID string
+	err := db.QueryRow(SQL, token).Scan(&userID)
+	if err == sql.ErrNoRows {
+		c.JSON(http.StatusNotFound, gin.H{"error": "wishlist not found"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	entries, err := getWishlistEntries(userID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	// the owner's notes and saved prices stay private
+	for i := range entries {
+		entries[i].UserID = ""
+		entries[i].Notes = ""
+		entries[i].SavedPrice = 0
+		entries[i].PriceDropped = false
+	}
+
+	c.IndentedJSON(http.StatusOK, entries)
+}
+
+// STORAGE
+
+func saveWishlistItem(item WishlistItem) error {
+	SQL_0 := `SELECT COUNT(*) FROM wishlist_items WHERE (user_id, product_id, size) = (?, ?, ?)`
+	var count int
+	if err := db.QueryRow(SQL_0, item.UserID, item.ProductID, item.Size).Scan(&count); err != nil {
+		return err
+	}
+	if count > 0 {
+		return nil
+	}
+
+	SQL := `INSERT INTO wishlist_items (user_id, product_id, size, saved_price, notes, created_at) VALUES (?, ?, ?, ?, ?, ?)`
+	_, err := db.Exec(SQL, item.UserID, item.ProductID, item.Size, item.SavedPrice, item.Notes, time.Now())
+	if err != nil {
+		return err
+	} else {
+		return nil
+	}
+}
+
+func getWishlistItem(userID string, itemID string) (WishlistItem, error) {
+	SQL := `SELECT * FROM wishlist_items WHERE (user_id, item_id) = (?, ?)`
+
+	var item WishlistItem
+	err := db.QueryRow(SQL, userID, itemID).Scan(&item.WishlistItemID, &item.UserID, &item.ProductID, &item.Size, &item.SavedPrice, &item.Notes, &item.CreatedAt)
+	return item, err
+}
+
+func getWishlistEntries(userID string) ([]WishlistEntry, error) {
+	SQL := `SELECT w.item_id, w.user_id, w.product_id, w.size, w.saved_price, w.notes, w.created_at,
+				COALESCE(p.name, ''), COALESCE(p.image, '')
+			FROM wishlist_items w LEFT JOIN products p ON p.product_id = w.product_id
+			WHERE w.user_id = ?
+			ORDER BY w.item_id DESC`
+	rows, err := db.Query(SQL, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	entries := []WishlistEntry{}
+	for rows.Next() {
+		var entry WishlistEntry
+		err := rows.Scan(&entry.WishlistItemID, &entry.UserID, &entry.ProductID, &entry.Size, &entry.SavedPrice, &entry.Notes, &entry.CreatedAt,
+			&entry.Name, &entry.Image)
+		if err != nil {
+			rows.Close()
+			return entries, err
+		}
+		entries = append(entries, entry)
+	}
+	rows.Close()
+
+	for i, entry := range entries {
+		price, found, err := getCurrentPrice(entry.ProductID, entry.Size)
+		if err != nil {
+			return entries, err
+		}
+		if !found {
+			price = entry.SavedPrice
+		}
+		entries[i].CurrentPrice = price
+		entries[i].PriceDropped = price < entry.SavedPrice
+	}
+
+	return entries, nil
+}